@@ -0,0 +1,110 @@
+package main
+
+import (
+	mor "../morpheus"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+)
+
+func parseDate(date string) (time.Time, error) {
+	if date == "" {
+		return time.Time{}, nil
+	}
+	return time.ParseInLocation("2006-01-02", date, time.Local)
+}
+
+func main() {
+	configName := flag.String("config", "morpheus", "name of the config file, without extension")
+	account := flag.Int("account", 0, "account of the config file to use")
+	format := flag.String("format", "text", "output format: json, text or html")
+	since := flag.String("since", "", "export the events since this date (YYYY-MM-DD)")
+	until := flag.String("until", "", "export the events before this date (YYYY-MM-DD)")
+	output := flag.String("o", "", "output file, stdout by default")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [options] roomIDorAlias\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	var opts mor.ExportOptions
+	var err error
+	if opts.Format, err = mor.ParseExportFormat(*format); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if opts.Since, err = parseDate(*since); err != nil {
+		fmt.Fprintln(os.Stderr, "since:", err)
+		os.Exit(2)
+	}
+	if opts.Until, err = parseDate(*until); err != nil {
+		fmt.Fprintln(os.Stderr, "until:", err)
+		os.Exit(2)
+	}
+	opts.Progress = func(n int) {
+		fmt.Fprintf(os.Stderr, "\rFetched %d events", n)
+	}
+
+	cfgs, err := mor.ReadConfigs(*configName, []string{"."})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if *account < 0 || *account >= len(cfgs) {
+		fmt.Fprintf(os.Stderr, "Account %d not found\n", *account)
+		os.Exit(2)
+	}
+	cfg := cfgs[*account]
+	// The index and the logs are fed by trinity, which may be running and
+	// holding their locks
+	cfg.IndexDB, cfg.LogDir = "", ""
+	// Log in with a new device, deleted when logging out, instead of the
+	// one of trinity
+	cfg.DeviceID = ""
+	cfg.DeviceDisplayName = "morpheus export"
+	c, err := mor.NewClientConfig(cfg, mor.NewBus())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if err := c.Login(); err != nil {
+		fmt.Fprintln(os.Stderr, "login:", err)
+		os.Exit(1)
+	}
+	err = export(c, flag.Arg(0), *output, opts)
+	if err := c.Logout(); err != nil {
+		fmt.Fprintln(os.Stderr, "logout:", err)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func export(c *mor.Client, roomIDorAlias, output string, opts mor.ExportOptions) error {
+	roomID, err := c.ResolveRoomID(roomIDorAlias)
+	if err != nil {
+		return fmt.Errorf("room: %v", err)
+	}
+	w := os.Stdout
+	if output != "" {
+		f, err := os.Create(output)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	n, err := c.ExportRoom(roomID, w, opts)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return fmt.Errorf("export: %v", err)
+	}
+	fmt.Fprintf(os.Stderr, "Exported %d events of %s\n", n, roomID)
+	return nil
+}
@@ -0,0 +1,196 @@
+package morpheus
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/matrix-org/gomatrix"
+	"sync"
+)
+
+// auth holds the refresh state of the session.  Every time the access token
+// is replaced gen is incremented, so that requests that failed with an old
+// token can tell whether they should trigger a refresh or just retry.  mux
+// protects the state, and renew is held while the session is renewed, which
+// may wait for the user to type the password.
+type auth struct {
+	refreshToken string
+	gen          uint64
+	mux          sync.Mutex
+	renew        sync.Mutex
+}
+
+func (a *auth) generation() uint64 {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	return a.gen
+}
+
+type reqLogin struct {
+	gomatrix.ReqLogin
+	RefreshToken bool `json:"refresh_token,omitempty"`
+}
+
+type respLogin struct {
+	gomatrix.RespLogin
+	RefreshToken string `json:"refresh_token"`
+	ExpiresInMs  int64  `json:"expires_in_ms"`
+}
+
+type reqRefresh struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+type respRefresh struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresInMs  int64  `json:"expires_in_ms"`
+}
+
+func respErrCode(err error) string {
+	httpErr, ok := err.(gomatrix.HTTPError)
+	if !ok {
+		return ""
+	}
+	switch respErr := httpErr.WrappedError.(type) {
+	case gomatrix.RespError:
+		return respErr.ErrCode
+	case *gomatrix.RespError:
+		return respErr.ErrCode
+	}
+	return ""
+}
+
+type respUnknownToken struct {
+	ErrCode    string `json:"errcode"`
+	SoftLogout bool   `json:"soft_logout"`
+}
+
+// unknownToken returns true if the homeserver rejected the access token, and
+// whether it's a soft logout, after which the session can be refreshed.  A
+// hard logout (the device was deleted) requires logging in again.
+func unknownToken(err error) (unknown, soft bool) {
+	if respErrCode(err) != "M_UNKNOWN_TOKEN" {
+		return false, false
+	}
+	httpErr, _ := err.(gomatrix.HTTPError)
+	var res respUnknownToken
+	if err := json.Unmarshal(httpErr.Contents, &res); err != nil {
+		return true, false
+	}
+	return true, res.SoftLogout
+}
+
+// setSession replaces the credentials of the session.
+func (c *Client) setSession(userID, accessToken, refreshToken string) {
+	c.auth.mux.Lock()
+	defer c.auth.mux.Unlock()
+	c.cli.SetCredentials(userID, accessToken)
+	c.auth.refreshToken = refreshToken
+	c.auth.gen++
+}
+
+func (c *Client) clearSession() {
+	c.auth.mux.Lock()
+	defer c.auth.mux.Unlock()
+	c.cli.ClearCredentials()
+	c.auth.refreshToken = ""
+	c.auth.gen++
+}
+
+func (c *Client) login(password string) (*respLogin, error) {
+	req := reqLogin{
+		ReqLogin: gomatrix.ReqLogin{
+			Type:                     "m.login.password",
+			User:                     c.cfg.Username,
+			Password:                 password,
+			DeviceID:                 c.cfg.DeviceID,
+			InitialDeviceDisplayName: c.cfg.DeviceDisplayName,
+		},
+		RefreshToken: true,
+	}
+	var res respLogin
+	if _, err := c.cli.MakeRequest("POST", c.cli.BuildURL("login"), &req, &res); err != nil {
+		return nil, err
+	}
+	c.DebugPrintf("AccessToken:\n%s", res.AccessToken)
+	// Reuse the device in the following logins
+	c.cfg.DeviceID = res.DeviceID
+	return &res, nil
+}
+
+// refresh exchanges the refresh token for a new access token.
+func (c *Client) refresh() error {
+	c.auth.mux.Lock()
+	oldRefreshToken := c.auth.refreshToken
+	c.auth.mux.Unlock()
+	if oldRefreshToken == "" {
+		return fmt.Errorf("No refresh token available")
+	}
+	req := reqRefresh{RefreshToken: oldRefreshToken}
+	var res respRefresh
+	// The refresh request must not carry the expired access token
+	cli, _ := gomatrix.NewClient(c.cli.HomeserverURL.String(), "", "")
+	cli.Prefix = c.cli.Prefix
+	if _, err := cli.MakeRequest("POST", cli.BuildURL("refresh"), &req, &res); err != nil {
+		return err
+	}
+	refreshToken := res.RefreshToken
+	if refreshToken == "" {
+		refreshToken = oldRefreshToken
+	}
+	c.setSession(c.cli.UserID, res.AccessToken, refreshToken)
+	c.DebugPrintf("Refreshed AccessToken:\n%s", res.AccessToken)
+	return nil
+}
+
+// renewSession tries to get a valid access token after a request made with
+// the token of generation gen was rejected.  If another request already
+// renewed the session in the meantime, it returns immediately so that the
+// caller can retry.  Requests that fail while a renewal is in progress wait
+// for it to finish, the others go on.  After a soft logout the session is
+// refreshed, and if it can't be or after a hard logout the user is asked for
+// the password.
+func (c *Client) renewSession(gen uint64, soft bool, cause error) error {
+	c.auth.renew.Lock()
+	defer c.auth.renew.Unlock()
+	if c.auth.generation() != gen {
+		return nil
+	}
+	if soft {
+		err := c.refresh()
+		if err == nil {
+			return nil
+		}
+		c.ConsolePrint(MsgTxtTypeNotice, "Session expired: ", err)
+	} else {
+		c.ConsolePrint(MsgTxtTypeNotice, "Logged out: ", cause)
+	}
+	for {
+		password, ok := c.Rs.bus.reauth(c, cause)
+		if !ok {
+			return cause
+		}
+		res, err := c.login(password)
+		if err == nil {
+			c.setSession(res.UserID, res.AccessToken, res.RefreshToken)
+			c.ConsolePrintf(MsgTxtTypeNotice, "Logged in to %s", c.cfg.Homeserver)
+			return nil
+		}
+		c.ConsolePrint(MsgTxtTypeNotice, "login: ", err)
+	}
+}
+
+// withAuth runs fn, and if it fails because the access token is no longer
+// valid, renews the session and runs fn again.
+func (c *Client) withAuth(fn func() error) error {
+	gen := c.auth.generation()
+	err := fn()
+	unknown, soft := unknownToken(err)
+	if !unknown {
+		return err
+	}
+	if err := c.renewSession(gen, soft, err); err != nil {
+		return err
+	}
+	return fn()
+}
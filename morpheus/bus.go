@@ -0,0 +1,260 @@
+package morpheus
+
+import (
+	"sync"
+	"time"
+)
+
+// MaxQueueLen is the number of events queued for a Subscription that doesn't
+// keep up, past which the oldest ones are dropped.
+const MaxQueueLen = 10000
+
+// reauthTimeout is how long reauth waits for the password
+const reauthTimeout = 10 * time.Minute
+
+type BusEventType int
+
+const (
+	BusAddUser    BusEventType = iota
+	BusDelUser    BusEventType = iota
+	BusUpdateUser BusEventType = iota
+	BusAddRoom    BusEventType = iota
+	BusDelRoom    BusEventType = iota
+	BusUpdateRoom BusEventType = iota
+	BusMessage    BusEventType = iota
+	BusCmd        BusEventType = iota
+	BusReauth     BusEventType = iota
+)
+
+func (t BusEventType) String() string {
+	switch t {
+	case BusAddUser:
+		return "BusAddUser"
+	case BusDelUser:
+		return "BusDelUser"
+	case BusUpdateUser:
+		return "BusUpdateUser"
+	case BusAddRoom:
+		return "BusAddRoom"
+	case BusDelRoom:
+		return "BusDelRoom"
+	case BusUpdateRoom:
+		return "BusUpdateRoom"
+	case BusMessage:
+		return "BusMessage"
+	case BusCmd:
+		return "BusCmd"
+	case BusReauth:
+		return "BusReauth"
+	default:
+		return ""
+	}
+}
+
+// BusEvent is a change notified by a Client.  The fields that are set depend
+// on the Type:
+//
+//	BusAddUser, BusDelUser, BusUpdateUser: Room, User
+//	BusAddRoom, BusDelRoom: Room
+//	BusUpdateRoom: Room, State
+//	BusMessage: Room, Event
+//	BusCmd: Room, Args
+//	BusReauth: Err, Reply, Done
+type BusEvent struct {
+	Type   BusEventType
+	Client *Client
+	Room   *Room
+	User   *User
+	State  RoomState
+	Event  *Event
+	Args   []string
+	Err    error
+	// Reply must receive the password of a BusReauth, or be closed to
+	// give up.
+	Reply chan<- string
+	// Done is closed when the BusReauth stops waiting for Reply.
+	Done <-chan struct{}
+}
+
+// BusFilter selects the events delivered to a Subscription.  Empty fields
+// match everything.
+type BusFilter struct {
+	// Rooms is a list of room IDs
+	Rooms []string
+	Types []BusEventType
+}
+
+func (f *BusFilter) match(ev *BusEvent) bool {
+	if len(f.Types) != 0 {
+		found := false
+		for _, t := range f.Types {
+			if t == ev.Type {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(f.Rooms) != 0 {
+		if ev.Room == nil {
+			return false
+		}
+		found := false
+		for _, roomID := range f.Rooms {
+			if roomID == ev.Room.ID() {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+type Subscription struct {
+	// C delivers the events in the order they were published.  It's
+	// closed after Unsubscribe.
+	C      <-chan BusEvent
+	c      chan BusEvent
+	filter BusFilter
+	// queue holds the events that don't fit in C until the subscriber
+	// reads them, ready is signaled when it gets events
+	queue []BusEvent
+	// dropped counts the events dropped from a full queue
+	dropped int
+	mux     sync.Mutex
+	ready   chan struct{}
+	done    chan struct{}
+	once    sync.Once
+}
+
+// Dropped returns the number of events that the subscriber missed because
+// its queue was full.
+func (s *Subscription) Dropped() int {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return s.dropped
+}
+
+// push queues an event for the subscriber without blocking, dropping the
+// oldest one if the queue is full.
+func (s *Subscription) push(ev BusEvent) {
+	s.mux.Lock()
+	if len(s.queue) >= MaxQueueLen {
+		s.queue[0] = BusEvent{}
+		s.queue = s.queue[1:]
+		s.dropped++
+	}
+	s.queue = append(s.queue, ev)
+	s.mux.Unlock()
+	select {
+	case s.ready <- struct{}{}:
+	default:
+	}
+}
+
+// deliver moves the queued events to C until Unsubscribe.
+func (s *Subscription) deliver() {
+	defer close(s.c)
+	for {
+		s.mux.Lock()
+		if len(s.queue) == 0 {
+			s.mux.Unlock()
+			select {
+			case <-s.ready:
+				continue
+			case <-s.done:
+				return
+			}
+		}
+		ev := s.queue[0]
+		s.queue[0] = BusEvent{}
+		s.queue = s.queue[1:]
+		s.mux.Unlock()
+		select {
+		case s.c <- ev:
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// Bus delivers the events of one or more Clients to its subscribers.  All
+// the subscribers see the events in the same order.  Publishing never
+// blocks: the events that don't fit in the buffer of a Subscription are
+// queued until the subscriber catches up, so subscribers can publish (call
+// into the Client) from the goroutine that reads the Subscription.  A
+// subscriber that falls MaxQueueLen events behind loses the oldest ones.
+type Bus struct {
+	subs map[*Subscription]struct{}
+	mux  sync.Mutex
+}
+
+func NewBus() *Bus {
+	return &Bus{subs: make(map[*Subscription]struct{})}
+}
+
+// Subscribe returns a Subscription that buffers up to bufLen events
+// matching filter in C, and queues up to MaxQueueLen more.
+func (b *Bus) Subscribe(filter BusFilter, bufLen int) *Subscription {
+	c := make(chan BusEvent, bufLen)
+	s := &Subscription{C: c, c: c, filter: filter, ready: make(chan struct{}, 1),
+		done: make(chan struct{})}
+	b.mux.Lock()
+	b.subs[s] = struct{}{}
+	b.mux.Unlock()
+	go s.deliver()
+	return s
+}
+
+// Unsubscribe stops the delivery of events to s, dropping the queued ones,
+// and closes s.C.
+func (b *Bus) Unsubscribe(s *Subscription) {
+	b.mux.Lock()
+	delete(b.subs, s)
+	b.mux.Unlock()
+	s.once.Do(func() { close(s.done) })
+}
+
+// publish queues ev for the matching subscribers and returns how many of
+// them got it.  The lock is only held to queue it, so that all the
+// subscribers see the events in the same order.
+func (b *Bus) publish(ev BusEvent) int {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	n := 0
+	for s := range b.subs {
+		if !s.filter.match(&ev) {
+			continue
+		}
+		s.push(ev)
+		n++
+	}
+	return n
+}
+
+// reauth asks the subscribers for the password and waits for the reply, for
+// Reply to be closed, for reauthTimeout or for the client to stop.
+func (b *Bus) reauth(c *Client, err error) (string, bool) {
+	reply := make(chan string, 1)
+	done := make(chan struct{})
+	defer close(done)
+	if b.publish(BusEvent{Type: BusReauth, Client: c, Err: err, Reply: reply,
+		Done: done}) == 0 {
+		return "", false
+	}
+	timeout := time.NewTimer(reauthTimeout)
+	defer timeout.Stop()
+	select {
+	case password, ok := <-reply:
+		return password, ok
+	case <-timeout.C:
+		return "", false
+	case <-c.done:
+		return "", false
+	}
+}
@@ -0,0 +1,61 @@
+package morpheus
+
+import (
+	"errors"
+	"strconv"
+	"testing"
+)
+
+func TestSubscriptionDropsOldest(t *testing.T) {
+	b := NewBus()
+	s := b.Subscribe(BusFilter{}, 0)
+	defer b.Unsubscribe(s)
+	total := MaxQueueLen + 10
+	for i := 0; i < total; i++ {
+		b.publish(BusEvent{Type: BusCmd, Args: []string{strconv.Itoa(i)}})
+	}
+	dropped := s.Dropped()
+	if dropped == 0 {
+		t.Fatalf("Dropped() = 0 after %d events", total)
+	}
+	var ev BusEvent
+	for i := 0; i < total-dropped; i++ {
+		ev = <-s.C
+	}
+	if last := ev.Args[0]; last != strconv.Itoa(total-1) {
+		t.Errorf("last event %s, want %d", last, total-1)
+	}
+}
+
+func TestReauthStop(t *testing.T) {
+	b := NewBus()
+	s := b.Subscribe(BusFilter{Types: []BusEventType{BusReauth}}, 1)
+	defer b.Unsubscribe(s)
+	c := &Client{done: make(chan struct{})}
+	go func() {
+		// The subscriber never replies, the client stops
+		<-s.C
+		close(c.done)
+	}()
+	if password, ok := b.reauth(c, errors.New("M_UNKNOWN_TOKEN")); ok || password != "" {
+		t.Errorf("reauth() = %q, %v, want \"\", false", password, ok)
+	}
+}
+
+func TestReauthReply(t *testing.T) {
+	b := NewBus()
+	s := b.Subscribe(BusFilter{Types: []BusEventType{BusReauth}}, 1)
+	defer b.Unsubscribe(s)
+	c := &Client{done: make(chan struct{})}
+	done := make(chan (<-chan struct{}), 1)
+	go func() {
+		ev := <-s.C
+		done <- ev.Done
+		ev.Reply <- "secret"
+	}()
+	if password, ok := b.reauth(c, errors.New("M_UNKNOWN_TOKEN")); !ok || password != "secret" {
+		t.Errorf("reauth() = %q, %v, want \"secret\", true", password, ok)
+	}
+	// Done is closed once reauth returns
+	<-<-done
+}
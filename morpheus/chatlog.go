@@ -0,0 +1,357 @@
+package morpheus
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/matrix-org/gomatrix"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"text/template"
+	"unicode"
+)
+
+// Maximum number of /messages pages requested to fill the gap of a room
+// after a reconnect
+const chatLogMaxBackfill = 50
+
+// DefaultLogFormat writes irssi-like lines
+const DefaultLogFormat = "{{.Line}}"
+
+// LogLine is the data passed to the LogFormat template for every line.
+type LogLine struct {
+	EventLine
+	RoomID string
+	Room   string
+	Sender string
+	// Line is the line formatted like irssi does
+	Line string
+}
+
+// ChatLog appends the timeline of the rooms to per-room log files, one per
+// day:
+//
+//	<LogDir>/<room alias or ID>/YYYY-MM-DD.log
+//
+// The last event of every room is kept in <LogDir>/state-<user ID>.json so
+// that the gaps left by reconnects and restarts are filled with /messages.
+type ChatLog struct {
+	c      *Client
+	dir    string
+	format *template.Template
+	// statePath is the state file of the user the log was opened with
+	statePath string
+	// queue holds the timelines until they are written by loop, ready is
+	// signaled when it gets timelines
+	queue   []logItem
+	mux     sync.Mutex
+	ready   chan struct{}
+	closing chan struct{}
+	done    chan struct{}
+	once    sync.Once
+	// rooms is only accessed by loop
+	rooms map[string]*roomLog
+}
+
+type logItem struct {
+	r         *Room
+	limited   bool
+	prevBatch string
+	events    []gomatrix.Event
+	// forget is the ID of a room whose logs are deleted, alias its
+	// canonical alias
+	forget, alias string
+}
+
+type roomLog struct {
+	// LastEventID is the last event of the timeline that was written or
+	// skipped, logged or not
+	LastEventID string `json:"last_event_id"`
+	nicks       map[string]string
+	filename    string
+	file        *os.File
+}
+
+// OpenChatLog starts logging the rooms of c in dir with the text/template
+// format.  It must be called once the user ID of c is known, after the login.
+func OpenChatLog(c *Client, dir, format string) (*ChatLog, error) {
+	if format == "" {
+		format = DefaultLogFormat
+	}
+	tmpl, err := template.New("log").Parse(format)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid LogFormat: %v", err)
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	statePath := filepath.Join(dir, "state-"+safeFilename(c.GetUserID())+".json")
+	l := &ChatLog{c: c, dir: dir, format: tmpl, statePath: statePath,
+		ready: make(chan struct{}, 1), closing: make(chan struct{}),
+		done: make(chan struct{}), rooms: make(map[string]*roomLog)}
+	// state.json is the state of the versions that shared it between users
+	for _, path := range []string{l.statePath, filepath.Join(dir, "state.json")} {
+		data, err := ioutil.ReadFile(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(data, &l.rooms); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		break
+	}
+	go l.loop()
+	return l, nil
+}
+
+// Close writes the queued timelines and closes the log files.
+func (l *ChatLog) Close() {
+	l.once.Do(func() {
+		close(l.closing)
+		<-l.done
+	})
+}
+
+// Queue logs the timeline of a room received in a sync without blocking.
+// limited timelines are preceded by the events missing since the last one.
+func (l *ChatLog) Queue(r *Room, limited bool, prevBatch string, events []gomatrix.Event) {
+	l.push(logItem{r: r, limited: limited, prevBatch: prevBatch, events: events})
+}
+
+// Forget deletes the log files and the state of a forgotten room, after the
+// queued timelines.
+func (l *ChatLog) Forget(roomID, alias string) {
+	l.push(logItem{forget: roomID, alias: alias})
+}
+
+func (l *ChatLog) push(item logItem) {
+	l.mux.Lock()
+	l.queue = append(l.queue, item)
+	l.mux.Unlock()
+	select {
+	case l.ready <- struct{}{}:
+	default:
+	}
+}
+
+func (l *ChatLog) loop() {
+	defer close(l.done)
+	for {
+		l.mux.Lock()
+		queue := l.queue
+		l.queue = nil
+		l.mux.Unlock()
+		for i := range queue {
+			var err error
+			if queue[i].forget != "" {
+				err = l.delete(queue[i].forget, queue[i].alias)
+			} else {
+				err = l.write(&queue[i])
+			}
+			if err != nil {
+				l.c.DebugPrint("log:", err)
+			}
+		}
+		if len(queue) != 0 {
+			continue
+		}
+		select {
+		case <-l.ready:
+		case <-l.closing:
+			l.mux.Lock()
+			empty := len(l.queue) == 0
+			l.mux.Unlock()
+			if !empty {
+				continue
+			}
+			for _, rl := range l.rooms {
+				if rl.file != nil {
+					rl.file.Close()
+				}
+			}
+			return
+		}
+	}
+}
+
+// safeFilename turns a room alias or ID into a file name without path
+// separators or characters that some file systems reject.
+func safeFilename(name string) string {
+	return strings.Map(func(c rune) rune {
+		if unicode.IsLetter(c) || unicode.IsNumber(c) || strings.ContainsRune("#!.-_+=@", c) {
+			return c
+		}
+		return '_'
+	}, name)
+}
+
+// roomNicks returns the display names of the joined users of the room.
+func roomNicks(r *Room) map[string]string {
+	nicks := make(map[string]string)
+	r.Users.rwm.RLock()
+	defer r.Users.rwm.RUnlock()
+	for _, u := range r.Users.U {
+		if name := u.Name(); name != "" {
+			nicks[u.ID()] = name
+		}
+	}
+	return nicks
+}
+
+// backfill fetches the events of the room from the token from back to the
+// last one, in chronological order.
+func (l *ChatLog) backfill(roomID, from string, rl *roomLog) ([]gomatrix.Event, error) {
+	var events []gomatrix.Event
+	for page := 0; page < chatLogMaxBackfill; page++ {
+		res, err := l.c.messages(roomID, from, "b", 100)
+		if err != nil {
+			return nil, err
+		}
+		done := len(res.Chunk) == 0 || res.End == "" || res.End == from
+		for _, ev := range res.Chunk {
+			if ev.ID == rl.LastEventID {
+				done = true
+				break
+			}
+			events = append(events, ev)
+		}
+		if done {
+			break
+		}
+		from = res.End
+	}
+	for i, j := 0, len(events)-1; i < j; i, j = i+1, j-1 {
+		events[i], events[j] = events[j], events[i]
+	}
+	return events, nil
+}
+
+func (l *ChatLog) write(item *logItem) error {
+	roomID := item.r.ID()
+	rl, ok := l.rooms[roomID]
+	if !ok {
+		rl = &roomLog{}
+		l.rooms[roomID] = rl
+	}
+	if rl.nicks == nil {
+		rl.nicks = roomNicks(item.r)
+	}
+	// The events up to the last one are already written, and the ones
+	// missing before a limited timeline are fetched back to it
+	events := item.events
+	if i := eventIndex(events, rl.LastEventID); i >= 0 {
+		events = events[i+1:]
+	} else if item.limited && rl.LastEventID != "" && item.prevBatch != "" {
+		missing, err := l.backfill(roomID, item.prevBatch, rl)
+		if err != nil {
+			l.c.DebugPrint("log: backfill", roomID, ":", err)
+		}
+		events = append(missing, events...)
+	}
+	room := item.r.CanonAlias()
+	if room == "" {
+		room = roomID
+	}
+	if len(events) == 0 {
+		return nil
+	}
+	for i := range events {
+		ev := &events[i]
+		line, ok := eventLine(ev, rl.nicks)
+		if !ok {
+			rl.LastEventID = ev.ID
+			continue
+		}
+		filename := filepath.Join(l.dir, safeFilename(room),
+			line.Ts.Format("2006-01-02")+".log")
+		if rl.file == nil || rl.filename != filename {
+			if rl.file != nil {
+				rl.file.Close()
+				rl.file = nil
+			}
+			if err := os.MkdirAll(filepath.Dir(filename), 0700); err != nil {
+				return err
+			}
+			f, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+			if err != nil {
+				return err
+			}
+			rl.file, rl.filename = f, filename
+		}
+		var b strings.Builder
+		err := l.format.Execute(&b, &LogLine{EventLine: line, RoomID: roomID, Room: room,
+			Sender: ev.Sender, Line: line.String()})
+		if err != nil {
+			return err
+		}
+		b.WriteString("\n")
+		if _, err := rl.file.WriteString(b.String()); err != nil {
+			return err
+		}
+		rl.LastEventID = ev.ID
+	}
+	return l.saveState()
+}
+
+// delete removes the directories that hold the logs of a room, by ID and by
+// alias, and its state.
+func (l *ChatLog) delete(roomID, alias string) error {
+	dirs := []string{filepath.Join(l.dir, safeFilename(roomID))}
+	if alias != "" {
+		dirs = append(dirs, filepath.Join(l.dir, safeFilename(alias)))
+	}
+	if rl, ok := l.rooms[roomID]; ok {
+		if rl.file != nil {
+			rl.file.Close()
+			dirs = append(dirs, filepath.Dir(rl.filename))
+		}
+		delete(l.rooms, roomID)
+	}
+	for _, dir := range dirs {
+		if err := os.RemoveAll(dir); err != nil {
+			return err
+		}
+	}
+	return l.saveState()
+}
+
+// eventIndex returns the index of the event with the ID, or -1.
+func eventIndex(events []gomatrix.Event, eventID string) int {
+	if eventID == "" {
+		return -1
+	}
+	for i := range events {
+		if events[i].ID == eventID {
+			return i
+		}
+	}
+	return -1
+}
+
+// saveState writes the last event of every room, through a temporary
+// file so that a crash doesn't leave it truncated.
+func (l *ChatLog) saveState() error {
+	data, err := json.Marshal(l.rooms)
+	if err != nil {
+		return err
+	}
+	tmp := l.statePath + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, l.statePath)
+}
+
+// logTimeline logs the timeline of a room, if logging is enabled.
+func (c *Client) logTimeline(r *Room, roomData *respSyncRoom) {
+	if c.chatLog == nil {
+		return
+	}
+	c.chatLog.Queue(r, roomData.Timeline.Limited, roomData.Timeline.PrevBatch,
+		roomData.Timeline.Events)
+}
@@ -0,0 +1,42 @@
+package morpheus
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestChatLogStatePath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "morpheus-log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	c := &Client{cfg: Config{UserID: "@alice:example.org"}, debugBuf: &bytes.Buffer{}}
+	l, err := OpenChatLog(c, dir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The state is saved for the user that the log was opened with
+	c.cfg.UserID = "@bob:example.org"
+	l.rooms["!a:x"] = &roomLog{LastEventID: "$1"}
+	if err := l.saveState(); err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+	bobState := filepath.Join(dir, "state-"+safeFilename("@bob:example.org")+".json")
+	if _, err := os.Stat(bobState); !os.IsNotExist(err) {
+		t.Errorf("state of @bob:example.org saved: %v", err)
+	}
+	c.cfg.UserID = "@alice:example.org"
+	l, err = OpenChatLog(c, dir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if rl := l.rooms["!a:x"]; rl == nil || rl.LastEventID != "$1" {
+		t.Errorf("state of @alice:example.org = %+v, want last event $1", rl)
+	}
+}
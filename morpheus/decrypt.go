@@ -0,0 +1,33 @@
+package morpheus
+
+import (
+	"github.com/matrix-org/gomatrix"
+)
+
+// Decrypter decrypts the m.room.encrypted events of a room, for example with
+// the megolm sessions of the device.  Decrypt returns the event with the type
+// and content of its cleartext.
+type Decrypter interface {
+	Decrypt(roomID string, ev *gomatrix.Event) (*gomatrix.Event, error)
+}
+
+// SetDecrypter sets the Decrypter of the encrypted timeline events, which are
+// then shown and indexed as their cleartext.  It must be called before
+// starting the sync.
+func (c *Client) SetDecrypter(d Decrypter) {
+	c.decrypter = d
+}
+
+// decrypt returns the cleartext of an encrypted event of roomID, or ev if it
+// isn't encrypted or it can't be decrypted.
+func (c *Client) decrypt(roomID string, ev *gomatrix.Event) *gomatrix.Event {
+	if c.decrypter == nil || ev.Type != "m.room.encrypted" {
+		return ev
+	}
+	dec, err := c.decrypter.Decrypt(roomID, ev)
+	if err != nil {
+		c.DebugPrint("decrypt", ev.ID, ":", err)
+		return ev
+	}
+	return dec
+}
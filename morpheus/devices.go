@@ -0,0 +1,183 @@
+package morpheus
+
+import (
+	mo "../encrypted/gomatrixolm"
+	"encoding/json"
+	"fmt"
+	mat "github.com/Dhole/gomatrix"
+	"github.com/matrix-org/gomatrix"
+)
+
+type Device struct {
+	ID          string `json:"device_id"`
+	DisplayName string `json:"display_name"`
+	LastSeenIP  string `json:"last_seen_ip"`
+	LastSeenTs  int64  `json:"last_seen_ts"`
+	// HasKeys is true if gomatrixolm has the E2EE keys of this device
+	HasKeys bool `json:"-"`
+}
+
+type respDevices struct {
+	Devices []Device `json:"devices"`
+}
+
+type reqRenameDevice struct {
+	DisplayName string `json:"display_name"`
+}
+
+type reqDeleteDevices struct {
+	Devices []string     `json:"devices"`
+	Auth    *reqAuthData `json:"auth,omitempty"`
+}
+
+type userIdentifier struct {
+	Type string `json:"type"`
+	User string `json:"user"`
+}
+
+type reqAuthData struct {
+	Type       string          `json:"type"`
+	Session    string          `json:"session,omitempty"`
+	Identifier *userIdentifier `json:"identifier,omitempty"`
+	User       string          `json:"user,omitempty"`
+	Password   string          `json:"password,omitempty"`
+}
+
+type respUserInteractive struct {
+	Flows []struct {
+		Stages []string `json:"stages"`
+	} `json:"flows"`
+	Session   string   `json:"session"`
+	Completed []string `json:"completed"`
+}
+
+func (res *respUserInteractive) hasSingleStageFlow(stage string) bool {
+	for _, flow := range res.Flows {
+		if len(flow.Stages) == 1 && flow.Stages[0] == stage {
+			return true
+		}
+	}
+	return false
+}
+
+// knownDeviceKeys returns the IDs of our devices whose keys are stored in the
+// gomatrixolm crypto DB.
+func (c *Client) knownDeviceKeys() (map[string]bool, error) {
+	known := make(map[string]bool)
+	if c.cfg.CryptoDB == "" {
+		return known, nil
+	}
+	db, err := mo.OpenCryptoDB(c.cfg.CryptoDB)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	users, err := db.LoadAllUserDevices()
+	if err != nil {
+		return nil, err
+	}
+	if ud, ok := users[mat.UserID(c.cfg.UserID)]; ok {
+		for deviceID, device := range ud.DevicesByID {
+			known[string(deviceID)] = device.Curve25519() != ""
+		}
+	}
+	return known, nil
+}
+
+// Devices returns the list of devices of our user.
+func (c *Client) Devices() ([]Device, error) {
+	var res respDevices
+	err := c.withAuth(func() error {
+		_, err := c.cli.MakeRequest("GET", c.cli.BuildURL("devices"), nil, &res)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	known, err := c.knownDeviceKeys()
+	if err != nil {
+		c.DebugPrint("knownDeviceKeys:", err)
+	}
+	for i := range res.Devices {
+		res.Devices[i].HasKeys = known[res.Devices[i].ID]
+	}
+	return res.Devices, nil
+}
+
+// RenameDevice sets the display name of one of our devices.
+func (c *Client) RenameDevice(deviceID, name string) error {
+	return c.withAuth(func() error {
+		_, err := c.cli.MakeRequest("PUT", c.cli.BuildURL("devices", deviceID),
+			&reqRenameDevice{DisplayName: name}, nil)
+		return err
+	})
+}
+
+// DeleteDevices deletes the given devices, which requires interactive
+// authentication with the password.  If the password is not in the config the
+// UI is asked for it.
+func (c *Client) DeleteDevices(deviceIDs []string) error {
+	req := reqDeleteDevices{Devices: deviceIDs}
+	var contents []byte
+	err := c.withAuth(func() (err error) {
+		contents, err = c.cli.MakeRequest("POST", c.cli.BuildURL("delete_devices"), &req, nil)
+		return err
+	})
+	httpErr, ok := err.(gomatrix.HTTPError)
+	if !ok || httpErr.Code != 401 {
+		return err
+	}
+	var uia respUserInteractive
+	if err := json.Unmarshal(contents, &uia); err != nil {
+		return err
+	}
+	if !uia.hasSingleStageFlow("m.login.password") {
+		return fmt.Errorf("No supported authentication flow in %+v", uia.Flows)
+	}
+	password := c.cfg.Password
+	if password == "" {
+		password, ok = c.Rs.bus.reauth(c, err)
+		if !ok {
+			return err
+		}
+	}
+	req.Auth = &reqAuthData{
+		Type:       "m.login.password",
+		Session:    uia.Session,
+		Identifier: &userIdentifier{Type: "m.id.user", User: c.cfg.UserID},
+		User:       c.cfg.UserID,
+		Password:   password,
+	}
+	return c.withAuth(func() error {
+		_, err := c.cli.MakeRequest("POST", c.cli.BuildURL("delete_devices"), &req, nil)
+		return err
+	})
+}
+
+// Logout invalidates the access token of this session and deletes its
+// device.
+func (c *Client) Logout() error {
+	err := c.withAuth(func() error {
+		_, err := c.cli.MakeRequest("POST", c.cli.BuildURL("logout"), struct{}{}, nil)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	c.clearSession()
+	return nil
+}
+
+// LogoutAll invalidates all the access tokens of our user, deleting all our
+// devices.
+func (c *Client) LogoutAll() error {
+	err := c.withAuth(func() error {
+		_, err := c.cli.MakeRequest("POST", c.cli.BuildURL("logout", "all"), struct{}{}, nil)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	c.clearSession()
+	return nil
+}
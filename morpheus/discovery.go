@@ -0,0 +1,91 @@
+package morpheus
+
+import (
+	"fmt"
+	"github.com/matrix-org/gomatrix"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+type respWellKnown struct {
+	Homeserver struct {
+		BaseURL string `json:"base_url"`
+	} `json:"m.homeserver"`
+}
+
+// splitUserID returns the localpart and the server name of a Matrix user ID.
+func splitUserID(userID string) (localpart, serverName string, err error) {
+	if !strings.HasPrefix(userID, "@") {
+		return "", "", fmt.Errorf("Invalid user ID %s", userID)
+	}
+	parts := strings.SplitN(userID[1:], ":", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", fmt.Errorf("Invalid user ID %s", userID)
+	}
+	return parts[0], parts[1], nil
+}
+
+// apiPrefix picks the client-server API prefix from the spec versions
+// supported by the homeserver.  The v3 endpoints exist from v1.1, v1.0 is the
+// legacy API from before r0.
+func apiPrefix(versions []string) string {
+	r0 := false
+	for _, v := range versions {
+		if minor, err := strconv.Atoi(strings.TrimPrefix(v, "v1.")); err == nil &&
+			strings.HasPrefix(v, "v1.") && minor >= 1 {
+			return "/_matrix/client/v3"
+		}
+		if strings.HasPrefix(v, "r0.") {
+			r0 = true
+		}
+	}
+	if r0 {
+		return "/_matrix/client/r0"
+	}
+	return "/_matrix/client/unstable"
+}
+
+// wellKnownHomeserver looks up the homeserver base URL of serverName through
+// /.well-known/matrix/client.
+func (c *Client) wellKnownHomeserver(serverName string) (string, error) {
+	var res respWellKnown
+	wellKnownURL := fmt.Sprintf("https://%s/.well-known/matrix/client", serverName)
+	if _, err := c.cli.MakeRequest("GET", wellKnownURL, nil, &res); err != nil {
+		return "", err
+	}
+	if res.Homeserver.BaseURL == "" {
+		return "", fmt.Errorf("m.homeserver.base_url missing")
+	}
+	return strings.TrimSuffix(res.Homeserver.BaseURL, "/"), nil
+}
+
+// discover finds the homeserver of our user if it's not in the config and
+// selects the API prefix supported by it.
+func (c *Client) discover() error {
+	if c.cfg.Homeserver == "" {
+		_, serverName, err := splitUserID(c.cfg.UserID)
+		if err != nil {
+			return err
+		}
+		hs, err := c.wellKnownHomeserver(serverName)
+		if err != nil {
+			c.DebugPrint("well-known:", err)
+			hs = "https://" + serverName
+		}
+		c.cfg.Homeserver = hs
+	}
+	hsURL, err := url.Parse(c.cfg.Homeserver)
+	if err != nil {
+		return err
+	}
+	c.cli.HomeserverURL = hsURL
+	var res gomatrix.RespVersions
+	if _, err := c.cli.MakeRequest("GET", c.cli.BuildBaseURL("_matrix/client/versions"),
+		nil, &res); err != nil {
+		return fmt.Errorf("%s doesn't look like a homeserver: %s", c.cfg.Homeserver, err)
+	}
+	c.cli.Prefix = apiPrefix(res.Versions)
+	c.DebugPrintf("Homeserver %s, API prefix %s", c.cfg.Homeserver, c.cli.Prefix)
+	return nil
+}
@@ -0,0 +1,28 @@
+package morpheus
+
+import (
+	"testing"
+)
+
+func TestAPIPrefix(t *testing.T) {
+	tests := []struct {
+		versions []string
+		prefix   string
+	}{
+		{[]string{}, "/_matrix/client/unstable"},
+		{nil, "/_matrix/client/unstable"},
+		{[]string{"r0.6.1"}, "/_matrix/client/r0"},
+		{[]string{"r0.5.0", "r0.6.1"}, "/_matrix/client/r0"},
+		{[]string{"v1.1"}, "/_matrix/client/v3"},
+		{[]string{"r0.6.1", "v1.11"}, "/_matrix/client/v3"},
+		{[]string{"v1.0"}, "/_matrix/client/unstable"},
+		{[]string{"r0.6.1", "v1.0"}, "/_matrix/client/r0"},
+		{[]string{"v1.x"}, "/_matrix/client/unstable"},
+		{[]string{"v2.0"}, "/_matrix/client/unstable"},
+	}
+	for _, test := range tests {
+		if prefix := apiPrefix(test.versions); prefix != test.prefix {
+			t.Errorf("apiPrefix(%q) = %q, want %q", test.versions, prefix, test.prefix)
+		}
+	}
+}
@@ -0,0 +1,440 @@
+package morpheus
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"github.com/matrix-org/gomatrix"
+	"html/template"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type ExportFormat int
+
+const (
+	// ExportJSON writes every raw event as a JSON line
+	ExportJSON ExportFormat = iota
+	// ExportText writes an irssi-like log
+	ExportText ExportFormat = iota
+	// ExportHTML writes a self-contained HTML page
+	ExportHTML ExportFormat = iota
+)
+
+func ParseExportFormat(format string) (ExportFormat, error) {
+	switch format {
+	case "json":
+		return ExportJSON, nil
+	case "text":
+		return ExportText, nil
+	case "html":
+		return ExportHTML, nil
+	default:
+		return 0, fmt.Errorf("Unknown export format %s", format)
+	}
+}
+
+type ExportOptions struct {
+	Format ExportFormat
+	// Since and Until limit the exported events by date, zero to not limit
+	Since time.Time
+	Until time.Time
+	// Progress is called with the number of events fetched so far
+	Progress func(n int)
+	// Decrypter decrypts the encrypted events, the one of the client set
+	// with SetDecrypter by default.  The events that it can't decrypt are
+	// exported as they are, or as "[encrypted]" in the text and HTML logs.
+	Decrypter Decrypter
+}
+
+type respMessages struct {
+	Start string           `json:"start"`
+	End   string           `json:"end"`
+	Chunk []gomatrix.Event `json:"chunk"`
+}
+
+// messages fetches a page of events of the room from the token from in the
+// direction dir ("b" or "f"), or from the end or the start of the room if
+// it's empty.
+func (c *Client) messages(roomID, from, dir string, limit int) (*respMessages, error) {
+	query := map[string]string{"dir": dir, "limit": strconv.Itoa(limit)}
+	if from != "" {
+		query["from"] = from
+	}
+	var res respMessages
+	err := c.withAuth(func() error {
+		_, err := c.cli.MakeRequest("GET", c.cli.BuildURLWithQuery(
+			[]string{"rooms", roomID, "messages"}, query), nil, &res)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// currentState fetches the current state of the room.
+func (c *Client) currentState(roomID string) (roomState, error) {
+	var evs []gomatrix.Event
+	err := c.withAuth(func() error {
+		_, err := c.cli.MakeRequest("GET", c.cli.BuildURL("rooms", roomID, "state"), nil, &evs)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	state := make(roomState, len(evs))
+	for _, ev := range evs {
+		if ev.StateKey != nil {
+			state[stateKey{ev.Type, *ev.StateKey}] = ev.Content
+		}
+	}
+	return state, nil
+}
+
+// nicks returns the display names of the joined members.
+func (s roomState) nicks() map[string]string {
+	nicks := make(map[string]string)
+	for key, content := range s {
+		if key.Type != "m.room.member" || content["membership"] != "join" {
+			continue
+		}
+		if name := s.name(key.StateKey); name != "" {
+			nicks[key.StateKey] = name
+		}
+	}
+	return nicks
+}
+
+// historyStart paginates the room backwards until since, or the creation of
+// the room if it's zero, reverting the state events on the way.  It returns
+// the token to paginate forwards from there, which is empty for the start of
+// the room, and false if the room has no events.
+func (c *Client) historyStart(roomID string, opts *ExportOptions, state roomState,
+	fetched *int) (string, bool, error) {
+	from := ""
+	for {
+		res, err := c.messages(roomID, from, "b", 100)
+		if err != nil {
+			return "", false, err
+		}
+		if len(res.Chunk) == 0 {
+			return from, from != "", nil
+		}
+		for i := range res.Chunk {
+			ev := &res.Chunk[i]
+			state.revert(ev.Type, ev.StateKey, prevContent(ev))
+		}
+		*fetched += len(res.Chunk)
+		if opts.Progress != nil {
+			opts.Progress(*fetched)
+		}
+		oldest := time.Unix(res.Chunk[len(res.Chunk)-1].Timestamp/1000, 0)
+		if res.End == "" || res.End == from {
+			// The servers that don't give the token of the end of the
+			// history paginate from the start of the room
+			return "", true, nil
+		}
+		if !opts.Since.IsZero() && oldest.Before(opts.Since) {
+			return res.End, true, nil
+		}
+		from = res.End
+	}
+}
+
+// roomHistory calls fn with the events of the room between since and until
+// in chronological order, and the display names of the users when they were
+// sent.  The room is paginated backwards to find the first event and the
+// state when it was sent, and then forwards to stream the events.
+func (c *Client) roomHistory(roomID string, opts *ExportOptions,
+	fn func(ev *gomatrix.Event, nicks map[string]string) error) error {
+	state, err := c.currentState(roomID)
+	if err != nil {
+		return err
+	}
+	fetched := 0
+	from, ok, err := c.historyStart(roomID, opts, state, &fetched)
+	if err != nil || !ok {
+		return err
+	}
+	nicks := state.nicks()
+	for {
+		res, err := c.messages(roomID, from, "f", 100)
+		if err != nil {
+			return err
+		}
+		for i := range res.Chunk {
+			ev := &res.Chunk[i]
+			ts := time.Unix(ev.Timestamp/1000, 0)
+			if !opts.Until.IsZero() && !ts.Before(opts.Until) {
+				return nil
+			}
+			if !opts.Since.IsZero() && ts.Before(opts.Since) {
+				// Keep the names up to date
+				eventLine(ev, nicks)
+				continue
+			}
+			if err := fn(ev, nicks); err != nil {
+				return err
+			}
+		}
+		fetched += len(res.Chunk)
+		if opts.Progress != nil {
+			opts.Progress(fetched)
+		}
+		if len(res.Chunk) == 0 || res.End == "" || res.End == from {
+			return nil
+		}
+		from = res.End
+	}
+}
+
+// EventLine is a line of a text log.
+type EventLine struct {
+	Ts   time.Time
+	Nick string
+	// Kind is "msg", "emote", "notice" or "info" for state changes
+	Kind string
+	Text string
+}
+
+// eventLine describes an event for a text log, updating nicks with the
+// membership changes.  It returns false for the events that are not logged.
+func eventLine(ev *gomatrix.Event, nicks map[string]string) (EventLine, bool) {
+	nick := func(userID string) string {
+		if name, ok := nicks[userID]; ok {
+			return name
+		}
+		return userID
+	}
+	line := EventLine{Ts: time.Unix(ev.Timestamp/1000, 0), Nick: nick(ev.Sender), Kind: "info"}
+	body, _ := ev.Content["body"].(string)
+	switch ev.Type {
+	case "m.room.message":
+		msgType, _ := ev.Content["msgtype"].(string)
+		switch msgType {
+		case "m.emote":
+			line.Kind = "emote"
+		case "m.notice":
+			line.Kind = "notice"
+		default:
+			line.Kind = "msg"
+		}
+		if msgType != "" && msgType != "m.text" && msgType != "m.emote" &&
+			msgType != "m.notice" {
+			body = fmt.Sprintf("[%s] %s", msgType, body)
+		}
+		line.Text = body
+	case "m.room.encrypted":
+		line.Kind = "msg"
+		line.Text = "[encrypted]"
+	case "m.room.member":
+		if ev.StateKey == nil {
+			return line, false
+		}
+		userID := *ev.StateKey
+		oldNick := nick(userID)
+		name, _ := ev.Content["displayname"].(string)
+		mem, _ := ev.Content["membership"].(string)
+		if mem == "join" && name != "" {
+			nicks[userID] = name
+		} else if mem != "join" {
+			delete(nicks, userID)
+		}
+		switch mem {
+		case "join":
+			if prev, ok := ev.Unsigned["prev_content"].(map[string]interface{}); ok &&
+				prev["membership"] == "join" {
+				if name == "" || name == oldNick {
+					return line, false
+				}
+				line.Text = fmt.Sprintf("%s is now known as %s", oldNick, name)
+			} else {
+				line.Text = fmt.Sprintf("%s [%s] has joined", nick(userID), userID)
+			}
+		case "leave":
+			if userID != ev.Sender {
+				line.Text = fmt.Sprintf("%s was kicked by %s", oldNick, line.Nick)
+			} else {
+				line.Text = fmt.Sprintf("%s [%s] has left", oldNick, userID)
+			}
+		case "invite":
+			line.Text = fmt.Sprintf("%s invited %s", line.Nick, userID)
+		case "ban":
+			line.Text = fmt.Sprintf("%s was banned by %s", oldNick, line.Nick)
+		default:
+			return line, false
+		}
+	case "m.room.topic":
+		topic, _ := ev.Content["topic"].(string)
+		line.Text = fmt.Sprintf("%s changed the topic to: %s", line.Nick, topic)
+	case "m.room.name":
+		name, _ := ev.Content["name"].(string)
+		line.Text = fmt.Sprintf("%s changed the room name to: %s", line.Nick, name)
+	default:
+		return line, false
+	}
+	return line, true
+}
+
+// String formats the line like irssi does.
+func (l *EventLine) String() string {
+	ts := l.Ts.Format("15:04:05")
+	switch l.Kind {
+	case "msg":
+		return fmt.Sprintf("%s <%s> %s", ts, l.Nick, l.Text)
+	case "emote":
+		return fmt.Sprintf("%s  * %s %s", ts, l.Nick, l.Text)
+	case "notice":
+		return fmt.Sprintf("%s -%s- %s", ts, l.Nick, l.Text)
+	default:
+		return fmt.Sprintf("%s -!- %s", ts, l.Text)
+	}
+}
+
+var exportHTMLTemplate = template.Must(template.New("header").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.}}</title>
+<style>
+body { font-family: monospace; background: #1c1c1c; color: #d0d0d0; }
+.day { color: #5faf87; margin: 1em 0 0.5em 0; }
+.ts { color: #87afd7; }
+.nick { color: #ffaf5f; }
+.info { color: #8a8a8a; }
+.notice { color: #949494; }
+pre { margin: 0; white-space: pre-wrap; }
+</style>
+</head>
+<body>
+<h1>{{.}}</h1>
+{{define "line"}}{{if .Day}}<div class="day">{{.Day}}</div>
+{{end}}<pre class="{{.Kind}}"><span class="ts">{{.Ts}}</span> {{if eq .Kind "info"}}-!- {{.Text}}{{else if eq .Kind "emote"}}* <span class="nick">{{.Nick}}</span> {{.Text}}{{else}}<span class="nick">&lt;{{.Nick}}&gt;</span> {{.Text}}{{end}}</pre>
+{{end}}{{define "footer"}}<p class="info">Exported {{.Exported}}, {{.Count}} events</p>
+</body>
+</html>
+{{end}}`))
+
+type htmlLine struct {
+	Day  string
+	Ts   string
+	Nick string
+	Kind string
+	Text string
+}
+
+// ExportRoom writes the history of a room to w in the given format as it's
+// fetched, and returns the number of events written.  The encrypted events
+// are exported decrypted with the Decrypter of the options.
+func (c *Client) ExportRoom(roomID string, w io.Writer, opts ExportOptions) (int, error) {
+	bw := bufio.NewWriter(w)
+	n := 0
+	write, err := c.exportWriter(roomID, bw, &opts, &n)
+	if err != nil {
+		return 0, err
+	}
+	if err := c.roomHistory(roomID, &opts, write); err != nil {
+		bw.Flush()
+		return n, err
+	}
+	if opts.Format == ExportHTML {
+		err := exportHTMLTemplate.ExecuteTemplate(bw, "footer", struct {
+			Exported string
+			Count    int
+		}{time.Now().Format("2006-01-02 15:04"), n})
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, bw.Flush()
+}
+
+// exportWriter writes the header of the export and returns the function that
+// writes its events, counting them in n.
+func (c *Client) exportWriter(roomID string, bw *bufio.Writer, opts *ExportOptions,
+	n *int) (func(ev *gomatrix.Event, nicks map[string]string) error, error) {
+	var write func(ev *gomatrix.Event, nicks map[string]string) error
+	switch opts.Format {
+	case ExportJSON:
+		enc := json.NewEncoder(bw)
+		write = func(ev *gomatrix.Event, nicks map[string]string) error {
+			*n++
+			return enc.Encode(ev)
+		}
+	case ExportText, ExportHTML:
+		if opts.Format == ExportHTML {
+			room := roomID
+			if r := c.Rs.ByID(roomID); r != nil {
+				room = r.DispName()
+			}
+			if err := exportHTMLTemplate.Execute(bw, room); err != nil {
+				return nil, err
+			}
+		}
+		prevDay := ""
+		write = func(ev *gomatrix.Event, nicks map[string]string) error {
+			line, ok := eventLine(ev, nicks)
+			if !ok {
+				return nil
+			}
+			*n++
+			day := line.Ts.Format("Mon Jan 02 2006")
+			dayChanged := day != prevDay
+			prevDay = day
+			if opts.Format == ExportText {
+				if dayChanged {
+					fmt.Fprintf(bw, "--- Day changed %s\n", day)
+				}
+				_, err := fmt.Fprintln(bw, line.String())
+				return err
+			}
+			hl := htmlLine{Ts: line.Ts.Format("15:04:05"), Nick: line.Nick,
+				Kind: line.Kind, Text: line.Text}
+			if dayChanged {
+				hl.Day = day
+			}
+			return exportHTMLTemplate.ExecuteTemplate(bw, "line", &hl)
+		}
+	default:
+		return nil, fmt.Errorf("Invalid ExportFormat %d", opts.Format)
+	}
+	decrypter := opts.Decrypter
+	if decrypter == nil {
+		decrypter = c.decrypter
+	}
+	if decrypter == nil {
+		return write, nil
+	}
+	return func(ev *gomatrix.Event, nicks map[string]string) error {
+		if ev.Type == "m.room.encrypted" {
+			if dec, err := decrypter.Decrypt(roomID, ev); err == nil {
+				ev = dec
+			}
+		}
+		return write(ev, nicks)
+	}, nil
+}
+
+type respRoomAlias struct {
+	RoomID string `json:"room_id"`
+}
+
+// ResolveRoomID returns the room ID of roomIDorAlias.
+func (c *Client) ResolveRoomID(roomIDorAlias string) (string, error) {
+	if !strings.HasPrefix(roomIDorAlias, "#") {
+		return roomIDorAlias, nil
+	}
+	var res respRoomAlias
+	err := c.withAuth(func() error {
+		_, err := c.cli.MakeRequest("GET", c.cli.BuildURL("directory", "room", roomIDorAlias),
+			nil, &res)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	return res.RoomID, nil
+}
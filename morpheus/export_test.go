@@ -0,0 +1,53 @@
+package morpheus
+
+import (
+	"bufio"
+	"bytes"
+	"github.com/matrix-org/gomatrix"
+	"strings"
+	"testing"
+)
+
+func TestExportDecrypted(t *testing.T) {
+	encrypted := func(id string) *gomatrix.Event {
+		return &gomatrix.Event{Type: "m.room.encrypted", ID: id, Sender: "@alice:x",
+			Timestamp: 1500000000000,
+			Content:   map[string]interface{}{"algorithm": "m.megolm.v1.aes-sha2"}}
+	}
+	decrypter := testDecrypter{"!a:x$1": gomatrix.Event{Type: "m.room.message", ID: "$1",
+		Sender: "@alice:x", Timestamp: 1500000000000,
+		Content: map[string]interface{}{"msgtype": "m.text", "body": "secret plans"}}}
+	tests := []struct {
+		format  ExportFormat
+		missing string
+	}{
+		{ExportJSON, `"m.room.encrypted"`},
+		{ExportText, "[encrypted]"},
+		{ExportHTML, "[encrypted]"},
+	}
+	for _, test := range tests {
+		c := &Client{Rs: NewRooms(NewBus())}
+		var buf bytes.Buffer
+		bw := bufio.NewWriter(&buf)
+		n := 0
+		write, err := c.exportWriter("!a:x", bw, &ExportOptions{Format: test.format,
+			Decrypter: decrypter}, &n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		nicks := map[string]string{"@alice:x": "Alice"}
+		// The second event has no session
+		for _, ev := range []*gomatrix.Event{encrypted("$1"), encrypted("$2")} {
+			if err := write(ev, nicks); err != nil {
+				t.Fatal(err)
+			}
+		}
+		bw.Flush()
+		out := buf.String()
+		if n != 2 || !strings.Contains(out, "secret plans") ||
+			strings.Count(out, test.missing) != 1 {
+			t.Errorf("export format %d = %d events %q, want 2 with %q and one %s",
+				test.format, n, out, "secret plans", test.missing)
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package morpheus
+
+import (
+	"../list"
+	"fmt"
+	"github.com/matrix-org/gomatrix"
+)
+
+// Gap marks events missing from the timeline of a room, between the tokens
+// From and To.  A limited sync leaves a gap between the end of the previous
+// sync and the events it returns.  In the Events of a room the Gap is
+// between the tokens of both sides.
+type Gap struct {
+	// From is the token on the old side of the gap
+	From string
+	// To is the token on the new side of the gap, it moves back as the
+	// gap is filled
+	To      string
+	filling bool
+}
+
+// gapElem returns the element of the gap in the list, or nil if it has been
+// removed.
+func (evs *Events) gapElem(gap *Gap) *list.Element {
+	for e := evs.l.Back(); e != nil; e = e.Prev() {
+		if g, ok := e.Value.(*Gap); ok && g == gap {
+			return e
+		}
+	}
+	return nil
+}
+
+// fillGap inserts the events, newest first, at the new side of the gap.
+// When an event that is already in the list is found both sides of the gap
+// have met, and the gap is removed.
+func (evs *Events) fillGap(gap *Gap, events []*Event, to string) (count uint, closed bool) {
+	evs.rwm.Lock()
+	defer evs.rwm.Unlock()
+	elem := evs.gapElem(gap)
+	if elem == nil {
+		return 0, true
+	}
+	for _, e := range events {
+		if _, ok := evs.ids[e.ID]; ok {
+			closed = true
+			break
+		}
+		evs.ids[e.ID] = evs.l.InsertAfter(e, elem)
+		evs.len++
+		count++
+	}
+	if closed || to == "" || to == gap.From {
+		evs.l.Remove(elem)
+		return count, true
+	}
+	gap.To = to
+	return count, false
+}
+
+// Gaps returns the gaps of the room, newest first.
+func (r *Room) Gaps() []*Gap {
+	r.Events.rwm.RLock()
+	defer r.Events.rwm.RUnlock()
+	var gaps []*Gap
+	for e := r.Events.l.Back(); e != nil; e = e.Prev() {
+		if gap, ok := e.Value.(*Gap); ok {
+			gaps = append(gaps, gap)
+		}
+	}
+	return gaps
+}
+
+// pushGap adds a gap after the last token of the room, if there is one.
+func (r *Room) pushGap(to string) *Gap {
+	back := r.Events.Back()
+	if back == nil {
+		return nil
+	}
+	from, ok := back.Value.(Token)
+	if !ok || string(from) == to {
+		return nil
+	}
+	gap := &Gap{From: string(from), To: to}
+	r.Events.PushBack(gap)
+	return gap
+}
+
+// FillGap fetches up to num of the events missing in a gap of the room,
+// the newest first, and returns the number of events added.  Overlapping
+// events are only added once, and the window is trimmed to MaxRoomEvents.
+func (c *Client) FillGap(r *Room, gap *Gap, num uint) (uint, error) {
+	r.timelineMux.Lock()
+	if gap.filling {
+		r.timelineMux.Unlock()
+		return 0, fmt.Errorf("The gap is already being filled")
+	}
+	gap.filling = true
+	from, to := gap.To, gap.From
+	r.timelineMux.Unlock()
+	defer func() {
+		r.timelineMux.Lock()
+		gap.filling = false
+		r.timelineMux.Unlock()
+	}()
+
+	var resMessages *gomatrix.RespMessages
+	err := c.withAuth(func() (err error) {
+		resMessages, err = c.cli.Messages(r.ID(), from, to, 'b', int(num))
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	events := r.historicalEvents(r.stateBefore(gap), resMessages.Chunk)
+	end := resMessages.End
+	if len(resMessages.Chunk) < int(num) || end == from {
+		end = ""
+	}
+	r.timelineMux.Lock()
+	count, _ := r.Events.fillGap(gap, events, end)
+	r.timelineMux.Unlock()
+	for _, e := range events {
+		c.indexEvent(r, e)
+	}
+	// Like when scrolling, the oldest events are dropped while the room
+	// follows new events and the newest ones otherwise
+	if max := c.maxRoomEvents(); r.Events.Len() > max {
+		r.rwm.RLock()
+		follow := r.follow
+		r.rwm.RUnlock()
+		if follow {
+			r.ClearFrontEvents(max)
+		} else {
+			r.ClearBackEvents(max)
+		}
+	}
+	r.Rooms.publish(BusEvent{Type: BusUpdateRoom, Room: r, State: RoomStateEvents})
+	return count, nil
+}
+
+// fillGapBackground fills a gap while it fits in the events kept in memory,
+// until it's filled or dropped by the trimming of FillGap.
+func (c *Client) fillGapBackground(r *Room, gap *Gap) {
+	filled := 0
+	for filled < c.maxRoomEvents() {
+		count, err := c.FillGap(r, gap, 100)
+		if err != nil {
+			c.DebugPrint("fill gap", r.ID(), ":", err)
+			return
+		}
+		if r.Events.gapRemoved(gap) {
+			return
+		}
+		filled += int(count)
+	}
+}
+
+func (evs *Events) gapRemoved(gap *Gap) bool {
+	evs.rwm.RLock()
+	defer evs.rwm.RUnlock()
+	return evs.gapElem(gap) == nil
+}
@@ -0,0 +1,320 @@
+package morpheus
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/spf13/viper"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	hookDefaultTimeout   = 10
+	hookDefaultRateLimit = 10
+	// hookMaxProcs is the maximum number of hook processes running at once
+	hookMaxProcs = 4
+)
+
+// HookConfig is a [[Hooks]] table of the config file.  Empty filters match
+// everything.
+type HookConfig struct {
+	// Command is run with sh -c
+	Command string
+	// Rooms is a list of room IDs
+	Rooms []string
+	// Senders is a list of user IDs
+	Senders []string
+	// Highlight restricts the hook to messages that mention our user
+	Highlight bool
+	// MsgTypes is a list of msgtypes, like "m.text" or "m.image"
+	MsgTypes []string
+	// Stdin is "json" to write the event as a JSON object to the stdin of
+	// the command.  The event is always passed in MORPHEUS_* environment
+	// variables.
+	Stdin string
+	// Timeout in seconds after which the command is killed
+	Timeout int
+	// RateLimit is the maximum number of runs per minute
+	RateLimit int
+	// IncludeOwn runs the hook for the messages sent by our user too
+	IncludeOwn bool
+}
+
+// HookEvent holds the details of a message passed to a hook.
+type HookEvent struct {
+	Account    string `json:"account"`
+	RoomID     string `json:"room_id"`
+	RoomName   string `json:"room_name"`
+	EventID    string `json:"event_id"`
+	Sender     string `json:"sender"`
+	SenderName string `json:"sender_name"`
+	MsgType    string `json:"msgtype"`
+	Body       string `json:"body"`
+	Ts         int64  `json:"ts"`
+	Highlight  bool   `json:"highlight"`
+}
+
+func (he *HookEvent) env() []string {
+	return []string{
+		"MORPHEUS_ACCOUNT=" + he.Account,
+		"MORPHEUS_ROOM_ID=" + he.RoomID,
+		"MORPHEUS_ROOM_NAME=" + he.RoomName,
+		"MORPHEUS_EVENT_ID=" + he.EventID,
+		"MORPHEUS_SENDER=" + he.Sender,
+		"MORPHEUS_SENDER_NAME=" + he.SenderName,
+		"MORPHEUS_MSGTYPE=" + he.MsgType,
+		"MORPHEUS_BODY=" + he.Body,
+		"MORPHEUS_TS=" + strconv.FormatInt(he.Ts, 10),
+		"MORPHEUS_HIGHLIGHT=" + strconv.FormatBool(he.Highlight),
+	}
+}
+
+type Hook struct {
+	cfg     HookConfig
+	enabled bool
+	// Token bucket refilled at cfg.RateLimit tokens per minute
+	tokens   float64
+	lastFill time.Time
+	runs     uint
+	dropped  uint
+	mux      sync.Mutex
+}
+
+func (h *Hook) Command() string {
+	return h.cfg.Command
+}
+
+func (h *Hook) Enabled() bool {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	return h.enabled
+}
+
+func (h *Hook) SetEnabled(enabled bool) {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	h.enabled = enabled
+}
+
+// Stats returns the number of times the hook has run and the number of times
+// it was skipped by the rate limit.
+func (h *Hook) Stats() (runs, dropped uint) {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	return h.runs, h.dropped
+}
+
+func (h *Hook) match(he *HookEvent) bool {
+	if h.cfg.Highlight && !he.Highlight {
+		return false
+	}
+	return matchAny(h.cfg.Rooms, he.RoomID) && matchAny(h.cfg.Senders, he.Sender) &&
+		matchAny(h.cfg.MsgTypes, he.MsgType)
+}
+
+func matchAny(list []string, s string) bool {
+	if len(list) == 0 {
+		return true
+	}
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+// take returns true if the rate limit allows running the hook now.  The
+// skipped runs are counted as dropped.
+func (h *Hook) take(now time.Time) bool {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	rate := float64(h.cfg.RateLimit)
+	h.tokens += now.Sub(h.lastFill).Minutes() * rate
+	if h.tokens > rate {
+		h.tokens = rate
+	}
+	h.lastFill = now
+	if h.tokens < 1 {
+		h.dropped++
+		return false
+	}
+	h.tokens--
+	return true
+}
+
+func (h *Hook) count(ran bool) {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	if ran {
+		h.runs++
+	} else {
+		h.dropped++
+	}
+}
+
+// Hooks runs external commands for the new messages published in a Bus.
+type Hooks struct {
+	H     []*Hook
+	bus   *Bus
+	sub   *Subscription
+	procs chan struct{}
+	start int64
+	// errs receives the errors of the hook processes
+	errs chan error
+}
+
+// NewHooks reads the [[Hooks]] tables of the config file, which must have
+// been loaded by NewClient or NewClients, and starts running them for the
+// messages published in bus.  The errors of the hook processes are delivered
+// through Errs.
+func NewHooks(bus *Bus) (*Hooks, error) {
+	var cfgs []HookConfig
+	if viper.IsSet("Hooks") {
+		if err := viper.UnmarshalKey("Hooks", &cfgs); err != nil {
+			return nil, fmt.Errorf("Error decoding Hooks in config file, %v", err)
+		}
+	}
+	now := time.Now()
+	hs := &Hooks{
+		bus:   bus,
+		procs: make(chan struct{}, hookMaxProcs),
+		start: now.Unix() * 1000,
+		errs:  make(chan error, 16),
+	}
+	for i, cfg := range cfgs {
+		if cfg.Command == "" {
+			return nil, fmt.Errorf("Hook %d: Key Command not found", i)
+		}
+		if cfg.Stdin != "" && cfg.Stdin != "json" {
+			return nil, fmt.Errorf("Hook %d: Invalid Stdin %s", i, cfg.Stdin)
+		}
+		if cfg.Timeout <= 0 {
+			cfg.Timeout = hookDefaultTimeout
+		}
+		if cfg.RateLimit <= 0 {
+			cfg.RateLimit = hookDefaultRateLimit
+		}
+		hs.H = append(hs.H, &Hook{cfg: cfg, enabled: true,
+			tokens: float64(cfg.RateLimit), lastFill: now})
+	}
+	if len(hs.H) != 0 {
+		hs.sub = bus.Subscribe(BusFilter{Types: []BusEventType{BusMessage}}, 256)
+		go hs.loop()
+	}
+	return hs, nil
+}
+
+// Errs delivers the errors of the hook processes.  Errors are dropped if
+// nobody reads them.
+func (hs *Hooks) Errs() <-chan error {
+	return hs.errs
+}
+
+func (hs *Hooks) Stop() {
+	if hs.sub != nil {
+		hs.bus.Unsubscribe(hs.sub)
+	}
+}
+
+func (hs *Hooks) loop() {
+	for ev := range hs.sub.C {
+		he, ok := hs.hookEvent(&ev)
+		if !ok {
+			continue
+		}
+		for _, h := range hs.H {
+			if !h.Enabled() || !h.match(he) {
+				continue
+			}
+			if !h.cfg.IncludeOwn && he.Sender == he.Account {
+				continue
+			}
+			if !h.take(time.Now()) {
+				continue
+			}
+			// Don't block the bus waiting for a slow hook
+			select {
+			case hs.procs <- struct{}{}:
+				h.count(true)
+				go hs.run(h, he)
+			default:
+				h.count(false)
+			}
+		}
+	}
+}
+
+// hookEvent builds the HookEvent of a new message.  Messages from the
+// history, the console and our own echo are skipped.
+func (hs *Hooks) hookEvent(ev *BusEvent) (*HookEvent, bool) {
+	if ev.Event == nil || ev.Room == nil || ev.Client == nil {
+		return nil, false
+	}
+	if ev.Room.ID() == ConsoleRoomID || ev.Event.Ts < hs.start {
+		return nil, false
+	}
+	msg, ok := ev.Event.Content.(Message)
+	if !ok {
+		return nil, false
+	}
+	he := &HookEvent{
+		Account:   ev.Client.GetUserID(),
+		RoomID:    ev.Room.ID(),
+		RoomName:  ev.Room.DispName(),
+		EventID:   ev.Event.ID,
+		Sender:    ev.Event.Sender,
+		MsgType:   msg.MsgType,
+		Ts:        ev.Event.Ts,
+		Highlight: ev.Event.Highlight,
+	}
+	switch cnt := msg.Content.(type) {
+	case TextMessage:
+		he.Body = cnt.Body
+	default:
+		he.Body = fmt.Sprint(cnt)
+	}
+	he.SenderName = he.Sender
+	if u := ev.Room.Users.ByID(he.Sender); u != nil {
+		he.SenderName = u.DispName()
+	}
+	return he, true
+}
+
+func (hs *Hooks) run(h *Hook, he *HookEvent) {
+	defer func() { <-hs.procs }()
+	ctx, cancel := context.WithTimeout(context.Background(),
+		time.Duration(h.cfg.Timeout)*time.Second)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "sh", "-c", h.cfg.Command)
+	cmd.Env = append(os.Environ(), he.env()...)
+	if h.cfg.Stdin == "json" {
+		data, err := json.Marshal(he)
+		if err != nil {
+			hs.error(fmt.Errorf("Hook %s: %v", h.cfg.Command, err))
+			return
+		}
+		cmd.Stdin = bytes.NewReader(data)
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			err = fmt.Errorf("timeout after %ds", h.cfg.Timeout)
+		}
+		hs.error(fmt.Errorf("Hook %s: %v %s", h.cfg.Command, err,
+			bytes.TrimSpace(stderr.Bytes())))
+	}
+}
+
+func (hs *Hooks) error(err error) {
+	select {
+	case hs.errs <- err:
+	default:
+	}
+}
@@ -0,0 +1,406 @@
+package morpheus
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"github.com/boltdb/bolt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// Index is an on-disk inverted index of the message bodies of our rooms,
+// used to search without the homeserver.  The encrypted messages are indexed
+// as their cleartext when the client has a Decrypter.  The bolt DB has the
+// buckets:
+//
+//	/index_docs/<roomID>\x00<eventID> -> JSON indexDoc
+//	/index_terms/<term>/<roomID>\x00<eventID> -> term frequency
+//	/index_meta/docs -> number of documents
+type Index struct {
+	db *bolt.DB
+	// queue holds the timeline events until they are written in batches by
+	// loop, ready is signaled when it gets events
+	queue   []indexItem
+	mux     sync.Mutex
+	ready   chan struct{}
+	closing chan struct{}
+	done    chan struct{}
+	onErr   func(error)
+	once    sync.Once
+}
+
+type indexItem struct {
+	roomID string
+	e      *Event
+}
+
+type indexDoc struct {
+	RoomID  string     `json:"room_id"`
+	EventID string     `json:"event_id"`
+	Sender  string     `json:"sender"`
+	Ts      int64      `json:"ts"`
+	MsgType string     `json:"msgtype"`
+	TxtType MsgTxtType `json:"txt_type"`
+	Body    string     `json:"body"`
+}
+
+func (doc *indexDoc) event() *Event {
+	return &Event{Type: "m.room.message", ID: doc.EventID, Ts: doc.Ts, Sender: doc.Sender,
+		Content: Message{doc.MsgType, TextMessage{Body: doc.Body, Type: doc.TxtType}}}
+}
+
+// IndexQuery is a local search.  Empty fields match everything.
+type IndexQuery struct {
+	// Terms are the words that the message must contain
+	Terms   string
+	Senders []string
+	Rooms   []string
+	Since   time.Time
+	Until   time.Time
+	// Limit is the maximum number of results, 50 by default
+	Limit int
+}
+
+// OpenIndex opens the index DB.  The errors of the events queued with Queue
+// are passed to onErr.
+func OpenIndex(filename string, onErr func(error)) (*Index, error) {
+	db, err := bolt.Open(filename, 0600, &bolt.Options{Timeout: 200 * time.Millisecond})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range []string{"index_docs", "index_terms", "index_meta"} {
+			if _, err := tx.CreateBucketIfNotExists([]byte(bucket)); err != nil {
+				return fmt.Errorf("create bucket: %s", err)
+			}
+		}
+		// The indexes created without the counter are counted once
+		if tx.Bucket([]byte("index_meta")).Get([]byte("docs")) != nil {
+			return nil
+		}
+		n := 0
+		tx.Bucket([]byte("index_docs")).ForEach(func(k, v []byte) error {
+			n++
+			return nil
+		})
+		return addDocs(tx, n)
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	idx := &Index{db: db, ready: make(chan struct{}, 1),
+		closing: make(chan struct{}), done: make(chan struct{}), onErr: onErr}
+	go idx.loop()
+	return idx, nil
+}
+
+// Close writes the queued events and closes the DB.
+func (idx *Index) Close() {
+	idx.once.Do(func() {
+		close(idx.closing)
+		<-idx.done
+		idx.db.Close()
+	})
+}
+
+// maxTermLen is the length in bytes of the longest term that is indexed.
+// The longer words are hashes, encoded data and the like, and could exceed
+// the maximum key size of bolt.
+const maxTermLen = 64
+
+// tokenize splits text into lowercase words, skipping single characters and
+// the words longer than maxTermLen.
+func tokenize(text string) []string {
+	words := strings.FieldsFunc(strings.ToLower(text), func(c rune) bool {
+		return !unicode.IsLetter(c) && !unicode.IsNumber(c)
+	})
+	terms := make([]string, 0, len(words))
+	for _, w := range words {
+		if len([]rune(w)) > 1 && len(w) <= maxTermLen {
+			terms = append(terms, w)
+		}
+	}
+	return terms
+}
+
+func docKey(roomID, eventID string) []byte {
+	return []byte(roomID + "\x00" + eventID)
+}
+
+func uint32tobytes(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	return b
+}
+
+// docCount returns the number of documents in the index.
+func docCount(tx *bolt.Tx) int {
+	v := tx.Bucket([]byte("index_meta")).Get([]byte("docs"))
+	if len(v) != 8 {
+		return 0
+	}
+	return int(binary.BigEndian.Uint64(v))
+}
+
+// addDocs adds n, which can be negative, to the number of documents.
+func addDocs(tx *bolt.Tx, n int) error {
+	count := docCount(tx) + n
+	if count < 0 {
+		count = 0
+	}
+	v := make([]byte, 8)
+	binary.BigEndian.PutUint64(v, uint64(count))
+	return tx.Bucket([]byte("index_meta")).Put([]byte("docs"), v)
+}
+
+// put indexes a text message of a room.  Events that are already in the
+// index and other kinds of events are ignored.
+func put(tx *bolt.Tx, roomID string, e *Event) error {
+	msg, ok := e.Content.(Message)
+	if !ok {
+		return nil
+	}
+	txtMsg, ok := msg.Content.(TextMessage)
+	if !ok {
+		return nil
+	}
+	key := docKey(roomID, e.ID)
+	docs := tx.Bucket([]byte("index_docs"))
+	if docs.Get(key) != nil {
+		return nil
+	}
+	doc := indexDoc{RoomID: roomID, EventID: e.ID, Sender: e.Sender, Ts: e.Ts,
+		MsgType: msg.MsgType, TxtType: txtMsg.Type, Body: txtMsg.Body}
+	data, err := json.Marshal(&doc)
+	if err != nil {
+		return err
+	}
+	if err := docs.Put(key, data); err != nil {
+		return err
+	}
+	if err := addDocs(tx, 1); err != nil {
+		return err
+	}
+	tf := make(map[string]uint32)
+	for _, term := range tokenize(txtMsg.Body) {
+		tf[term]++
+	}
+	terms := tx.Bucket([]byte("index_terms"))
+	for term, n := range tf {
+		b, err := terms.CreateBucketIfNotExists([]byte(term))
+		if err != nil {
+			return err
+		}
+		if err := b.Put(key, uint32tobytes(n)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// maxIndexBatch is the maximum number of events written in a transaction.
+const maxIndexBatch = 1024
+
+// Queue indexes a text message of a room in the background without blocking.
+// Events queued after Close are dropped.
+func (idx *Index) Queue(roomID string, e *Event) {
+	select {
+	case <-idx.closing:
+		return
+	default:
+	}
+	idx.mux.Lock()
+	idx.queue = append(idx.queue, indexItem{roomID, e})
+	idx.mux.Unlock()
+	select {
+	case idx.ready <- struct{}{}:
+	default:
+	}
+}
+
+// write writes a batch of events in a single transaction.  If it fails, the
+// events are written one by one so that only the ones that fail are lost.
+func (idx *Index) write(batch []indexItem) {
+	err := idx.db.Update(func(tx *bolt.Tx) error {
+		for _, item := range batch {
+			if err := put(tx, item.roomID, item.e); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err == nil || len(batch) == 1 {
+		if err != nil {
+			idx.onErr(fmt.Errorf("%s %s: %v", batch[0].roomID, batch[0].e.ID, err))
+		}
+		return
+	}
+	for _, item := range batch {
+		idx.write([]indexItem{item})
+	}
+}
+
+// loop writes the queued events, all the ones available in transactions of
+// up to maxIndexBatch events.
+func (idx *Index) loop() {
+	defer close(idx.done)
+	for {
+		idx.mux.Lock()
+		queue := idx.queue
+		idx.queue = nil
+		idx.mux.Unlock()
+		for len(queue) != 0 {
+			n := len(queue)
+			if n > maxIndexBatch {
+				n = maxIndexBatch
+			}
+			idx.write(queue[:n])
+			queue = queue[n:]
+		}
+		select {
+		case <-idx.ready:
+		case <-idx.closing:
+			idx.mux.Lock()
+			empty := len(idx.queue) == 0
+			idx.mux.Unlock()
+			if empty {
+				return
+			}
+		}
+	}
+}
+
+func (q *IndexQuery) match(doc *indexDoc) bool {
+	if !matchAny(q.Senders, doc.Sender) || !matchAny(q.Rooms, doc.RoomID) {
+		return false
+	}
+	ts := time.Unix(doc.Ts/1000, 0)
+	if !q.Since.IsZero() && ts.Before(q.Since) {
+		return false
+	}
+	if !q.Until.IsZero() && !ts.Before(q.Until) {
+		return false
+	}
+	return true
+}
+
+// Search returns the messages that contain all the terms of the query,
+// ranked by TF-IDF, or by date if the query has no terms.  The queries whose
+// words are all too short to be indexed match nothing.
+func (idx *Index) Search(q *IndexQuery) (*SearchResults, error) {
+	limit := q.Limit
+	if limit <= 0 {
+		limit = 50
+	}
+	terms := tokenize(q.Terms)
+	if len(terms) == 0 && strings.TrimSpace(q.Terms) != "" {
+		return &SearchResults{Highlights: terms}, nil
+	}
+	type scored struct {
+		doc  indexDoc
+		rank float64
+	}
+	var matches []scored
+	err := idx.db.View(func(tx *bolt.Tx) error {
+		docs := tx.Bucket([]byte("index_docs"))
+		getDoc := func(key []byte) (*indexDoc, error) {
+			var doc indexDoc
+			if err := json.Unmarshal(docs.Get(key), &doc); err != nil {
+				return nil, err
+			}
+			return &doc, nil
+		}
+		if len(terms) == 0 {
+			return docs.ForEach(func(k, v []byte) error {
+				var doc indexDoc
+				if err := json.Unmarshal(v, &doc); err != nil {
+					return err
+				}
+				if q.match(&doc) {
+					matches = append(matches, scored{doc, float64(doc.Ts)})
+				}
+				return nil
+			})
+		}
+		nDocs := docCount(tx)
+		// Intersect the posting lists adding the TF-IDF of every term
+		var ranks map[string]float64
+		for _, term := range terms {
+			b := tx.Bucket([]byte("index_terms")).Bucket([]byte(term))
+			if b == nil {
+				return nil
+			}
+			postings := make(map[string]uint32)
+			b.ForEach(func(k, v []byte) error {
+				postings[string(k)] = binary.BigEndian.Uint32(v)
+				return nil
+			})
+			idf := math.Log(float64(nDocs+1) / float64(len(postings)))
+			newRanks := make(map[string]float64)
+			for key, n := range postings {
+				rank, ok := ranks[key]
+				if ranks != nil && !ok {
+					continue
+				}
+				newRanks[key] = rank + (1+math.Log(float64(n)))*idf
+			}
+			ranks = newRanks
+		}
+		for key, rank := range ranks {
+			doc, err := getDoc([]byte(key))
+			if err != nil {
+				return err
+			}
+			if q.match(doc) {
+				matches = append(matches, scored{*doc, rank})
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].rank != matches[j].rank {
+			return matches[i].rank > matches[j].rank
+		}
+		return matches[i].doc.Ts > matches[j].doc.Ts
+	})
+	results := &SearchResults{Count: len(matches), Highlights: terms}
+	for i := 0; i < len(matches) && i < limit; i++ {
+		results.Results = append(results.Results, SearchResult{
+			RoomID: matches[i].doc.RoomID,
+			Rank:   matches[i].rank,
+			Event:  matches[i].doc.event(),
+		})
+	}
+	return results, nil
+}
+
+// indexEvent adds an event of the room to the local index, if there is one.
+func (c *Client) indexEvent(r *Room, e *Event) {
+	c.indexRoomEvent(r.ID(), e)
+}
+
+// indexRoomEvent indexes an event of a room that may not be in Rooms, like
+// the predecessors whose history is shown in their successor.
+func (c *Client) indexRoomEvent(roomID string, e *Event) {
+	if c.index == nil || roomID == ConsoleRoomID {
+		return
+	}
+	c.index.Queue(roomID, e)
+}
+
+// SearchLocal searches the local index of messages.
+func (c *Client) SearchLocal(q *IndexQuery) (*SearchResults, error) {
+	if c.index == nil {
+		return nil, fmt.Errorf("No IndexDB in config file")
+	}
+	return c.index.Search(q)
+}
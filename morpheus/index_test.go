@@ -0,0 +1,206 @@
+package morpheus
+
+import (
+	"bytes"
+	"errors"
+	"github.com/boltdb/bolt"
+	"github.com/matrix-org/gomatrix"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTokenize(t *testing.T) {
+	long := strings.Repeat("a", maxTermLen)
+	tests := []struct {
+		text  string
+		terms []string
+	}{
+		{"", []string{}},
+		{"Hello, World!", []string{"hello", "world"}},
+		{"a b cd", []string{"cd"}},
+		{"don't stop", []string{"don", "stop"}},
+		{"v1.2 x86_64", []string{"v1", "x86", "64"}},
+		{"Ünïcödé ĳ 日本語", []string{"ünïcödé", "日本語"}},
+		{long + " " + long + "a", []string{long}},
+	}
+	for _, test := range tests {
+		if terms := tokenize(test.text); !reflect.DeepEqual(terms, test.terms) {
+			t.Errorf("tokenize(%q) = %q, want %q", test.text, terms, test.terms)
+		}
+	}
+}
+
+// openTestIndex opens an index in a temporary directory, removed by the
+// returned function.
+func openTestIndex(t *testing.T) (*Index, string, func()) {
+	dir, err := ioutil.TempDir("", "morpheus-index")
+	if err != nil {
+		t.Fatal(err)
+	}
+	filename := filepath.Join(dir, "index.db")
+	idx, err := OpenIndex(filename, func(err error) { t.Error(err) })
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return idx, filename, func() {
+		idx.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func textEvent(id, sender string, ts time.Time, body string) *Event {
+	return &Event{Type: "m.room.message", ID: id, Ts: ts.Unix() * 1000, Sender: sender,
+		Content: Message{"m.text", TextMessage{Body: body, Type: MsgTxtTypeText}}}
+}
+
+func putEvents(t *testing.T, idx *Index, roomID string, events ...*Event) {
+	err := idx.db.Update(func(tx *bolt.Tx) error {
+		for _, e := range events {
+			if err := put(tx, roomID, e); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// resultIDs returns the event IDs of the results in order.
+func resultIDs(res *SearchResults) []string {
+	ids := []string{}
+	for _, result := range res.Results {
+		ids = append(ids, result.Event.ID)
+	}
+	return ids
+}
+
+func TestIndexSearch(t *testing.T) {
+	idx, _, remove := openTestIndex(t)
+	defer remove()
+	day := time.Date(2020, 1, 10, 12, 0, 0, 0, time.Local)
+	putEvents(t, idx, "!a:x",
+		textEvent("$1", "@alice:x", day, "the cat sat on the mat"),
+		textEvent("$2", "@bob:x", day.Add(time.Hour), "cat cat cat"),
+		textEvent("$3", "@alice:x", day.AddDate(0, 0, 1), "a dog"),
+	)
+	putEvents(t, idx, "!b:x",
+		textEvent("$4", "@alice:x", day.AddDate(0, 0, 2), "the cat and the dog"),
+	)
+	// Indexing an event again is ignored
+	putEvents(t, idx, "!a:x", textEvent("$1", "@alice:x", day, "the cat sat on the mat"))
+	tests := []struct {
+		q   IndexQuery
+		ids []string
+	}{
+		// The repeated term ranks higher, then the newest
+		{IndexQuery{Terms: "cat"}, []string{"$2", "$4", "$1"}},
+		{IndexQuery{Terms: "CAT dog"}, []string{"$4"}},
+		{IndexQuery{Terms: "cat bird"}, []string{}},
+		{IndexQuery{Terms: "cat", Limit: 1}, []string{"$2"}},
+		// Without terms, by date
+		{IndexQuery{}, []string{"$4", "$3", "$2", "$1"}},
+		// Only words too short to be indexed
+		{IndexQuery{Terms: "a"}, []string{}},
+		{IndexQuery{Terms: "cat", Rooms: []string{"!b:x"}}, []string{"$4"}},
+		{IndexQuery{Terms: "cat", Senders: []string{"@alice:x"}}, []string{"$4", "$1"}},
+		{IndexQuery{Senders: []string{"@bob:x", "@carol:x"}}, []string{"$2"}},
+		{IndexQuery{Since: day.AddDate(0, 0, 1)}, []string{"$4", "$3"}},
+		{IndexQuery{Until: day.AddDate(0, 0, 1)}, []string{"$2", "$1"}},
+		{IndexQuery{Terms: "dog", Since: day, Until: day.AddDate(0, 0, 2)},
+			[]string{"$3"}},
+	}
+	for _, test := range tests {
+		res, err := idx.Search(&test.q)
+		if err != nil {
+			t.Errorf("Search(%+v): %v", test.q, err)
+			continue
+		}
+		if ids := resultIDs(res); !reflect.DeepEqual(ids, test.ids) {
+			t.Errorf("Search(%+v) = %q, want %q", test.q, ids, test.ids)
+		}
+	}
+}
+
+func TestIndexDeleteRoom(t *testing.T) {
+	idx, _, remove := openTestIndex(t)
+	defer remove()
+	now := time.Now()
+	putEvents(t, idx, "!a:x", textEvent("$1", "@alice:x", now, "hello world"))
+	putEvents(t, idx, "!b:x", textEvent("$2", "@alice:x", now, "hello there"))
+	if err := idx.DeleteRoom("!a:x"); err != nil {
+		t.Fatal(err)
+	}
+	res, err := idx.Search(&IndexQuery{Terms: "hello"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids := resultIDs(res); !reflect.DeepEqual(ids, []string{"$2"}) {
+		t.Errorf("Search(hello) = %q after DeleteRoom, want [$2]", ids)
+	}
+	err = idx.db.View(func(tx *bolt.Tx) error {
+		if n := docCount(tx); n != 1 {
+			t.Errorf("docCount = %d after DeleteRoom, want 1", n)
+		}
+		if b := tx.Bucket([]byte("index_terms")).Bucket([]byte("world")); b != nil &&
+			b.Get(docKey("!a:x", "$1")) != nil {
+			t.Errorf("term world still has the deleted event")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testDecrypter has the cleartext of the events by room ID and event ID.
+type testDecrypter map[string]gomatrix.Event
+
+func (d testDecrypter) Decrypt(roomID string, ev *gomatrix.Event) (*gomatrix.Event, error) {
+	dec, ok := d[roomID+ev.ID]
+	if !ok {
+		return nil, errors.New("unknown session")
+	}
+	return &dec, nil
+}
+
+func TestIndexDecrypted(t *testing.T) {
+	idx, filename, remove := openTestIndex(t)
+	defer remove()
+	c := &Client{index: idx, debugBuf: &bytes.Buffer{}}
+	c.SetDecrypter(testDecrypter{"!a:x$1": gomatrix.Event{Type: "m.room.message",
+		ID: "$1", Sender: "@alice:x", Timestamp: 1000,
+		Content: map[string]interface{}{"msgtype": "m.text", "body": "secret plans"}}})
+	rs := NewRooms(NewBus())
+	rs.client = c
+	userID := "@me:x"
+	r := NewRoom(&rs, "!a:x", MemJoin, "", "", "")
+	r.myUserID = &userID
+	_, err := r.storeEvent(r.ID(), &gomatrix.Event{Type: "m.room.encrypted", ID: "$1",
+		Sender: "@alice:x", Timestamp: 1000,
+		Content: map[string]interface{}{"algorithm": "m.megolm.v1.aes-sha2"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Write the queued event
+	idx.Close()
+	idx, err = OpenIndex(filename, func(err error) { t.Error(err) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+	res, err := idx.Search(&IndexQuery{Terms: "plans"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids := resultIDs(res); !reflect.DeepEqual(ids, []string{"$1"}) {
+		t.Errorf("Search(plans) = %q, want [$1]", ids)
+	}
+}
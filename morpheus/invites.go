@@ -0,0 +1,121 @@
+package morpheus
+
+import (
+	"fmt"
+)
+
+// AutoAcceptConfig are the invites joined without asking.  Both lists are
+// empty by default, which accepts none.
+type AutoAcceptConfig struct {
+	// Inviters are user IDs
+	Inviters []string
+	// Servers are server names of the inviter
+	Servers []string
+}
+
+// Invite is the preview of a room we are invited to, from its stripped
+// state.
+type Invite struct {
+	Inviter    string
+	Reason     string
+	IsDirect   bool
+	Name       string
+	CanonAlias string
+	Topic      string
+	// Members is the number of joined members that the stripped state
+	// has, usually only the inviter
+	Members int
+}
+
+// Invite returns the invite of the room, or nil if we are not invited.
+func (r *Room) Invite() *Invite {
+	if r.Mem() != MemInvite {
+		return nil
+	}
+	r.rwm.RLock()
+	defer r.rwm.RUnlock()
+	inv := &Invite{Name: r.name, CanonAlias: r.canonAlias, Topic: r.topic}
+	for key, content := range r.state {
+		if key.Type != "m.room.member" {
+			continue
+		}
+		if key.StateKey == *r.myUserID {
+			inv.Reason, _ = content["reason"].(string)
+			inv.IsDirect, _ = content["is_direct"].(bool)
+		} else if content["membership"] == "join" {
+			inv.Members++
+		}
+	}
+	inv.Inviter = r.inviter
+	return inv
+}
+
+// setInviter records the sender of our invite from the stripped state.
+func (r *Room) setInviter(sender string) {
+	r.rwm.Lock()
+	r.inviter = sender
+	r.rwm.Unlock()
+}
+
+// autoAccept returns true if the invite matches the AutoAccept rules.
+func (c *Client) autoAccept(inviter string) bool {
+	for _, userID := range c.cfg.AutoAccept.Inviters {
+		if userID == inviter {
+			return true
+		}
+	}
+	_, server, err := splitUserID(inviter)
+	if err != nil {
+		return false
+	}
+	for _, s := range c.cfg.AutoAccept.Servers {
+		if s == server {
+			return true
+		}
+	}
+	return false
+}
+
+// AcceptInvite joins a room we are invited to.
+func (c *Client) AcceptInvite(roomID string) error {
+	r := c.Rs.ByID(roomID)
+	if r == nil || r.Mem() != MemInvite {
+		return fmt.Errorf("No invite to room %s", roomID)
+	}
+	return c.withAuth(func() error {
+		_, err := c.cli.JoinRoom(roomID, "", nil)
+		return err
+	})
+}
+
+type reqLeave struct {
+	Reason string `json:"reason,omitempty"`
+}
+
+// DeclineInvite rejects an invite, with an optional reason.
+func (c *Client) DeclineInvite(roomID, reason string) error {
+	r := c.Rs.ByID(roomID)
+	if r == nil || r.Mem() != MemInvite {
+		return fmt.Errorf("No invite to room %s", roomID)
+	}
+	return c.withAuth(func() error {
+		_, err := c.cli.MakeRequest("POST", c.cli.BuildURL("rooms", roomID, "leave"),
+			&reqLeave{Reason: reason}, nil)
+		return err
+	})
+}
+
+// updateInvite processes the stripped state of an invited room and accepts
+// the invite if the AutoAccept rules match the inviter.
+func (c *Client) updateInvite(r *Room, newInvite bool) {
+	inv := r.Invite()
+	if inv == nil || !newInvite || inv.Inviter == "" || !c.autoAccept(inv.Inviter) {
+		return
+	}
+	go func() {
+		c.ConsolePrintf(MsgTxtTypeNotice, "Accepting invite of %s to %s", inv.Inviter, r)
+		if err := c.AcceptInvite(r.ID()); err != nil {
+			c.ConsolePrint(MsgTxtTypeNotice, "accept:", err)
+		}
+	}()
+}
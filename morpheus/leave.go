@@ -0,0 +1,109 @@
+package morpheus
+
+import (
+	"encoding/json"
+	"github.com/boltdb/bolt"
+	"strings"
+	"time"
+)
+
+// hideLeft schedules the removal of a left room from Rooms, if the config
+// sets HideLeftRoomsAfter.  The room is still in the homeserver and comes
+// back if we join it again.
+func (rs *Rooms) hideLeft(r *Room) {
+	after := rs.client.cfg.HideLeftRoomsAfter
+	if after <= 0 {
+		return
+	}
+	roomID := r.ID()
+	rs.rwm.Lock()
+	defer rs.rwm.Unlock()
+	if t, ok := rs.hideTimers[roomID]; ok {
+		t.Stop()
+	}
+	rs.hideTimers[roomID] = time.AfterFunc(time.Duration(after)*time.Second, func() {
+		rs.rwm.Lock()
+		delete(rs.hideTimers, roomID)
+		rs.rwm.Unlock()
+		if rs.ByID(roomID) == r && r.Mem() == MemLeave {
+			rs.Del(roomID)
+		}
+	})
+}
+
+func (rs *Rooms) stopHideTimers() {
+	rs.rwm.Lock()
+	defer rs.rwm.Unlock()
+	for roomID, t := range rs.hideTimers {
+		t.Stop()
+		delete(rs.hideTimers, roomID)
+	}
+}
+
+// ForgetRoom leaves the room if we are in it and forgets it, so that the
+// homeserver doesn't send it anymore, and removes it from Rooms, the local
+// index and the chat logs.
+func (c *Client) ForgetRoom(roomID string) error {
+	r := c.Rs.ByID(roomID)
+	if r != nil && r.Mem() != MemLeave && r.Mem() != MemBan {
+		if err := c.LeaveRoom(roomID); err != nil {
+			return err
+		}
+	}
+	err := c.withAuth(func() error {
+		_, err := c.cli.MakeRequest("POST", c.cli.BuildURL("rooms", roomID, "forget"),
+			struct{}{}, nil)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	alias := ""
+	if r != nil {
+		alias = r.CanonAlias()
+		c.Rs.Del(roomID)
+	}
+	if c.chatLog != nil {
+		c.chatLog.Forget(roomID, alias)
+	}
+	if c.index != nil {
+		if err := c.index.DeleteRoom(roomID); err != nil {
+			c.DebugPrint("index:", err)
+		}
+	}
+	return nil
+}
+
+// DeleteRoom removes the messages of a room from the index.
+func (idx *Index) DeleteRoom(roomID string) error {
+	prefix := roomID + "\x00"
+	return idx.db.Update(func(tx *bolt.Tx) error {
+		docs := tx.Bucket([]byte("index_docs"))
+		terms := tx.Bucket([]byte("index_terms"))
+		var keys [][]byte
+		var bodies []string
+		cur := docs.Cursor()
+		for k, v := cur.Seek([]byte(prefix)); k != nil &&
+			strings.HasPrefix(string(k), prefix); k, v = cur.Next() {
+			var doc indexDoc
+			if err := json.Unmarshal(v, &doc); err != nil {
+				return err
+			}
+			keys = append(keys, append([]byte{}, k...))
+			bodies = append(bodies, doc.Body)
+		}
+		for i, key := range keys {
+			for _, term := range tokenize(bodies[i]) {
+				if b := terms.Bucket([]byte(term)); b != nil {
+					if err := b.Delete(key); err != nil {
+						return err
+					}
+				}
+			}
+			if err := docs.Delete(key); err != nil {
+				return err
+			}
+		}
+		return addDocs(tx, -len(keys))
+	})
+}
@@ -0,0 +1,410 @@
+package morpheus
+
+import (
+	"html"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// The messages are written in a subset of CommonMark: paragraphs, ATX and
+// setext headings, fenced code blocks, block quotes, lists, thematic breaks, and
+// emphasis, strikethrough, code spans, links, autolinks and @mentions of the
+// members of the room.  The lines of a paragraph are separated with line
+// breaks, as in most chat clients.
+
+// mentionFunc returns the user mentioned at the start of s, its display name
+// and the length of the mention in s, or n = 0 if there's none.
+type mentionFunc func(s string) (userID, name string, n int)
+
+var (
+	mdHeading    = regexp.MustCompile(`^ {0,3}(#{1,6})(?:[ \t]+(.*?))?(?:[ \t]+#+)?[ \t]*$`)
+	mdSetext     = regexp.MustCompile(`^ {0,3}(=+|-+)[ \t]*$`)
+	mdBreak      = regexp.MustCompile(`^ {0,3}(?:(?:-[ \t]*){3,}|(?:\*[ \t]*){3,}|(?:_[ \t]*){3,})$`)
+	mdFence      = regexp.MustCompile("^ {0,3}(```+|~~~+)[ \t]*([^`\\s]*)")
+	mdQuote      = regexp.MustCompile(`^ {0,3}> ?(.*)$`)
+	mdListItem   = regexp.MustCompile(`^( {0,3})([-*+]|(\d{1,9})[.)])(?:[ \t]+(.*))?$`)
+	mdAutolink   = regexp.MustCompile(`^<((?:https?|mailto|matrix):[^\s<>]+)>`)
+	mdBareURL    = regexp.MustCompile(`^https?://[^\s<>]+`)
+	mdInlineLink = regexp.MustCompile(`^\[([^\]]+)\]\(([^\s()]+)\)`)
+)
+
+// markdownHTML converts Markdown to HTML.
+func markdownHTML(md string, mention mentionFunc) string {
+	blocks, paragraphs := mdBlocks(strings.Split(md, "\n"), mention)
+	// A message with a single paragraph doesn't need it
+	if len(blocks) == 1 && paragraphs == 1 && strings.HasPrefix(blocks[0], "<p>") {
+		return strings.TrimSuffix(strings.TrimPrefix(blocks[0], "<p>"), "</p>")
+	}
+	return strings.Join(blocks, "")
+}
+
+// mdBlocks converts the lines to HTML blocks, returning also the number of
+// paragraphs.
+func mdBlocks(lines []string, mention mentionFunc) ([]string, int) {
+	blocks := []string{}
+	paragraphs := 0
+	var para []string
+	endPara := func() {
+		if len(para) != 0 {
+			inlines := make([]string, len(para))
+			for i, line := range para {
+				inlines[i] = mdInline(strings.TrimSpace(line), mention)
+			}
+			blocks = append(blocks, "<p>"+strings.Join(inlines, "<br>")+"</p>")
+			paragraphs++
+			para = nil
+		}
+	}
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+		if strings.TrimSpace(line) == "" {
+			endPara()
+			continue
+		}
+		if m := mdFence.FindStringSubmatch(line); m != nil {
+			endPara()
+			code := []string{}
+			for i++; i < len(lines); i++ {
+				if strings.HasPrefix(strings.TrimSpace(lines[i]), m[1]) {
+					break
+				}
+				code = append(code, lines[i])
+			}
+			class := ""
+			if m[2] != "" {
+				class = ` class="language-` + html.EscapeString(m[2]) + `"`
+			}
+			blocks = append(blocks, "<pre><code"+class+">"+
+				html.EscapeString(strings.Join(code, "\n"))+"\n</code></pre>")
+			continue
+		}
+		if m := mdHeading.FindStringSubmatch(line); m != nil {
+			endPara()
+			level := strconv.Itoa(len(m[1]))
+			blocks = append(blocks, "<h"+level+">"+mdInline(m[2], mention)+"</h"+level+">")
+			continue
+		}
+		// An underline turns the paragraph above into a heading
+		if m := mdSetext.FindStringSubmatch(line); m != nil && len(para) != 0 {
+			inlines := make([]string, len(para))
+			for i, line := range para {
+				inlines[i] = mdInline(strings.TrimSpace(line), mention)
+			}
+			level := "2"
+			if m[1][0] == '=' {
+				level = "1"
+			}
+			blocks = append(blocks, "<h"+level+">"+strings.Join(inlines, " ")+"</h"+level+">")
+			para = nil
+			continue
+		}
+		if mdBreak.MatchString(line) {
+			endPara()
+			blocks = append(blocks, "<hr>")
+			continue
+		}
+		if mdQuote.MatchString(line) {
+			endPara()
+			quoted := []string{}
+			for ; i < len(lines); i++ {
+				m := mdQuote.FindStringSubmatch(lines[i])
+				if m == nil {
+					break
+				}
+				quoted = append(quoted, m[1])
+			}
+			i--
+			inner, _ := mdBlocks(quoted, mention)
+			blocks = append(blocks, "<blockquote>"+strings.Join(inner, "")+"</blockquote>")
+			continue
+		}
+		if mdListItem.MatchString(line) {
+			endPara()
+			var list string
+			list, i = mdList(lines, i, mention)
+			blocks = append(blocks, list)
+			i--
+			continue
+		}
+		para = append(para, line)
+	}
+	endPara()
+	return blocks, paragraphs
+}
+
+// mdList converts the list that starts at lines[start], returning the index of
+// the line after it.  The lines indented after an item belong to it.
+func mdList(lines []string, start int, mention mentionFunc) (string, int) {
+	first := mdListItem.FindStringSubmatch(lines[start])
+	ordered := first[3] != ""
+	marker := first[2][len(first[2])-1:]
+	var items []string
+	var item []string
+	endItem := func() {
+		if item == nil {
+			return
+		}
+		inner, paragraphs := mdBlocks(item, mention)
+		content := strings.Join(inner, "")
+		// Tight items don't need the paragraph
+		if len(inner) != 0 && paragraphs == 1 && strings.HasPrefix(inner[0], "<p>") {
+			content = strings.TrimSuffix(strings.TrimPrefix(inner[0], "<p>"), "</p>") +
+				strings.Join(inner[1:], "")
+		}
+		items = append(items, "<li>"+content+"</li>")
+		item = nil
+	}
+	i := start
+	for ; i < len(lines); i++ {
+		line := lines[i]
+		// The more indented items are nested in the current one
+		if m := mdListItem.FindStringSubmatch(line); m != nil &&
+			len(m[1]) < len(first[1])+2 &&
+			(m[3] != "") == ordered && strings.HasSuffix(m[2], marker) {
+			endItem()
+			item = []string{m[4]}
+			continue
+		}
+		indented := strings.HasPrefix(line, "  ") || strings.HasPrefix(line, "\t")
+		if strings.TrimSpace(line) == "" {
+			// A blank line ends the list unless the item goes on
+			if i+1 < len(lines) && (strings.HasPrefix(lines[i+1], "  ") ||
+				mdListItem.MatchString(lines[i+1])) {
+				item = append(item, "")
+				continue
+			}
+			break
+		}
+		if !indented {
+			break
+		}
+		item = append(item, strings.TrimPrefix(strings.TrimLeft(line, "\t"), "  "))
+	}
+	endItem()
+	if !ordered {
+		return "<ul>" + strings.Join(items, "") + "</ul>", i
+	}
+	startAttr := ""
+	if n, _ := strconv.Atoi(first[3]); n != 1 {
+		startAttr = ` start="` + strconv.Itoa(n) + `"`
+	}
+	return "<ol" + startAttr + ">" + strings.Join(items, "") + "</ol>", i
+}
+
+// mdDelims are the emphasis delimiters, longest first
+var mdDelims = []struct {
+	delim, tag string
+}{
+	{"**", "strong"}, {"__", "strong"}, {"~~", "del"}, {"*", "em"}, {"_", "em"},
+}
+
+// isWordBefore returns true if the rune before s[i] is a letter or a digit.
+func isWordBefore(s string, i int) bool {
+	if i <= 0 {
+		return false
+	}
+	c, _ := utf8.DecodeLastRuneInString(s[:i])
+	return unicode.IsLetter(c) || unicode.IsDigit(c)
+}
+
+// isWordAt returns true if the rune at s[i] is a letter or a digit.
+func isWordAt(s string, i int) bool {
+	if i >= len(s) {
+		return false
+	}
+	c, _ := utf8.DecodeRuneInString(s[i:])
+	return unicode.IsLetter(c) || unicode.IsDigit(c)
+}
+
+// mdInline converts the inline Markdown of a line of text.
+func mdInline(s string, mention mentionFunc) string {
+	var b strings.Builder
+	for i := 0; i < len(s); {
+		rest := s[i:]
+		c := s[i]
+		switch {
+		case c == '\\' && i+1 < len(s) && strings.IndexByte("\\`*_{}[]()#+-.!~<>@|", s[i+1]) != -1:
+			b.WriteString(html.EscapeString(s[i+1 : i+2]))
+			i += 2
+			continue
+		case c == '`':
+			n := len(rest) - len(strings.TrimLeft(rest, "`"))
+			if end := strings.Index(rest[n:], rest[:n]); end != -1 {
+				code := rest[n : n+end]
+				if len(code) > 2 && code[0] == ' ' && code[len(code)-1] == ' ' {
+					code = code[1 : len(code)-1]
+				}
+				b.WriteString("<code>" + html.EscapeString(code) + "</code>")
+				i += 2*n + end
+				continue
+			}
+			b.WriteString(rest[:n])
+			i += n
+			continue
+		case c == '[':
+			if m := mdInlineLink.FindStringSubmatch(rest); m != nil {
+				b.WriteString(`<a href="` + html.EscapeString(m[2]) + `">` +
+					mdInline(m[1], mention) + "</a>")
+				i += len(m[0])
+				continue
+			}
+		case c == '<':
+			if m := mdAutolink.FindStringSubmatch(rest); m != nil {
+				b.WriteString(`<a href="` + html.EscapeString(m[1]) + `">` +
+					html.EscapeString(m[1]) + "</a>")
+				i += len(m[0])
+				continue
+			}
+		case c == 'h' && !isWordBefore(s, i):
+			if url := mdBareURL.FindString(rest); url != "" {
+				url = strings.TrimRight(url, ".,:;!?\"')")
+				b.WriteString(`<a href="` + html.EscapeString(url) + `">` +
+					html.EscapeString(url) + "</a>")
+				i += len(url)
+				continue
+			}
+		case c == '@' && !isWordBefore(s, i) && mention != nil:
+			if userID, name, n := mention(rest); n != 0 {
+				b.WriteString(`<a href="https://matrix.to/#/` + html.EscapeString(userID) +
+					`">` + html.EscapeString(name) + "</a>")
+				i += n
+				continue
+			}
+		case c == '*' || c == '_' || c == '~':
+			if tag, n, inner := mdEmphasis(s, i); n != 0 {
+				b.WriteString("<" + tag + ">" + mdInline(inner, mention) + "</" + tag + ">")
+				i += n
+				continue
+			}
+		}
+		r, size := utf8.DecodeRuneInString(rest)
+		b.WriteString(html.EscapeString(string(r)))
+		i += size
+	}
+	return b.String()
+}
+
+// mdEmphasis returns the tag, length and content of the emphasis that starts
+// at s[i], or n = 0 if there's none.  Underscores inside words, as in
+// snake_case, are not emphasis.
+func mdEmphasis(s string, i int) (tag string, n int, inner string) {
+	for _, d := range mdDelims {
+		if !strings.HasPrefix(s[i:], d.delim) {
+			continue
+		}
+		l := len(d.delim)
+		// The opening delimiter must be followed by text
+		if i+l >= len(s) || s[i+l] == ' ' || (d.delim[0] == '_' && isWordBefore(s, i)) {
+			continue
+		}
+		for j := i + l + 1; j+l <= len(s); j++ {
+			if s[j:j+l] != d.delim || s[j-1] == ' ' || s[j-1] == '\\' ||
+				(l == 1 && s[j-1] == d.delim[0]) {
+				continue
+			}
+			// Don't close ** with the first * of a longer run
+			if l == 1 && j+1 < len(s) && s[j+1] == d.delim[0] {
+				j++
+				continue
+			}
+			if d.delim[0] == '_' && isWordAt(s, j+l) {
+				continue
+			}
+			// In ***a*** the inner delimiters are the emphasis, in
+			// ***a** b* the outer one
+			if l == 2 && s[i+l] == d.delim[0] {
+				if j+l >= len(s) || s[j+l] != d.delim[0] {
+					break
+				}
+				for j+l < len(s) && s[j+l] == d.delim[0] {
+					j++
+				}
+			}
+			return d.tag, j + l - i, s[i+l : j]
+		}
+	}
+	return "", 0, ""
+}
+
+// mentionAt returns the member of the room mentioned at the start of s, by
+// user ID, localpart or display name, preferring the longest match.
+func (r *Room) mentionAt(s string) (userID, name string, n int) {
+	r.Users.rwm.RLock()
+	users := append([]*User{}, r.Users.U...)
+	r.Users.rwm.RUnlock()
+	for _, u := range users {
+		if u.Mem() != MemJoin && u.Mem() != MemInvite {
+			continue
+		}
+		id := u.ID()
+		candidates := []string{id}
+		if localpart, _, err := splitUserID(id); err == nil {
+			candidates = append(candidates, "@"+localpart)
+		}
+		if u.Name() != "" {
+			candidates = append(candidates, "@"+u.Name())
+		}
+		for _, cand := range candidates {
+			if len(cand) <= n || len(cand) > len(s) || isWordAt(s, len(cand)) ||
+				!strings.EqualFold(s[:len(cand)], cand) {
+				continue
+			}
+			userID, n = id, len(cand)
+			name = u.Name()
+			if name == "" {
+				name = id
+			}
+		}
+	}
+	return userID, name, n
+}
+
+// plainPrefix and markdownPrefix start the messages sent without or with
+// Markdown, regardless of the PlainText config
+const (
+	plainPrefix    = "/plain "
+	markdownPrefix = "/md "
+)
+
+// IsCommand returns true if the text typed is a command rather than a
+// message.
+func IsCommand(body string) bool {
+	return strings.HasPrefix(body, "/") && !strings.HasPrefix(body, plainPrefix) &&
+		!strings.HasPrefix(body, markdownPrefix)
+}
+
+type reqText struct {
+	MsgType       string             `json:"msgtype"`
+	Body          string             `json:"body"`
+	Format        string             `json:"format,omitempty"`
+	FormattedBody string             `json:"formatted_body,omitempty"`
+	RelatesTo     *reqThreadRelation `json:"m.relates_to,omitempty"`
+}
+
+// textContent returns the content of a text message to the room, with the
+// HTML of its Markdown if it has any formatting.
+func (c *Client) textContent(r *Room, body string) *reqText {
+	markdown := !c.cfg.PlainText
+	if strings.HasPrefix(body, plainPrefix) {
+		body, markdown = strings.TrimPrefix(body, plainPrefix), false
+	} else if strings.HasPrefix(body, markdownPrefix) {
+		body, markdown = strings.TrimPrefix(body, markdownPrefix), true
+	}
+	content := &reqText{MsgType: "m.text", Body: body}
+	if !markdown {
+		return content
+	}
+	var mention mentionFunc
+	if r != nil {
+		mention = r.mentionAt
+	}
+	formatted := markdownHTML(body, mention)
+	if formatted != html.EscapeString(body) {
+		content.Format = "org.matrix.custom.html"
+		content.FormattedBody = formatted
+	}
+	return content
+}
@@ -0,0 +1,82 @@
+package morpheus
+
+import (
+	"strings"
+	"testing"
+)
+
+// testMention mentions @alice, a member named Alice.
+func testMention(s string) (userID, name string, n int) {
+	if strings.HasPrefix(s, "@alice") {
+		return "@alice:example.org", "Alice", len("@alice")
+	}
+	return "", "", 0
+}
+
+func TestMdInline(t *testing.T) {
+	tests := []struct {
+		md   string
+		html string
+	}{
+		{"plain", "plain"},
+		{"**bold** *it* _it_ ~~del~~", "<strong>bold</strong> <em>it</em> <em>it</em> <del>del</del>"},
+		{"***both***", "<strong><em>both</em></strong>"},
+		{"***a** b*", "<em><strong>a</strong> b</em>"},
+		{"*a **b** c*", "<em>a <strong>b</strong> c</em>"},
+		{"**a *b* c**", "<strong>a <em>b</em> c</strong>"},
+		{"**unclosed", "**unclosed"},
+		{"snake_case_name", "snake_case_name"},
+		{"2 * 3 * 4", "2 * 3 * 4"},
+		{`\*not\*`, "*not*"},
+		{"a <b> & c", "a &lt;b&gt; &amp; c"},
+		{"`a < b`", "<code>a &lt; b</code>"},
+		{"`` a ` b ``", "<code>a ` b</code>"},
+		{"`unclosed", "`unclosed"},
+		{"[site](https://example.org)", `<a href="https://example.org">site</a>`},
+		{"<https://example.org>", `<a href="https://example.org">https://example.org</a>`},
+		{"see https://example.org/x.", `see <a href="https://example.org/x">https://example.org/x</a>.`},
+		{"hi @alice", `hi <a href="https://matrix.to/#/@alice:example.org">Alice</a>`},
+		{"bob@alice", "bob@alice"},
+		{"@bob", "@bob"},
+	}
+	for _, test := range tests {
+		if html := mdInline(test.md, testMention); html != test.html {
+			t.Errorf("mdInline(%q) = %q, want %q", test.md, html, test.html)
+		}
+	}
+}
+
+func TestMarkdownHTML(t *testing.T) {
+	tests := []struct {
+		md   string
+		html string
+	}{
+		{"", ""},
+		{"plain text", "plain text"},
+		{"one\ntwo", "one<br>two"},
+		{"one\n\ntwo", "<p>one</p><p>two</p>"},
+		{"# Title\ntext", "<h1>Title</h1><p>text</p>"},
+		{"## Sub ##", "<h2>Sub</h2>"},
+		{"#nospace", "#nospace"},
+		{"```go\nif x < 1 {\n}\n```", "<pre><code class=\"language-go\">if x &lt; 1 {\n}\n</code></pre>"},
+		{"```\nunclosed", "<pre><code>unclosed\n</code></pre>"},
+		{"> quote\n> more\n\nafter", "<blockquote><p>quote<br>more</p></blockquote><p>after</p>"},
+		{"- a\n- b\n  - c", "<ul><li>a</li><li>b<ul><li>c</li></ul></li></ul>"},
+		{"* a\n\n* b", "<ul><li>a</li><li>b</li></ul>"},
+		{"3. a\n4. b", `<ol start="3"><li>a</li><li>b</li></ol>`},
+		{"1) a", "<ol><li>a</li></ol>"},
+		{"---", "<hr>"},
+		{"text\n---", "<h2>text</h2>"},
+		{"Title\n===\ntext", "<h1>Title</h1><p>text</p>"},
+		{"one\n*two*\n--", "<h2>one <em>two</em></h2>"},
+		{"text\n\n---", "<p>text</p><hr>"},
+		{"text\n***", "<p>text</p><hr>"},
+		{"===", "==="},
+		{"- a\n---", "<ul><li>a</li></ul><hr>"},
+	}
+	for _, test := range tests {
+		if html := markdownHTML(test.md, testMention); html != test.html {
+			t.Errorf("markdownHTML(%q) = %q, want %q", test.md, html, test.html)
+		}
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"github.com/matrix-org/gomatrix"
 	"sort"
 	"strconv"
+	"strings"
 	"sync"
 	//sync "github.com/sasha-s/go-deadlock"
 	"time"
@@ -38,16 +39,32 @@ type Event struct {
 	Sender   string
 	StateKey *string
 	Content  interface{}
+	// SenderName is the display name of the sender when the event was
+	// sent, empty if it had none
+	SenderName string
+	// ThreadRoot is the ID of the root event of the thread of the event, if
+	// it's in one
+	ThreadRoot string
+	// PushActions are set by our push rules
+	PushActions
+	// prevContent is the content replaced by a state event
+	prevContent map[string]interface{}
 }
 
 type Events struct {
 	l   *list.List
 	len int
-	rwm *sync.RWMutex
+	// ids are the elements of the events in l by event ID
+	ids map[string]*list.Element
+	// cutLinks are the RoomLinks dropped with the newest events, in order:
+	// the events at the back belong to the room of the first one
+	cutLinks []*RoomLink
+	rwm      *sync.RWMutex
 }
 
 func NewEvents() (evs Events) {
 	evs.l = list.New()
+	evs.ids = make(map[string]*list.Element)
 	evs.rwm = &sync.RWMutex{}
 	return evs
 }
@@ -66,14 +83,14 @@ func (evs *Events) PushFront(e interface{}) {
 
 func (evs *Events) PushBackEvent(e *Event) {
 	evs.rwm.Lock()
-	evs.l.PushBack(e)
+	evs.ids[e.ID] = evs.l.PushBack(e)
 	evs.len++
 	evs.rwm.Unlock()
 }
 
 func (evs *Events) PushFrontEvent(e *Event) {
 	evs.rwm.Lock()
-	evs.l.PushFront(e)
+	evs.ids[e.ID] = evs.l.PushFront(e)
 	evs.len++
 	evs.rwm.Unlock()
 }
@@ -109,20 +126,23 @@ func (evs *Events) clearFront(n int) bool {
 	remove := false
 	e := evs.l.Back()
 	for ; e != nil; e = e.Prev() {
-		if _, ok := e.Value.(Token); ok {
+		switch e.Value.(type) {
+		case Token:
 			if cnt >= n {
 				remove = true
-				break
 			}
-		} else {
+		case *Event:
 			cnt++
 		}
+		if remove {
+			break
+		}
 	}
 	if remove {
 		prev := e.Prev()
 		for prev != nil {
 			prevPrev := prev.Prev()
-			evs.l.Remove(prev)
+			evs.remove(prev)
 			prev = prevPrev
 		}
 	}
@@ -167,7 +187,9 @@ const (
 
 type TextMessage struct {
 	Body string
-	Type MsgTxtType
+	// FormattedBody is the HTML version of Body, if the message has one
+	FormattedBody string
+	Type          MsgTxtType
 }
 
 type StateRoomName struct {
@@ -186,6 +208,12 @@ type StateRoomJoinRules struct {
 	IsPublic bool
 }
 
+type StateRoomPowerLevels struct {
+	Users         map[string]int
+	UsersDefault  int
+	Notifications map[string]int
+}
+
 type StateRoomMember struct {
 	Name       string
 	Membership Membership
@@ -224,6 +252,13 @@ const (
 	RoomStateDispName   RoomState = iota
 	RoomStateTopic      RoomState = iota
 	RoomStateMembership RoomState = iota
+	RoomStateUnread     RoomState = iota
+	// RoomStateEvents means that events were dropped from the room
+	RoomStateEvents RoomState = iota
+	// RoomStateTombstone means that the room has been upgraded
+	RoomStateTombstone RoomState = iota
+	// RoomStateSpace means that the children or parents of the room changed
+	RoomStateSpace RoomState = iota
 )
 
 type User struct {
@@ -289,7 +324,7 @@ func (u *User) updateDispName(r *Room) bool {
 	} else {
 		u.dispName = u.name
 	}
-	return u.dispName == prevDispName
+	return u.dispName != prevDispName
 }
 
 // r.Users.{delByName,addByName} Locks Users
@@ -317,11 +352,12 @@ func (u *User) setMembership(mem Membership, newUser bool, r *Room) {
 	if u.mem == mem && !newUser {
 		return
 	}
+	memOld := u.mem
 	u.mem = mem
 	if newUser {
-		r.Users.MemCountDelta(u.mem, mem, 0, 1)
+		r.Users.MemCountDelta(memOld, mem, 0, 1)
 	} else {
-		r.Users.MemCountDelta(u.mem, mem, -1, 1)
+		r.Users.MemCountDelta(memOld, mem, -1, 1)
 	}
 }
 
@@ -404,6 +440,8 @@ func (us *Users) AddUpdate(id, name string, power int, mem Membership) (*User, e
 	}
 
 	u.rwm.Lock()
+	// The display name of the room depends on the membership
+	memChanged := newUser || u.mem != mem
 	u.setName(name, us.Room)
 	u.setPower(power, us.Room)
 	u.setMembership(mem, newUser, us.Room)
@@ -417,21 +455,27 @@ func (us *Users) AddUpdate(id, name string, power int, mem Membership) (*User, e
 		us.U = append(us.U, u)
 		us.byID[u.id] = u
 		us.rwm.Unlock()
-		us.Room.Rooms.call.AddUser(us.Room, u)
+		us.Room.Rooms.publish(BusEvent{Type: BusAddUser, Room: us.Room, User: u})
 	}
 
 	if updateDispName {
+		updated := make([]*User, 0)
 		us.rwm.RLock()
 		// TODO: Improvement: only trigger the updateDispName to users in us.byName[oldname] and us.byName[newname]
 		for _, u1 := range us.U {
 			u1.rwm.Lock()
 			if u1.updateDispName(us.Room) {
-				defer func() { go us.Room.Rooms.call.UpdateUser(us.Room, u1) }()
+				updated = append(updated, u1)
 			}
 			u1.rwm.Unlock()
 		}
 		us.rwm.RUnlock()
-		defer us.Room.updateDispName(*us.Room.myUserID)
+		for _, u1 := range updated {
+			us.Room.Rooms.publish(BusEvent{Type: BusUpdateUser, Room: us.Room, User: u1})
+		}
+	}
+	if updateDispName || memChanged {
+		us.Room.updateDispName(*us.Room.myUserID)
 	}
 
 	return u, nil
@@ -466,7 +510,7 @@ func (us *Users) AddUpdate(id, name string, power int, mem Membership) (*User, e
 //func (us *Users) AddBatchFinish() {
 //	us.rwm.RLock()
 //	for _, u := range us.U {
-//		us.Room.Rooms.call.AddUser(us.Room, u)
+//		us.Room.Rooms.publish(BusEvent{Type: BusAddUser, Room: us.Room, User: u})
 //		u.updateDispName(us.Room)
 //	}
 //	us.rwm.RUnlock()
@@ -478,7 +522,7 @@ func (us *Users) Del(u *User) {
 	// TODO
 	// TODO: What if there are two users with the same name?
 	us.rwm.Unlock()
-	go us.Room.Rooms.call.DelUser(us.Room, u)
+	us.Room.Rooms.publish(BusEvent{Type: BusDelUser, Room: us.Room, User: u})
 }
 
 func (us *Users) SetUserName(u *User, name string) {
@@ -486,7 +530,7 @@ func (us *Users) SetUserName(u *User, name string) {
 	// TODO
 	// TODO: What if there are two users with the same name?
 	us.rwm.Unlock()
-	go us.Room.Rooms.call.UpdateUser(us.Room, u)
+	us.Room.Rooms.publish(BusEvent{Type: BusUpdateUser, Room: us.Room, User: u})
 }
 
 type ExpBackoff struct {
@@ -531,8 +575,27 @@ type Room struct {
 	tokensLen   int
 	HasFirstMsg bool
 	HasLastMsg  bool
+	// follow is set when the UI shows the end of the timeline
+	follow      bool
+	timelineMux sync.Mutex
 	myUserID    *string
 	mem         Membership
+	powerLevels StateRoomPowerLevels
+	// state is the current state, with the raw content of the events
+	state roomState
+	// The fields of the room summary, used for the display name
+	summaryHeroes    []string
+	joinedCount      int
+	invitedCount     int
+	hasSummaryCounts bool
+	// inviter is the sender of our invite
+	inviter string
+	// threads are indexed by the ID of their root event
+	threads map[string]*threadState
+	// Unread counts from the homeserver
+	notifCount     int
+	highlightCount int
+	readEventID    string
 
 	Rooms      *Rooms
 	rwm        sync.RWMutex
@@ -548,7 +611,11 @@ func NewRoom(rs *Rooms, id string, mem Membership, name, canonAlias, topic strin
 	r.canonAlias = canonAlias
 	r.topic = topic
 	r.Users = newUsers(r)
+	r.state = make(roomState)
+	r.threads = make(map[string]*threadState)
 	r.Events = NewEvents()
+	r.HasLastMsg = true
+	r.follow = true
 	r.Rooms = rs
 	r.ExpBackoff = NewExpBackoff(30000)
 	return r
@@ -594,19 +661,139 @@ func (r *Room) Mem() Membership {
 	return r.mem
 }
 
+// Unread returns the number of unread messages that notify and how many of
+// them are highlights.
+func (r *Room) Unread() (notif, highlight int) {
+	r.rwm.RLock()
+	defer r.rwm.RUnlock()
+	return r.notifCount, r.highlightCount
+}
+
+// LastTs returns the timestamp of the last event of the room, or 0.
+func (r *Room) LastTs() int64 {
+	if e := r.Events.LastEvent(); e != nil {
+		return e.Ts
+	}
+	return 0
+}
+
+func (r *Room) setUnread(notif, highlight int) {
+	r.rwm.Lock()
+	if r.notifCount == notif && r.highlightCount == highlight {
+		r.rwm.Unlock()
+		return
+	}
+	r.notifCount = notif
+	r.highlightCount = highlight
+	r.rwm.Unlock()
+	r.Rooms.publish(BusEvent{Type: BusUpdateRoom, Room: r, State: RoomStateUnread})
+}
+
+// setRead resets the unread counts after reading up to eventID.  It returns
+// false if eventID was already read.
+func (r *Room) setRead(eventID string) bool {
+	r.rwm.Lock()
+	if r.readEventID == eventID {
+		r.rwm.Unlock()
+		return false
+	}
+	r.readEventID = eventID
+	r.rwm.Unlock()
+	r.setUnread(0, 0)
+	return true
+}
+
+// Account returns the user ID of the account the room belongs to.
+func (r *Room) Account() string {
+	return *r.myUserID
+}
+
 func (r *Room) String() string {
 	return r.DispName()
 }
 
+// Maximum number of heroes in the display name of a room
+const maxHeroes = 5
+
+// heroName returns the name of a member for the display name of the room.
+// The members may be lazy loaded, so if we don't have the member its member
+// event is used.
+func (r *Room) heroName(userID string) string {
+	if u := r.Users.ByID(userID); u != nil {
+		return u.String()
+	}
+	if name := r.state.name(userID); name != "" {
+		return name
+	}
+	return userID
+}
+
+// heroes returns the users that name the room and the number of joined and
+// invited members, from the room summary if the homeserver sent it.  Without
+// members other than us, the heroes are the ones that left.
+func (r *Room) heroes(myUserID string) ([]string, int) {
+	r.Users.rwm.RLock()
+	count := r.Users.MemCount[MemJoin] + r.Users.MemCount[MemInvite]
+	users := append([]*User{}, r.Users.U...)
+	r.Users.rwm.RUnlock()
+	if r.hasSummaryCounts {
+		count = r.joinedCount + r.invitedCount
+	}
+	if r.summaryHeroes != nil {
+		return r.summaryHeroes, count
+	}
+	var members, left []string
+	for _, u := range users {
+		if u.ID() == myUserID {
+			continue
+		}
+		switch u.Mem() {
+		case MemJoin, MemInvite:
+			members = append(members, u.ID())
+		case MemLeave, MemBan:
+			left = append(left, u.ID())
+		}
+	}
+	heroes := members
+	if len(heroes) == 0 {
+		heroes = left
+	}
+	sort.Strings(heroes)
+	if len(heroes) > maxHeroes {
+		heroes = heroes[:maxHeroes]
+	}
+	return heroes, count
+}
+
+// joinNames lists names like "A, B and C", or "A, B and 3 others" if there
+// are others not named.
+func joinNames(names []string, others int) string {
+	switch {
+	case others == 1:
+		return fmt.Sprintf("%s and 1 other", strings.Join(names, ", "))
+	case others > 1:
+		return fmt.Sprintf("%s and %d others", strings.Join(names, ", "), others)
+	case len(names) == 1:
+		return names[0]
+	default:
+		return fmt.Sprintf("%s and %s", strings.Join(names[:len(names)-1], ", "),
+			names[len(names)-1])
+	}
+}
+
+// updateDispName calculates the display name of the room as the spec says:
+// the name, the canonical alias, or the names of the heroes.
 func (r *Room) updateDispName(myUserID string) {
-	r.rwm.Lock()
-	defer r.rwm.Unlock()
-	prevDispName := r.dispName
+	var prevDispName string
+	// Publish after the lock is released
 	defer func() {
-		if r.dispName != prevDispName {
-			go r.Rooms.call.UpdateRoom(r, RoomStateDispName)
+		if r.DispName() != prevDispName {
+			r.Rooms.publish(BusEvent{Type: BusUpdateRoom, Room: r, State: RoomStateDispName})
 		}
 	}()
+	r.rwm.Lock()
+	defer r.rwm.Unlock()
+	prevDispName = r.dispName
 	if r.name != "" {
 		r.dispName = r.name
 		return
@@ -615,29 +802,42 @@ func (r *Room) updateDispName(myUserID string) {
 		r.dispName = r.canonAlias
 		return
 	}
-	roomUserIDs := make([]string, 0)
-	for _, u := range r.Users.U {
-		if u.id == myUserID {
-			continue
+	heroes, count := r.heroes(myUserID)
+	names := make([]string, 0, len(heroes))
+	for _, userID := range heroes {
+		names = append(names, r.heroName(userID))
+	}
+	switch {
+	case count > 1 && len(names) != 0:
+		others := count - 1 - len(names)
+		if others < 0 {
+			others = 0
 		}
-		roomUserIDs = append(roomUserIDs, u.id)
+		r.dispName = joinNames(names, others)
+	case len(names) != 0:
+		r.dispName = fmt.Sprintf("Empty room (was %s)", joinNames(names, 0))
+	default:
+		r.dispName = "Empty room"
 	}
-	sort.Strings(roomUserIDs)
-	if len(roomUserIDs) == 1 {
-		r.dispName = r.Users.ByID(roomUserIDs[0]).String()
-		return
+}
+
+// setSummary updates the summary of the room sent by the sync.  Its fields
+// are only sent when they change.
+func (r *Room) setSummary(heroes []string, joined, invited *int) {
+	r.rwm.Lock()
+	if heroes != nil {
+		r.summaryHeroes = heroes
 	}
-	if len(roomUserIDs) == 2 {
-		r.dispName = fmt.Sprintf("%s and %s", r.Users.ByID(roomUserIDs[0]),
-			r.Users.ByID(roomUserIDs[1]))
-		return
+	if joined != nil {
+		r.joinedCount = *joined
+		r.hasSummaryCounts = true
 	}
-	if len(roomUserIDs) > 2 {
-		r.dispName = fmt.Sprintf("%s and %d others", r.Users.ByID(roomUserIDs[0]),
-			len(roomUserIDs)-1)
-		return
+	if invited != nil {
+		r.invitedCount = *invited
+		r.hasSummaryCounts = true
 	}
-	r.dispName = "Emtpy room"
+	r.rwm.Unlock()
+	r.updateDispName(*r.myUserID)
 }
 
 func parseMessage(msgType string, content map[string]interface{}) (interface{}, error) {
@@ -665,6 +865,9 @@ func parseMessage(msgType string, content map[string]interface{}) (interface{},
 				msgType, content)
 		}
 		mc.Body = body
+		if format, _ := content["format"].(string); format == "org.matrix.custom.html" {
+			mc.FormattedBody, _ = content["formatted_body"].(string)
+		}
 		mc.Type = msgTxtType
 		cnt = mc
 	}
@@ -723,7 +926,25 @@ func parseEvent(evType string, stateKey *string,
 				evType, content)
 		}
 		cnt = StateRoomMember{Name: name, Membership: membership}
-	//case "m.room.power_levels":
+	case "m.room.power_levels":
+		pl := StateRoomPowerLevels{Users: make(map[string]int),
+			Notifications: make(map[string]int)}
+		users, _ := content["users"].(map[string]interface{})
+		for userID, power := range users {
+			if power, ok := power.(float64); ok {
+				pl.Users[userID] = int(power)
+			}
+		}
+		if power, ok := content["users_default"].(float64); ok {
+			pl.UsersDefault = int(power)
+		}
+		notifications, _ := content["notifications"].(map[string]interface{})
+		for key, power := range notifications {
+			if power, ok := power.(float64); ok {
+				pl.Notifications[key] = int(power)
+			}
+		}
+		cnt = pl
 	//case "m.room.redaction":
 	case "m.room.message": // Stateless
 		msgType, ok := content["msgtype"].(string)
@@ -775,14 +996,21 @@ func (r *Room) SetTopic(topic string) {
 	r.rwm.Lock()
 	r.topic = topic
 	r.rwm.Unlock()
-	go r.Rooms.call.UpdateRoom(r, RoomStateTopic)
+	r.Rooms.publish(BusEvent{Type: BusUpdateRoom, Room: r, State: RoomStateTopic})
 }
 
 func (r *Room) SetMembership(mem Membership) {
 	r.rwm.Lock()
+	if r.mem == mem {
+		r.rwm.Unlock()
+		return
+	}
 	r.mem = mem
 	r.rwm.Unlock()
-	go r.Rooms.call.UpdateRoom(r, RoomStateMembership)
+	r.Rooms.publish(BusEvent{Type: BusUpdateRoom, Room: r, State: RoomStateMembership})
+	if mem == MemLeave {
+		r.Rooms.hideLeft(r)
+	}
 }
 
 func (r *Room) PushToken(token string) {
@@ -802,32 +1030,69 @@ func (r *Room) PushMessage(msgType, id string, ts int64, userID string,
 	if err != nil {
 		return err
 	}
-	e := &Event{"m.room.message", id, ts, userID, nil, Message{msgType, cnt}}
+	e := &Event{Type: "m.room.message", ID: id, Ts: ts, Sender: userID,
+		Content: Message{msgType, cnt}}
+	e.PushActions = r.pushActions(&pushEvent{Type: e.Type, Sender: userID, Content: content})
 	r.Events.PushBackEvent(e)
+	r.Rooms.client.indexEvent(r, e)
 	//r.msgsLen++
-	go r.Rooms.call.ArrvMessage(r, e)
+	r.Rooms.publish(BusEvent{Type: BusMessage, Room: r, Event: e})
 	return nil
 }
 
 func (r *Room) PushTextMessage(txtType MsgTxtType, id string, ts int64, userID, body string) error {
-	e := &Event{"m.room.message", id, ts, userID, nil,
-		Message{"m.text", TextMessage{body, txtType}}}
+	e := &Event{Type: "m.room.message", ID: id, Ts: ts, Sender: userID,
+		Content: Message{"m.text", TextMessage{Body: body, Type: txtType}}}
 	r.Events.PushBackEvent(e)
 	//r.msgsLen++
-	go r.Rooms.call.ArrvMessage(r, e)
+	r.Rooms.publish(BusEvent{Type: BusMessage, Room: r, Event: e})
 	return nil
 }
 
-func (r *Room) PushEvent(ev *gomatrix.Event) error {
+// newEvent parses a gomatrix.Event that is not part of a room timeline.
+func newEvent(ev *gomatrix.Event) (*Event, error) {
 	cnt, err := parseEvent(ev.Type, ev.StateKey, ev.Content)
+	if err != nil {
+		return nil, err
+	}
+	return &Event{Type: ev.Type, ID: ev.ID, Ts: int64(ev.Timestamp), Sender: ev.Sender,
+		StateKey: ev.StateKey, Content: cnt, ThreadRoot: threadRoot(ev.Content),
+		prevContent: prevContent(ev)}, nil
+}
+
+// newEvents parses the events that are supported and skips the rest.
+func newEvents(evs []gomatrix.Event) []*Event {
+	es := make([]*Event, 0, len(evs))
+	for i := range evs {
+		if e, err := newEvent(&evs[i]); err == nil {
+			es = append(es, e)
+		}
+	}
+	return es
+}
+
+func (r *Room) PushEvent(ev *gomatrix.Event) error {
+	e, err := r.storeEvent(r.ID(), ev)
 	if err != nil {
 		return err
 	}
-	e := &Event{ev.Type, ev.ID, int64(ev.Timestamp), ev.Sender, ev.StateKey, cnt}
+	r.Rooms.publish(BusEvent{Type: BusMessage, Room: r, Event: e})
+	return nil
+}
+
+// storeEvent appends a timeline event of roomID, the room or a predecessor,
+// without publishing it, for the events that were already notified when they
+// arrived.
+func (r *Room) storeEvent(roomID string, ev *gomatrix.Event) (*Event, error) {
+	e, err := r.timelineEvent(ev)
+	if err != nil {
+		return nil, err
+	}
+	e.SenderName = r.senderName(ev.Sender)
 	r.Events.PushBackEvent(e)
+	r.Rooms.client.indexRoomEvent(roomID, e)
 	//r.msgsLen++
-	go r.Rooms.call.ArrvMessage(r, e)
-	return nil
+	return e, nil
 }
 
 func (r *Room) PushFrontMessage(msgType, id string, ts int64, userID string,
@@ -837,12 +1102,53 @@ func (r *Room) PushFrontMessage(msgType, id string, ts int64, userID string,
 	if err != nil {
 		return err
 	}
-	e := &Event{"m.room.message", id, ts, userID, nil, Message{msgType, cnt}}
+	e := &Event{Type: "m.room.message", ID: id, Ts: ts, Sender: userID,
+		Content: Message{msgType, cnt}}
+	e.PushActions = r.pushActions(&pushEvent{Type: e.Type, Sender: userID, Content: content})
 	r.Events.PushFrontEvent(e)
+	r.Rooms.client.indexEvent(r, e)
 	//r.msgsLen++
 	return nil
 }
 
+// isMention returns true if the body of the event contains our user ID or
+// display name.
+func (r *Room) isMention(pe *pushEvent) bool {
+	body, ok := pe.Content["body"].(string)
+	if !ok {
+		return false
+	}
+	myUserID := *r.myUserID
+	if strings.Contains(strings.ToLower(body), strings.ToLower(myUserID)) {
+		return true
+	}
+	if u := r.Users.ByID(myUserID); u != nil && u.Name() != "" {
+		return containsWord(body, u.Name())
+	}
+	return false
+}
+
+// senderPower returns the power level of a user in the room.
+func (r *Room) senderPower(userID string) int {
+	r.rwm.RLock()
+	defer r.rwm.RUnlock()
+	if power, ok := r.powerLevels.Users[userID]; ok {
+		return power
+	}
+	return r.powerLevels.UsersDefault
+}
+
+// notificationPower returns the power level required to send the given kind
+// of notification, like "room" for @room.
+func (r *Room) notificationPower(key string) int {
+	r.rwm.RLock()
+	defer r.rwm.RUnlock()
+	if power, ok := r.powerLevels.Notifications[key]; ok {
+		return power
+	}
+	return 50
+}
+
 func (r *Room) ClearFrontEvents(n int) {
 	if r.Events.clearFront(n) {
 		r.rwm.Lock()
@@ -852,6 +1158,13 @@ func (r *Room) ClearFrontEvents(n int) {
 }
 
 func (r *Room) updateState(ev *gomatrix.Event) error {
+	r.setState(ev)
+	switch ev.Type {
+	case "m.room.tombstone":
+		r.Rooms.publish(BusEvent{Type: BusUpdateRoom, Room: r, State: RoomStateTombstone})
+	case "m.space.child", "m.space.parent":
+		r.Rooms.publish(BusEvent{Type: BusUpdateRoom, Room: r, State: RoomStateSpace})
+	}
 	cnt, err := parseEvent(ev.Type, ev.StateKey, ev.Content)
 	if err != nil {
 		return err
@@ -863,13 +1176,17 @@ func (r *Room) updateState(ev *gomatrix.Event) error {
 		r.SetTopic(cnt.Topic)
 	case StateRoomCanonAlias:
 		r.SetCanonAlias(cnt.Alias)
+	case StateRoomPowerLevels:
+		r.rwm.Lock()
+		r.powerLevels = cnt
+		r.rwm.Unlock()
 	case StateRoomMember:
 		if ev.StateKey == nil || *ev.StateKey == "" {
 			return fmt.Errorf("m.room.member doesn't have a state key")
 		}
 		// FIXME: Don't reset user's power to 0
 		r.Users.AddUpdate(*ev.StateKey, cnt.Name, 0, cnt.Membership)
-		if cnt.Membership == MemLeave && ev.StateKey == r.myUserID {
+		if cnt.Membership == MemLeave && *ev.StateKey == *r.myUserID {
 			r.SetMembership(MemLeave)
 		}
 	default:
@@ -878,20 +1195,6 @@ func (r *Room) updateState(ev *gomatrix.Event) error {
 	return nil
 }
 
-type Callbacks struct {
-	AddUser    func(r *Room, u *User)
-	DelUser    func(r *Room, u *User)
-	UpdateUser func(r *Room, u *User)
-
-	AddRoom    func(r *Room)
-	DelRoom    func(r *Room)
-	UpdateRoom func(r *Room, state RoomState)
-
-	ArrvMessage func(r *Room, e *Event)
-
-	Cmd func(r *Room, args []string)
-}
-
 type Rooms struct {
 	R    []*Room
 	byID map[string]*Room
@@ -903,9 +1206,23 @@ type Rooms struct {
 	//ConsoleUserDisplayName string
 	consoleUserID string
 
-	rwm  *sync.RWMutex
-	call Callbacks
-	UI   interface{}
+	// hideTimers remove the left rooms after HideLeftRoomsAfter
+	hideTimers map[string]*time.Timer
+
+	rwm    *sync.RWMutex
+	bus    *Bus
+	client *Client
+	UI     interface{}
+}
+
+func (rs *Rooms) publish(ev BusEvent) {
+	ev.Client = rs.client
+	rs.bus.publish(ev)
+}
+
+// Client returns the account the rooms belong to.
+func (rs *Rooms) Client() *Client {
+	return rs.client
 }
 
 func (rs *Rooms) ConsoleRoom() *Room {
@@ -932,12 +1249,13 @@ func (rs *Rooms) ByName(name string) []*Room {
 	return rs.byName[name]
 }
 
-func NewRooms(call Callbacks) (rs Rooms) {
+func NewRooms(bus *Bus) (rs Rooms) {
 	rs.R = make([]*Room, 0)
 	rs.byID = make(map[string]*Room)
 	rs.byName = make(map[string][]*Room)
+	rs.hideTimers = make(map[string]*time.Timer)
 	rs.rwm = &sync.RWMutex{}
-	rs.call = call
+	rs.bus = bus
 	return rs
 }
 
@@ -946,8 +1264,8 @@ func (rs *Rooms) AddUpdate(myUserID *string, roomID string, mem Membership) *Roo
 	rs.rwm.Lock()
 	r, ok := rs.byID[roomID]
 	if ok {
-		r.SetMembership(mem)
 		rs.rwm.Unlock()
+		r.SetMembership(mem)
 		//return r, fmt.Errorf("Room %v already exists", roomID)
 		return r
 	}
@@ -961,12 +1279,15 @@ func (rs *Rooms) AddUpdate(myUserID *string, roomID string, mem Membership) *Roo
 	//}
 	rs.rwm.Unlock()
 
-	rs.call.AddRoom(r)
-	// FIXME: updateDispName will call rs.call.UpdateRoom because the
-	// displayname will be updated, but we also call rs.call.UpdateRoom
-	// here unconditionally, so we end up calling rs.call.UpdateRoom twice
+	rs.publish(BusEvent{Type: BusAddRoom, Room: r})
+	// FIXME: updateDispName will publish a BusUpdateRoom because the
+	// displayname will be updated, but we also publish a BusUpdateRoom
+	// here unconditionally, so we end up publishing it twice
 	r.updateDispName(*r.myUserID)
-	go rs.call.UpdateRoom(r, RoomStateAll)
+	rs.publish(BusEvent{Type: BusUpdateRoom, Room: r, State: RoomStateAll})
+	if mem == MemLeave {
+		rs.hideLeft(r)
+	}
 	//return r, nil
 	return r
 }
@@ -991,7 +1312,7 @@ func (rs *Rooms) Del(roomID string) (*Room, error) {
 	}
 	rs.R = newR
 	rs.rwm.Unlock()
-	go rs.call.DelRoom(r)
+	rs.publish(BusEvent{Type: BusDelRoom, Room: r})
 	return r, nil
 }
 
@@ -1000,7 +1321,7 @@ func (rs *Rooms) SetRoomName(r *Room, name string) {
 	// TODO
 	// TODO: What if there are two rooms with the same name?
 	rs.rwm.Unlock()
-	go rs.call.UpdateRoom(r, RoomStateName)
+	rs.publish(BusEvent{Type: BusUpdateRoom, Room: r, State: RoomStateName})
 }
 
 func (rs *Rooms) AddConsoleMessage(msgType string, content map[string]interface{}) error {
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"fmt"
 	"github.com/matrix-org/gomatrix"
+	"net/url"
 	"sync"
 	"time"
 	//"github.com/pkg/profile"
@@ -17,6 +18,29 @@ type Config struct {
 	DisplayName string
 	Password    string
 	Homeserver  string
+	// DeviceID is reused across logins to avoid leaving devices behind
+	DeviceID          string
+	DeviceDisplayName string
+	// CryptoDB is the path of the gomatrixolm crypto DB
+	CryptoDB string
+	// IndexDB is the path of the local search index, empty to disable it
+	IndexDB string
+	// LogDir is the directory of the room logs, empty to disable them
+	LogDir string
+	// LogFormat is the text/template of the log lines, see LogLine
+	LogFormat string
+	// MaxRoomEvents is the number of events kept in memory per room
+	MaxRoomEvents int
+	// FillGaps fetches the events missed by limited syncs in the background
+	FillGaps bool
+	// AutoAccept are the invites accepted without asking
+	AutoAccept AutoAcceptConfig
+	// HideLeftRoomsAfter is the number of seconds after which the left
+	// rooms are removed from the room list, 0 to keep them
+	HideLeftRoomsAfter int
+	// PlainText sends the messages as typed, without converting their
+	// Markdown to HTML
+	PlainText bool
 }
 
 type GenMap map[string]interface{}
@@ -46,15 +70,14 @@ func appendRoomEvents(r *Room, events []gomatrix.Event) {
 	}
 }
 
-func prependRoomEvents(r *Room, events []gomatrix.Event) uint {
+// prependRoomEvents adds the events of roomID, the room or a predecessor,
+// fetched backwards to the front of the room, with the sender names they had.
+func prependRoomEvents(r *Room, roomID string, events []gomatrix.Event) uint {
 	count := uint(0)
-	for _, ev := range events {
-		if msgType, ok := ev.MessageType(); ok {
-			if err := r.PushFrontMessage(msgType, ev.ID, int64(ev.Timestamp),
-				ev.Sender, ev.Content); err == nil {
-				count++
-			}
-		}
+	for _, e := range r.historicalEvents(r.stateBefore(nil), events) {
+		r.Events.PushFrontEvent(e)
+		r.Rooms.client.indexRoomEvent(roomID, e)
+		count++
 	}
 	return count
 }
@@ -73,20 +96,28 @@ func (c *Client) GetPrevEvents(r *Room, num uint) (uint, error) {
 	}
 	start := string(token)
 	end := ""
-	resMessages, err := c.cli.Messages(r.ID(), start, end, 'b', int(num))
+	// Past its creation, the history continues in the predecessor
+	roomID := r.frontRoomID()
+	var resMessages *gomatrix.RespMessages
+	err := c.withAuth(func() (err error) {
+		resMessages, err = c.cli.Messages(roomID, start, end, 'b', int(num))
+		return err
+	})
 	if err != nil {
 		r.ExpBackoff.Inc()
 		return 0, err
 	}
 	r.ExpBackoff.Reset()
-	if len(resMessages.Chunk) < int(num) {
+	if len(resMessages.Chunk) != 0 {
+		count += prependRoomEvents(r, roomID, resMessages.Chunk)
+		r.PushFrontToken(resMessages.End)
+	}
+	if len(resMessages.Chunk) < int(num) && !c.predecessorHistory(r, roomID) {
 		r.HasFirstMsg = true
-		if len(resMessages.Chunk) == 0 {
-			return 0, nil
-		}
 	}
-	count += prependRoomEvents(r, resMessages.Chunk)
-	r.PushFrontToken(resMessages.End)
+	if max := c.maxRoomEvents(); r.Events.Len() > max {
+		r.ClearBackEvents(max)
+	}
 	return count, nil
 }
 
@@ -123,6 +154,10 @@ func (c *Client) GetUserID() string {
 	return c.cfg.UserID
 }
 
+func (c *Client) GetDeviceID() string {
+	return c.cfg.DeviceID
+}
+
 func (c *Client) GetDisplayName() string {
 	return c.cfg.DisplayName
 }
@@ -166,18 +201,58 @@ func (c *Client) DebugBuf() *bytes.Buffer {
 type Client struct {
 	cli         *gomatrix.Client
 	cfg         Config
+	auth        auth
+	pushRules   pushRules
+	index       *Index
+	chatLog     *ChatLog
+	decrypter   Decrypter
 	Rs          Rooms
 	debugBuf    *bytes.Buffer
 	debugBufMux sync.Mutex
 	//minMsgs     uint
 
 	exit chan error
+	// done is closed by StopSync
+	done     chan struct{}
+	stopOnce sync.Once
 
 	//	sentMsgsChan chan MessageRoom
 }
 
-func NewClient(configName string, configPaths []string, call Callbacks) (*Client, error) {
-	//defer profile.Start().Stop()
+// check validates the account config and fills the fields that can be
+// derived from others.
+func (cfg *Config) check() error {
+	if cfg.Password == "" {
+		return fmt.Errorf("Key Password not found in config file")
+	}
+	if cfg.UserID != "" {
+		localpart, _, err := splitUserID(cfg.UserID)
+		if err != nil {
+			return err
+		}
+		if cfg.Username == "" {
+			cfg.Username = localpart
+		}
+	} else {
+		for key, value := range map[string]string{
+			"Username": cfg.Username, "Homeserver": cfg.Homeserver} {
+			if value == "" {
+				return fmt.Errorf("Key %s not found in config file", key)
+			}
+		}
+		// The real user ID is the one returned by the login, use the
+		// homeserver host as the server name until then.
+		hsURL, err := url.Parse(cfg.Homeserver)
+		if err != nil {
+			return fmt.Errorf("Invalid Homeserver %s: %v", cfg.Homeserver, err)
+		}
+		cfg.UserID = fmt.Sprintf("@%s:%s", cfg.Username, hsURL.Host)
+	}
+	cfg.Homeserver = strings.TrimSuffix(cfg.Homeserver, "/")
+	return nil
+}
+
+func readConfig(configName string, configPaths []string) error {
 	viper.SetConfigType("toml")
 	viper.SetConfigName(configName)
 	for _, configPath := range configPaths {
@@ -185,30 +260,40 @@ func NewClient(configName string, configPaths []string, call Callbacks) (*Client
 	}
 
 	if err := viper.ReadInConfig(); err != nil {
-		return nil, fmt.Errorf("Error config file: %s \n", err)
+		return fmt.Errorf("Error config file: %s \n", err)
 	}
+	return nil
+}
 
-	mustExistKeys := []string{"Username", "Password", "Homeserver"}
-	for _, key := range mustExistKeys {
-		if !viper.IsSet(key) {
-			return nil, fmt.Errorf("Key %s not found in config file", key)
-		}
-	}
+// NewClientConfig creates a Client for an account config that publishes its
+// events to bus.
+func NewClientConfig(cfg Config, bus *Bus) (*Client, error) {
 	var c Client
-	if err := viper.Unmarshal(&c.cfg); err != nil {
-		return nil, fmt.Errorf("Error decoding config file, %v", err)
+	c.cfg = cfg
+	if err := c.cfg.check(); err != nil {
+		return nil, err
 	}
 
-	c.cfg.UserID = fmt.Sprintf("@%s:%s", c.cfg.Username,
-		strings.TrimPrefix(c.cfg.Homeserver, "https://"))
-
 	c.debugBuf = bytes.NewBufferString("")
+	c.exit = make(chan error, 1)
+	c.done = make(chan struct{})
+	if c.cfg.IndexDB != "" {
+		index, err := OpenIndex(c.cfg.IndexDB, func(err error) {
+			c.DebugPrint("index:", err)
+		})
+		if err != nil {
+			return nil, fmt.Errorf("IndexDB %s: %v", c.cfg.IndexDB, err)
+		}
+		c.index = index
+	}
 	//c.minMsgs = 50
+	// The homeserver URL and the API prefix are set by discover()
 	cli, _ := gomatrix.NewClient(c.cfg.Homeserver, "", "")
 	cli.Prefix = "/_matrix/client/unstable"
 	c.cli = cli
 
-	c.Rs = NewRooms(call)
+	c.Rs = NewRooms(bus)
+	c.Rs.client = &c
 	c.Rs.consoleUserID = ConsoleUserID
 	r := c.AddRoom(ConsoleRoomID, "Console", "", "")
 	r.HasFirstMsg = true
@@ -222,9 +307,63 @@ func NewClient(configName string, configPaths []string, call Callbacks) (*Client
 	return &c, nil
 }
 
+// NewClient creates a Client for the account in the config file that
+// publishes its events to bus.
+func NewClient(configName string, configPaths []string, bus *Bus) (*Client, error) {
+	//defer profile.Start().Stop()
+	if err := readConfig(configName, configPaths); err != nil {
+		return nil, err
+	}
+	var cfg Config
+	if err := viper.Unmarshal(&cfg); err != nil {
+		return nil, fmt.Errorf("Error decoding config file, %v", err)
+	}
+	return NewClientConfig(cfg, bus)
+}
+
+// ReadConfigs reads the configs of the accounts in the config file.  The
+// accounts are listed as [[Accounts]] tables; a config file without them is
+// read as a single account.
+func ReadConfigs(configName string, configPaths []string) ([]Config, error) {
+	if err := readConfig(configName, configPaths); err != nil {
+		return nil, err
+	}
+	var cfgs []Config
+	if viper.IsSet("Accounts") {
+		if err := viper.UnmarshalKey("Accounts", &cfgs); err != nil {
+			return nil, fmt.Errorf("Error decoding config file, %v", err)
+		}
+	} else {
+		var cfg Config
+		if err := viper.Unmarshal(&cfg); err != nil {
+			return nil, fmt.Errorf("Error decoding config file, %v", err)
+		}
+		cfgs = append(cfgs, cfg)
+	}
+	return cfgs, nil
+}
+
+// NewClients creates a Client for every account in the config file.  All the
+// Clients publish their events to bus.
+func NewClients(configName string, configPaths []string, bus *Bus) ([]*Client, error) {
+	cfgs, err := ReadConfigs(configName, configPaths)
+	if err != nil {
+		return nil, err
+	}
+	clis := make([]*Client, 0, len(cfgs))
+	for i, cfg := range cfgs {
+		c, err := NewClientConfig(cfg, bus)
+		if err != nil {
+			return nil, fmt.Errorf("Account %d: %v", i, err)
+		}
+		clis = append(clis, c)
+	}
+	return clis, nil
+}
+
 // TODO: Handle error, maybe hold message if unsuccesful
 func (c *Client) SendText(roomID, body string) {
-	if roomID == c.Rs.ConsoleRoom().ID() || body[0] == '/' {
+	if roomID == c.Rs.ConsoleRoom().ID() || IsCommand(body) {
 		c.Rs.ConsoleRoom().PushTextMessage(MsgTxtTypeText, txnID(),
 			time.Now().Unix()*1000, c.cfg.UserID, body)
 		body = strings.TrimPrefix(body, "/")
@@ -232,9 +371,13 @@ func (c *Client) SendText(roomID, body string) {
 		if len(args) < 1 {
 			return
 		}
-		c.Rs.call.Cmd(c.Rs.ByID(roomID), args)
+		c.Rs.publish(BusEvent{Type: BusCmd, Room: c.Rs.ByID(roomID), Args: args})
 	} else {
-		_, err := c.cli.SendText(roomID, body)
+		content := c.textContent(c.Rs.ByID(roomID), body)
+		err := c.withAuth(func() error {
+			_, err := c.cli.SendMessageEvent(roomID, "m.room.message", content)
+			return err
+		})
 		if err != nil {
 			c.ConsolePrint(MsgTxtTypeNotice, "send:", err)
 			return
@@ -244,7 +387,10 @@ func (c *Client) SendText(roomID, body string) {
 
 // TODO: Return error
 func (c *Client) JoinRoom(roomIDorAlias string) {
-	_, err := c.cli.JoinRoom(roomIDorAlias, "", nil)
+	err := c.withAuth(func() error {
+		_, err := c.cli.JoinRoom(roomIDorAlias, "", nil)
+		return err
+	})
 	if err != nil {
 		c.ConsolePrint(MsgTxtTypeNotice, "join:", err)
 		return
@@ -254,39 +400,73 @@ func (c *Client) JoinRoom(roomIDorAlias string) {
 	// TODO: Notify UI of new joined room
 }
 
-// TODO: Return error
-func (c *Client) LeaveRoom(roomID string) {
-	_, err := c.cli.LeaveRoom(roomID)
-	if err != nil {
-		c.ConsolePrint(MsgTxtTypeNotice, "leave:", err)
-		return
-	}
-	// TODO: Figure out if room datastructure should be removed or not
-	//r, err := c.Rs.Del(roomID)
+// LeaveRoom leaves a room.  The room is kept in Rooms as a left room, which
+// is removed after HideLeftRoomsAfter, or with ForgetRoom.
+func (c *Client) LeaveRoom(roomID string) error {
 	r := c.Rs.ByID(roomID)
 	if r == nil {
-		c.ConsolePrint(MsgTxtTypeNotice, "leave:", roomID, "not found")
-		return
+		return fmt.Errorf("Room %s not found", roomID)
+	}
+	err := c.withAuth(func() error {
+		_, err := c.cli.LeaveRoom(roomID)
+		return err
+	})
+	if err != nil {
+		return err
 	}
-	c.ConsolePrintf(MsgTxtTypeNotice, "Left room (%s) %s", roomID, r.DispName)
-	// TODO: Notify UI of left room
+	c.ConsolePrintf(MsgTxtTypeNotice, "Left room (%s) %s", roomID, r.DispName())
+	// The sync will confirm it, but update the UI now
+	r.SetMembership(MemLeave)
+	return nil
+}
+
+type reqReadMarkers struct {
+	FullyRead string `json:"m.fully_read"`
+	Read      string `json:"m.read,omitempty"`
+}
+
+// MarkRead moves our read marker and read receipt to the last event of the
+// room, which resets its unread counts.
+func (c *Client) MarkRead(r *Room) error {
+	e := r.Events.LastEvent()
+	if e == nil || r.ID() == ConsoleRoomID {
+		return nil
+	}
+	if !r.setRead(e.ID) {
+		return nil
+	}
+	return c.withAuth(func() error {
+		_, err := c.cli.MakeRequest("POST", c.cli.BuildURL("rooms", r.ID(), "read_markers"),
+			&reqReadMarkers{FullyRead: e.ID, Read: e.ID}, nil)
+		return err
+	})
 }
 
 func (c *Client) Login() error {
+	if err := c.discover(); err != nil {
+		return err
+	}
 	c.ConsolePrintf(MsgTxtTypeNotice, "Logging in to %s ...", c.cfg.Homeserver)
-	res, err := c.cli.Login(&gomatrix.ReqLogin{
-		Type:     "m.login.password",
-		User:     c.cfg.Username,
-		Password: c.cfg.Password,
-	})
+	res, err := c.login(c.cfg.Password)
 	if err != nil {
 		return err
 	}
 
 	//fmt.Println("Token:", res.AccessToken)
-	c.ConsolePrintf(MsgTxtTypeNotice, "Logged in to %s", c.cfg.Homeserver)
-	c.DebugPrintf("AccessToken:\n%s", res.AccessToken)
-	c.cli.SetCredentials(res.UserID, res.AccessToken)
+	c.ConsolePrintf(MsgTxtTypeNotice, "Logged in to %s as %s", c.cfg.Homeserver, res.UserID)
+	if res.UserID != "" && res.UserID != c.cfg.UserID {
+		c.cfg.UserID = res.UserID
+		c.Rs.ConsoleRoom().Users.AddUpdate(c.cfg.UserID, c.cfg.DisplayName, 0, MemJoin)
+	}
+	c.setSession(res.UserID, res.AccessToken, res.RefreshToken)
+	// The state of the log is per user, whose ID is only known now
+	if c.cfg.LogDir != "" && c.chatLog == nil {
+		chatLog, err := OpenChatLog(c, c.cfg.LogDir, c.cfg.LogFormat)
+		if err != nil {
+			return fmt.Errorf("LogDir %s: %v", c.cfg.LogDir, err)
+		}
+		c.chatLog = chatLog
+	}
 
 	return nil
 }
@@ -294,7 +474,11 @@ func (c *Client) Login() error {
 func (c *Client) Sync() error {
 	c.ConsolePrint(MsgTxtTypeNotice, "Doing initial sync request ...")
 	//`{"room":{"timeline":{"limit":50}}}`
-	res, err := c.cli.SyncRequest(30000, "", "", false, "online")
+	var res *respSync
+	err := c.withAuth(func() (err error) {
+		res, err = c.syncRequest(30000, "", false, "online")
+		return err
+	})
 	if err != nil {
 		return err
 	}
@@ -330,32 +514,41 @@ func (c *Client) Sync() error {
 	//for _, ev := range roomHist.State.Events {
 	//}
 	//}
-	// TODO: Populate account data
-	//for _, ev := range res.AccountData.Events {
-	//}
-
 	// TODO: Do this only if the already set display name doesn't match the config
 	//if c.cfg.DisplayName != "" {
 	//	cli.SetDisplayName(c.cfg.DisplayName)
 	//}
 
 	go func() {
+		since := res.NextBatch
 		for {
-			res, err = c.cli.SyncRequest(30000, res.NextBatch, "", false, "")
+			var res *respSync
+			err := c.withAuth(func() (err error) {
+				res, err = c.syncRequest(30000, since, false, "")
+				return err
+			})
 			if err != nil {
 				// TODO: Add an exponential back-off up to 5 minutes or something.
 				time.Sleep(30)
 				continue
 			}
 			c.update(res)
+			since = res.NextBatch
 		}
 	}()
 
-	c.exit = make(chan error)
 	return <-c.exit
 }
 
-func (c *Client) update(res *gomatrix.RespSync) {
+func (c *Client) update(res *respSync) {
+	// The push rules are needed to process the timeline events
+	for _, ev := range res.AccountData.Events {
+		if ev.Type == "m.push_rules" {
+			if err := c.updatePushRules(ev.Content); err != nil {
+				c.DebugPrint("m.push_rules:", err)
+			}
+		}
+	}
 	for roomID, roomData := range res.Rooms.Join {
 		r := c.Rs.AddUpdate(&c.cfg.UserID, roomID, MemJoin)
 		for _, ev := range roomData.State.Events {
@@ -364,21 +557,34 @@ func (c *Client) update(res *gomatrix.RespSync) {
 			//	c.DebugPrintf("%v - %+v", err, ev)
 			//}
 		}
-		r.PushToken(roomData.Timeline.PrevBatch)
-		for _, ev := range roomData.Timeline.Events {
-			r.PushEvent(&ev)
+		if summary := roomData.Summary; summary.Heroes != nil ||
+			summary.JoinedMemberCount != nil || summary.InvitedMemberCount != nil {
+			r.setSummary(summary.Heroes, summary.JoinedMemberCount,
+				summary.InvitedMemberCount)
+		}
+		r.pushTimeline(roomData.Timeline.PrevBatch, roomData.Timeline.Limited,
+			roomData.Timeline.Events, res.NextBatch)
+		c.logTimeline(r, &roomData)
+		if unread := roomData.UnreadNotifications; unread != nil {
+			r.setUnread(unread.NotificationCount, unread.HighlightCount)
 		}
-		r.PushToken(res.NextBatch)
 		//if roomID == "!JpNcLQuoaOfdycmQio:matrix.org" {
 		//	c.DebugPrintf("%+v", roomData.State)
 		//	c.DebugPrintf("%+v", roomData.Timeline)
 		//}
 	}
 	for roomID, roomData := range res.Rooms.Invite {
+		prev := c.Rs.ByID(roomID)
+		newInvite := prev == nil || prev.Mem() != MemInvite
 		r := c.Rs.AddUpdate(&c.cfg.UserID, roomID, MemInvite)
 		for _, ev := range roomData.State.Events {
 			r.updateState(&ev)
+			if ev.Type == "m.room.member" && ev.StateKey != nil &&
+				*ev.StateKey == c.cfg.UserID && ev.Content["membership"] == "invite" {
+				r.setInviter(ev.Sender)
+			}
 		}
+		c.updateInvite(r, newInvite)
 		//if roomID == "!JpNcLQuoaOfdycmQio:matrix.org" {
 		c.DebugPrintf("invite %+v", roomData)
 		//}
@@ -388,11 +594,9 @@ func (c *Client) update(res *gomatrix.RespSync) {
 		for _, ev := range roomData.State.Events {
 			r.updateState(&ev)
 		}
-		r.PushToken(roomData.Timeline.PrevBatch)
-		for _, ev := range roomData.Timeline.Events {
-			r.PushEvent(&ev)
-		}
-		r.PushToken(res.NextBatch)
+		r.pushTimeline(roomData.Timeline.PrevBatch, roomData.Timeline.Limited,
+			roomData.Timeline.Events, res.NextBatch)
+		c.logTimeline(r, &roomData)
 		//if roomID == "!JpNcLQuoaOfdycmQio:matrix.org" {
 		//	c.DebugPrintf("leave %+v", roomData)
 		//}
@@ -401,7 +605,19 @@ func (c *Client) update(res *gomatrix.RespSync) {
 
 // TODO: Actually stop the c.cli.Sync()
 func (c *Client) StopSync() {
-	c.exit <- nil
+	if c.index != nil {
+		c.index.Close()
+	}
+	if c.chatLog != nil {
+		c.chatLog.Close()
+	}
+	c.Rs.stopHideTimers()
+	c.stopOnce.Do(func() { close(c.done) })
+	// The clients that didn't log in are not syncing
+	select {
+	case c.exit <- nil:
+	default:
+	}
 }
 
 //func (c *Client) SetMinMsgs(n uint) {
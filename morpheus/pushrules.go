@@ -0,0 +1,514 @@
+package morpheus
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/matrix-org/gomatrix"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	PushRuleOverride  = "override"
+	PushRuleContent   = "content"
+	PushRuleRoom      = "room"
+	PushRuleSender    = "sender"
+	PushRuleUnderride = "underride"
+)
+
+// PushRuleKinds lists the kinds of push rules in evaluation order.
+var PushRuleKinds = []string{PushRuleOverride, PushRuleContent, PushRuleRoom,
+	PushRuleSender, PushRuleUnderride}
+
+type PushCondition struct {
+	Kind    string `json:"kind"`
+	Key     string `json:"key,omitempty"`
+	Pattern string `json:"pattern,omitempty"`
+	Is      string `json:"is,omitempty"`
+}
+
+type PushRule struct {
+	RuleID     string          `json:"rule_id"`
+	Default    bool            `json:"default"`
+	Enabled    bool            `json:"enabled"`
+	Conditions []PushCondition `json:"conditions,omitempty"`
+	// Pattern is only used by content rules
+	Pattern string        `json:"pattern,omitempty"`
+	Actions []interface{} `json:"actions"`
+}
+
+type PushRuleset struct {
+	Override  []PushRule `json:"override"`
+	Content   []PushRule `json:"content"`
+	Room      []PushRule `json:"room"`
+	Sender    []PushRule `json:"sender"`
+	Underride []PushRule `json:"underride"`
+}
+
+// Kind returns the rules of the given kind.
+func (rs *PushRuleset) Kind(kind string) []PushRule {
+	switch kind {
+	case PushRuleOverride:
+		return rs.Override
+	case PushRuleContent:
+		return rs.Content
+	case PushRuleRoom:
+		return rs.Room
+	case PushRuleSender:
+		return rs.Sender
+	case PushRuleUnderride:
+		return rs.Underride
+	default:
+		return nil
+	}
+}
+
+type respPushRules struct {
+	Global PushRuleset `json:"global"`
+}
+
+// PushActions are the effects of the push rule that matched an event.
+type PushActions struct {
+	Notify    bool
+	Highlight bool
+	// Sound is the sound to play, empty for none
+	Sound string
+}
+
+func parsePushActions(actions []interface{}) (pa PushActions) {
+	for _, a := range actions {
+		switch a := a.(type) {
+		case string:
+			if a == "notify" || a == "coalesce" {
+				pa.Notify = true
+			}
+		case map[string]interface{}:
+			switch a["set_tweak"] {
+			case "sound":
+				pa.Sound, _ = a["value"].(string)
+			case "highlight":
+				// The value defaults to true
+				v, ok := a["value"].(bool)
+				pa.Highlight = v || !ok
+			}
+		}
+	}
+	return pa
+}
+
+type globKey struct {
+	pattern string
+	words   bool
+}
+
+// pushRules holds the push rules of our user, nil until they are received
+// in the account data.
+type pushRules struct {
+	rules *PushRuleset
+	rwm   sync.RWMutex
+	// globs caches the compiled patterns of the rules, nil if invalid
+	globs  map[globKey]*regexp.Regexp
+	globsM sync.Mutex
+}
+
+func (pr *pushRules) get() *PushRuleset {
+	pr.rwm.RLock()
+	defer pr.rwm.RUnlock()
+	return pr.rules
+}
+
+func (pr *pushRules) set(rules *PushRuleset) {
+	pr.rwm.Lock()
+	pr.rules = rules
+	pr.rwm.Unlock()
+	pr.globsM.Lock()
+	pr.globs = nil
+	pr.globsM.Unlock()
+}
+
+// updatePushRules decodes the content of an m.push_rules account data event.
+func (c *Client) updatePushRules(content map[string]interface{}) error {
+	data, err := json.Marshal(content)
+	if err != nil {
+		return err
+	}
+	var res respPushRules
+	if err := json.Unmarshal(data, &res); err != nil {
+		return err
+	}
+	c.pushRules.set(&res.Global)
+	return nil
+}
+
+// pushEvent is the event as seen by the push rule conditions.
+type pushEvent struct {
+	Type     string
+	Sender   string
+	StateKey *string
+	Content  map[string]interface{}
+}
+
+// splitPushKey splits a dotted key, where literal dots are escaped with a
+// backslash.
+func splitPushKey(key string) []string {
+	parts := []string{}
+	var part strings.Builder
+	for i := 0; i < len(key); i++ {
+		switch {
+		case key[i] == '\\' && i+1 < len(key):
+			i++
+			part.WriteByte(key[i])
+		case key[i] == '.':
+			parts = append(parts, part.String())
+			part.Reset()
+		default:
+			part.WriteByte(key[i])
+		}
+	}
+	return append(parts, part.String())
+}
+
+// value returns the string value of a dotted key of the event, as used by
+// event_match.
+func (pe *pushEvent) value(key string, roomID string) (string, bool) {
+	parts := splitPushKey(key)
+	switch parts[0] {
+	case "type":
+		return pe.Type, len(parts) == 1
+	case "sender":
+		return pe.Sender, len(parts) == 1
+	case "room_id":
+		return roomID, len(parts) == 1
+	case "state_key":
+		if pe.StateKey == nil || len(parts) != 1 {
+			return "", false
+		}
+		return *pe.StateKey, true
+	case "content":
+		var v interface{} = pe.Content
+		for _, p := range parts[1:] {
+			m, ok := v.(map[string]interface{})
+			if !ok {
+				return "", false
+			}
+			if v, ok = m[p]; !ok {
+				return "", false
+			}
+		}
+		s, ok := v.(string)
+		return s, ok
+	}
+	return "", false
+}
+
+// globRegexp compiles a push rule glob that matches case-insensitively the
+// whole value, or any word of it if words is true.
+func globRegexp(pattern string, words bool) (*regexp.Regexp, error) {
+	expr := regexp.QuoteMeta(pattern)
+	expr = strings.Replace(expr, `\*`, `.*`, -1)
+	expr = strings.Replace(expr, `\?`, `.`, -1)
+	if words {
+		expr = `(^|\W)` + expr + `(\W|$)`
+	} else {
+		expr = `^` + expr + `$`
+	}
+	return regexp.Compile("(?is)" + expr)
+}
+
+// globMatch matches a push rule glob against a value, compiling the glob
+// once for the current rules.
+func (pr *pushRules) globMatch(pattern, value string, words bool) bool {
+	key := globKey{pattern: pattern, words: words}
+	pr.globsM.Lock()
+	re, ok := pr.globs[key]
+	if !ok {
+		re, _ = globRegexp(pattern, words)
+		if pr.globs == nil {
+			pr.globs = make(map[globKey]*regexp.Regexp)
+		}
+		pr.globs[key] = re
+	}
+	pr.globsM.Unlock()
+	return re != nil && re.MatchString(value)
+}
+
+// containsWord returns true if word appears in s as a whole word, ignoring
+// case.
+func containsWord(s, word string) bool {
+	re, err := regexp.Compile(`(?is)(^|\W)` + regexp.QuoteMeta(word) + `(\W|$)`)
+	if err != nil {
+		return false
+	}
+	return re.MatchString(s)
+}
+
+// memberCountMatch evaluates the is field of a room_member_count condition.
+func memberCountMatch(is string, count int) bool {
+	op := strings.TrimRight(is, "0123456789")
+	n, err := strconv.Atoi(is[len(op):])
+	if err != nil {
+		return false
+	}
+	switch op {
+	case "", "==":
+		return count == n
+	case "<":
+		return count < n
+	case ">":
+		return count > n
+	case "<=":
+		return count <= n
+	case ">=":
+		return count >= n
+	}
+	return false
+}
+
+func (r *Room) pushConditionMatch(cond *PushCondition, pe *pushEvent) bool {
+	switch cond.Kind {
+	case "event_match":
+		value, ok := pe.value(cond.Key, r.ID())
+		if !ok {
+			return false
+		}
+		return r.Rooms.client.pushRules.globMatch(cond.Pattern, value,
+			cond.Key == "content.body")
+	case "contains_display_name":
+		body, ok := pe.Content["body"].(string)
+		if !ok {
+			return false
+		}
+		u := r.Users.ByID(*r.myUserID)
+		if u == nil || u.Name() == "" {
+			return false
+		}
+		return containsWord(body, u.Name())
+	case "room_member_count":
+		r.Users.rwm.RLock()
+		count := r.Users.MemCount[MemJoin]
+		r.Users.rwm.RUnlock()
+		return memberCountMatch(cond.Is, count)
+	case "sender_notification_permission":
+		return r.senderPower(pe.Sender) >= r.notificationPower(cond.Key)
+	}
+	// Unknown conditions never match
+	return false
+}
+
+func (r *Room) pushRuleMatch(kind string, rule *PushRule, pe *pushEvent) bool {
+	switch kind {
+	case PushRuleContent:
+		body, ok := pe.Content["body"].(string)
+		return ok && r.Rooms.client.pushRules.globMatch(rule.Pattern, body, true)
+	case PushRuleRoom:
+		return rule.RuleID == r.ID()
+	case PushRuleSender:
+		return rule.RuleID == pe.Sender
+	}
+	for i := range rule.Conditions {
+		if !r.pushConditionMatch(&rule.Conditions[i], pe) {
+			return false
+		}
+	}
+	return true
+}
+
+// pushActions evaluates our push rules for an event of the room.  Until the
+// rules are received, messages from other users notify and highlight if they
+// mention us.
+func (r *Room) pushActions(pe *pushEvent) PushActions {
+	if pe.Sender == *r.myUserID || r.ID() == ConsoleRoomID {
+		return PushActions{}
+	}
+	rules := r.Rooms.client.pushRules.get()
+	if rules == nil {
+		if pe.Type != "m.room.message" {
+			return PushActions{}
+		}
+		return PushActions{Notify: true, Highlight: r.isMention(pe)}
+	}
+	for _, kind := range PushRuleKinds {
+		for _, rule := range rules.Kind(kind) {
+			if rule.Enabled && r.pushRuleMatch(kind, &rule, pe) {
+				return parsePushActions(rule.Actions)
+			}
+		}
+	}
+	return PushActions{}
+}
+
+type reqPushRule struct {
+	Actions    []interface{}   `json:"actions"`
+	Conditions []PushCondition `json:"conditions,omitempty"`
+	Pattern    string          `json:"pattern,omitempty"`
+}
+
+type reqPushRuleEnabled struct {
+	Enabled bool `json:"enabled"`
+}
+
+func isNotFound(err error) bool {
+	httpErr, ok := err.(gomatrix.HTTPError)
+	return ok && httpErr.Code == 404
+}
+
+func (c *Client) pushRuleURL(kind, ruleID string, attr ...string) string {
+	return c.cli.BuildURL(append([]string{"pushrules", "global", kind, ruleID}, attr...)...)
+}
+
+// PushRules fetches the push rules of our user.
+func (c *Client) PushRules() (*PushRuleset, error) {
+	var res respPushRules
+	err := c.withAuth(func() error {
+		// The trailing slash is part of the endpoint
+		_, err := c.cli.MakeRequest("GET", c.cli.BuildURL("pushrules")+"/", nil, &res)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	c.pushRules.set(&res.Global)
+	return &res.Global, nil
+}
+
+// AddPushRule adds or replaces a push rule of the given kind.  For room and
+// sender rules the ruleID is the room or user ID, and for content rules the
+// pattern is matched against the words of the message body.
+func (c *Client) AddPushRule(kind, ruleID string, actions []interface{},
+	conditions []PushCondition, pattern string) error {
+	req := reqPushRule{Actions: actions, Conditions: conditions, Pattern: pattern}
+	err := c.withAuth(func() error {
+		_, err := c.cli.MakeRequest("PUT", c.pushRuleURL(kind, ruleID), &req, nil)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	_, err = c.PushRules()
+	return err
+}
+
+func (c *Client) SetPushRuleEnabled(kind, ruleID string, enabled bool) error {
+	err := c.withAuth(func() error {
+		_, err := c.cli.MakeRequest("PUT", c.pushRuleURL(kind, ruleID, "enabled"),
+			&reqPushRuleEnabled{Enabled: enabled}, nil)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	_, err = c.PushRules()
+	return err
+}
+
+// DeletePushRule deletes a push rule.  Deleting a rule that doesn't exist is
+// not an error.
+func (c *Client) DeletePushRule(kind, ruleID string) error {
+	err := c.withAuth(func() error {
+		_, err := c.cli.MakeRequest("DELETE", c.pushRuleURL(kind, ruleID), nil, nil)
+		return err
+	})
+	if err != nil && !isNotFound(err) {
+		return err
+	}
+	_, err = c.PushRules()
+	return err
+}
+
+type RoomNotify int
+
+const (
+	RoomNotifyAll      RoomNotify = iota
+	RoomNotifyMentions RoomNotify = iota
+	RoomNotifyNone     RoomNotify = iota
+)
+
+func (n RoomNotify) String() string {
+	switch n {
+	case RoomNotifyAll:
+		return "all"
+	case RoomNotifyMentions:
+		return "mentions"
+	case RoomNotifyNone:
+		return "none"
+	default:
+		return ""
+	}
+}
+
+// SetRoomNotify sets how a room notifies, the same way other clients do it:
+// a room rule that doesn't notify keeps the mentions and keywords, which are
+// override and content rules, and an override rule that doesn't notify mutes
+// the room completely.
+func (c *Client) SetRoomNotify(roomID string, notify RoomNotify) error {
+	dontNotify := []interface{}{"dont_notify"}
+	switch notify {
+	case RoomNotifyAll:
+		if err := c.DeletePushRule(PushRuleOverride, roomID); err != nil {
+			return err
+		}
+		return c.DeletePushRule(PushRuleRoom, roomID)
+	case RoomNotifyMentions:
+		if err := c.DeletePushRule(PushRuleOverride, roomID); err != nil {
+			return err
+		}
+		return c.AddPushRule(PushRuleRoom, roomID, dontNotify, nil, "")
+	case RoomNotifyNone:
+		if err := c.DeletePushRule(PushRuleRoom, roomID); err != nil {
+			return err
+		}
+		return c.AddPushRule(PushRuleOverride, roomID, dontNotify,
+			[]PushCondition{{Kind: "event_match", Key: "room_id", Pattern: roomID}}, "")
+	default:
+		return fmt.Errorf("Invalid RoomNotify %d", notify)
+	}
+}
+
+// RoomNotify returns how a room notifies according to the rules set by
+// SetRoomNotify.
+func (c *Client) RoomNotify(roomID string) RoomNotify {
+	rules := c.pushRules.get()
+	if rules == nil {
+		return RoomNotifyAll
+	}
+	for _, rule := range rules.Override {
+		if rule.RuleID == roomID && rule.Enabled {
+			return RoomNotifyNone
+		}
+	}
+	for _, rule := range rules.Room {
+		if rule.RuleID == roomID && rule.Enabled && !parsePushActions(rule.Actions).Notify {
+			return RoomNotifyMentions
+		}
+	}
+	return RoomNotifyAll
+}
+
+// AddKeyword adds a content rule that highlights the messages containing
+// the keyword.
+func (c *Client) AddKeyword(keyword string) error {
+	return c.AddPushRule(PushRuleContent, keyword, []interface{}{"notify",
+		map[string]interface{}{"set_tweak": "sound", "value": "default"},
+		map[string]interface{}{"set_tweak": "highlight"}}, nil, keyword)
+}
+
+func (c *Client) DelKeyword(keyword string) error {
+	return c.DeletePushRule(PushRuleContent, keyword)
+}
+
+// Keywords returns the patterns of the content rules that we have added.
+func (c *Client) Keywords() []string {
+	keywords := []string{}
+	rules := c.pushRules.get()
+	if rules == nil {
+		return keywords
+	}
+	for _, rule := range rules.Content {
+		if !rule.Default {
+			keywords = append(keywords, rule.Pattern)
+		}
+	}
+	return keywords
+}
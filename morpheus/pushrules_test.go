@@ -0,0 +1,156 @@
+package morpheus
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestGlobMatch(t *testing.T) {
+	tests := []struct {
+		pattern, value string
+		words          bool
+		match          bool
+	}{
+		{"m.room.message", "m.room.message", false, true},
+		{"m.room.message", "m.room.messages", false, false},
+		{"m.room.*", "m.room.member", false, true},
+		{"m.room.?ember", "m.room.member", false, true},
+		{"m.room.?ember", "m.room.mmember", false, false},
+		{"M.ROOM.MESSAGE", "m.room.message", false, true},
+		{"m.room.message", "xm.room.message", false, false},
+		{"cake", "I like cake", true, true},
+		{"cake", "I like CAKE!", true, true},
+		{"cake", "I like cakes", true, false},
+		{"cake*", "I like cakes", true, true},
+		{"ca?e", "a case of", true, true},
+		{"lunch time", "is it lunch time?", true, true},
+		{"[a]", "[a]", false, true},
+		{"a.b", "axb", false, false},
+		{"", "", false, true},
+	}
+	var pr pushRules
+	for _, test := range tests {
+		for i := 0; i < 2; i++ {
+			if match := pr.globMatch(test.pattern, test.value, test.words); match != test.match {
+				t.Errorf("globMatch(%q, %q, %v) = %v, want %v", test.pattern, test.value,
+					test.words, match, test.match)
+			}
+		}
+	}
+	pr.set(&PushRuleset{})
+	if pr.globs != nil {
+		t.Errorf("set() kept the compiled globs")
+	}
+}
+
+func TestMemberCountMatch(t *testing.T) {
+	tests := []struct {
+		is    string
+		count int
+		match bool
+	}{
+		{"2", 2, true},
+		{"2", 3, false},
+		{"==2", 2, true},
+		{"<2", 1, true},
+		{"<2", 2, false},
+		{">2", 3, true},
+		{">2", 2, false},
+		{"<=2", 2, true},
+		{"<=2", 3, false},
+		{">=2", 2, true},
+		{">=2", 1, false},
+		{"", 0, false},
+		{"=2", 2, false},
+		{"!2", 1, false},
+		{">x", 1, false},
+	}
+	for _, test := range tests {
+		if match := memberCountMatch(test.is, test.count); match != test.match {
+			t.Errorf("memberCountMatch(%q, %d) = %v, want %v", test.is, test.count,
+				match, test.match)
+		}
+	}
+}
+
+func TestSplitPushKey(t *testing.T) {
+	tests := []struct {
+		key   string
+		parts []string
+	}{
+		{"type", []string{"type"}},
+		{"content.body", []string{"content", "body"}},
+		{`content.m\.relates_to.rel_type`, []string{"content", "m.relates_to", "rel_type"}},
+		{`content.a\\b`, []string{"content", `a\b`}},
+		{`a\`, []string{`a\`}},
+		{"a..b", []string{"a", "", "b"}},
+		{"", []string{""}},
+	}
+	for _, test := range tests {
+		if parts := splitPushKey(test.key); !reflect.DeepEqual(parts, test.parts) {
+			t.Errorf("splitPushKey(%q) = %q, want %q", test.key, parts, test.parts)
+		}
+	}
+}
+
+func TestPushEventValue(t *testing.T) {
+	stateKey := "@a:b"
+	pe := &pushEvent{
+		Type:     "m.room.message",
+		Sender:   "@s:b",
+		StateKey: &stateKey,
+		Content: map[string]interface{}{
+			"body":         "hi",
+			"m.relates_to": map[string]interface{}{"rel_type": "m.thread"},
+			"n":            1.0,
+		},
+	}
+	tests := []struct {
+		key   string
+		value string
+		ok    bool
+	}{
+		{"type", "m.room.message", true},
+		{"sender", "@s:b", true},
+		{"room_id", "!r:b", true},
+		{"state_key", "@a:b", true},
+		{"content.body", "hi", true},
+		{`content.m\.relates_to.rel_type`, "m.thread", true},
+		{"content.m.relates_to.rel_type", "", false},
+		{"content.n", "", false},
+		{"content.missing", "", false},
+		{"content", "", false},
+		{"type.x", "m.room.message", false},
+		{"unknown", "", false},
+	}
+	for _, test := range tests {
+		value, ok := pe.value(test.key, "!r:b")
+		if value != test.value || ok != test.ok {
+			t.Errorf("value(%q) = %q, %v, want %q, %v", test.key, value, ok,
+				test.value, test.ok)
+		}
+	}
+}
+
+func TestParsePushActions(t *testing.T) {
+	tests := []struct {
+		actions []interface{}
+		pa      PushActions
+	}{
+		{nil, PushActions{}},
+		{[]interface{}{"dont_notify"}, PushActions{}},
+		{[]interface{}{"notify"}, PushActions{Notify: true}},
+		{[]interface{}{"coalesce"}, PushActions{Notify: true}},
+		{[]interface{}{"notify", map[string]interface{}{"set_tweak": "sound",
+			"value": "default"}}, PushActions{Notify: true, Sound: "default"}},
+		{[]interface{}{"notify", map[string]interface{}{"set_tweak": "highlight"}},
+			PushActions{Notify: true, Highlight: true}},
+		{[]interface{}{"notify", map[string]interface{}{"set_tweak": "highlight",
+			"value": false}}, PushActions{Notify: true}},
+	}
+	for _, test := range tests {
+		if pa := parsePushActions(test.actions); pa != test.pa {
+			t.Errorf("parsePushActions(%v) = %+v, want %+v", test.actions, pa, test.pa)
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package morpheus
+
+import (
+	"fmt"
+	"github.com/matrix-org/gomatrix"
+	"strconv"
+)
+
+// SearchFilter restricts the events returned by Search.  Empty fields match
+// everything.
+type SearchFilter struct {
+	Senders    []string `json:"senders,omitempty"`
+	NotSenders []string `json:"not_senders,omitempty"`
+	Types      []string `json:"types,omitempty"`
+	// Limit is the number of results per page
+	Limit int `json:"limit,omitempty"`
+}
+
+type reqSearchFilter struct {
+	SearchFilter
+	Rooms []string `json:"rooms,omitempty"`
+}
+
+type reqEventContext struct {
+	BeforeLimit int `json:"before_limit"`
+	AfterLimit  int `json:"after_limit"`
+}
+
+type reqSearch struct {
+	SearchCategories struct {
+		RoomEvents struct {
+			SearchTerm   string          `json:"search_term"`
+			Keys         []string        `json:"keys"`
+			Filter       reqSearchFilter `json:"filter"`
+			OrderBy      string          `json:"order_by"`
+			EventContext reqEventContext `json:"event_context"`
+		} `json:"room_events"`
+	} `json:"search_categories"`
+}
+
+type respSearch struct {
+	SearchCategories struct {
+		RoomEvents struct {
+			Count      int      `json:"count"`
+			Highlights []string `json:"highlights"`
+			Results    []struct {
+				Rank    float64        `json:"rank"`
+				Result  gomatrix.Event `json:"result"`
+				Context struct {
+					EventsBefore []gomatrix.Event `json:"events_before"`
+					EventsAfter  []gomatrix.Event `json:"events_after"`
+				} `json:"context"`
+			} `json:"results"`
+			NextBatch string `json:"next_batch"`
+		} `json:"room_events"`
+	} `json:"search_categories"`
+}
+
+type SearchResult struct {
+	RoomID string
+	Rank   float64
+	Event  *Event
+	// Before and After are the events around Event in chronological order
+	Before []*Event
+	After  []*Event
+}
+
+type SearchResults struct {
+	// Count is the approximate number of results of the search
+	Count      int
+	Results    []SearchResult
+	Highlights []string
+	// NextBatch is the token to get the next page, empty if this is the
+	// last one
+	NextBatch string
+}
+
+// reverseEvents returns the events in reverse order.
+func reverseEvents(es []*Event) []*Event {
+	for i, j := 0, len(es)-1; i < j; i, j = i+1, j-1 {
+		es[i], es[j] = es[j], es[i]
+	}
+	return es
+}
+
+// Search looks for term in the message bodies of the given rooms, or all our
+// rooms if rooms is empty, ranking the results by relevance.  Every result
+// has contextLen events before and after it.  nextBatch is the NextBatch of
+// the previous page, or empty for the first one.  Results with event types
+// that we don't support are skipped.
+func (c *Client) Search(term string, rooms []string, filter *SearchFilter,
+	contextLen int, nextBatch string) (*SearchResults, error) {
+	var req reqSearch
+	re := &req.SearchCategories.RoomEvents
+	re.SearchTerm = term
+	re.Keys = []string{"content.body"}
+	if filter != nil {
+		re.Filter.SearchFilter = *filter
+	}
+	re.Filter.Rooms = rooms
+	re.OrderBy = "rank"
+	re.EventContext = reqEventContext{BeforeLimit: contextLen, AfterLimit: contextLen}
+	query := map[string]string{}
+	if nextBatch != "" {
+		query["next_batch"] = nextBatch
+	}
+	var res respSearch
+	err := c.withAuth(func() error {
+		_, err := c.cli.MakeRequest("POST",
+			c.cli.BuildURLWithQuery([]string{"search"}, query), &req, &res)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	resRE := &res.SearchCategories.RoomEvents
+	results := &SearchResults{Count: resRE.Count, Highlights: resRE.Highlights,
+		NextBatch: resRE.NextBatch}
+	for i := range resRE.Results {
+		result := &resRE.Results[i]
+		e, err := newEvent(&result.Result)
+		if err != nil {
+			continue
+		}
+		results.Results = append(results.Results, SearchResult{
+			RoomID: result.Result.RoomID,
+			Rank:   result.Rank,
+			Event:  e,
+			// events_before is in reverse chronological order
+			Before: reverseEvents(newEvents(result.Context.EventsBefore)),
+			After:  newEvents(result.Context.EventsAfter),
+		})
+	}
+	return results, nil
+}
+
+type respContext struct {
+	Start        string           `json:"start"`
+	End          string           `json:"end"`
+	Event        gomatrix.Event   `json:"event"`
+	EventsBefore []gomatrix.Event `json:"events_before"`
+	EventsAfter  []gomatrix.Event `json:"events_after"`
+}
+
+// EventContext is an event with the events around it, as returned by
+// Context.
+type EventContext struct {
+	RoomID string
+	Event  *Event
+	// Before and After are in chronological order
+	Before []*Event
+	After  []*Event
+	// Start and End are the pagination tokens before Before and after
+	// After
+	Start string
+	End   string
+}
+
+// context requests up to limit events around the event eventID.
+func (c *Client) context(roomID, eventID string, limit int) (*respContext, error) {
+	var res respContext
+	err := c.withAuth(func() error {
+		_, err := c.cli.MakeRequest("GET", c.cli.BuildURLWithQuery(
+			[]string{"rooms", roomID, "context", eventID},
+			map[string]string{"limit": strconv.Itoa(limit)}), nil, &res)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// Context fetches up to limit events around the event eventID.
+func (c *Client) Context(roomID, eventID string, limit int) (*EventContext, error) {
+	res, err := c.context(roomID, eventID, limit)
+	if err != nil {
+		return nil, err
+	}
+	e, err := newEvent(&res.Event)
+	if err != nil {
+		return nil, fmt.Errorf("Event %s: %v", eventID, err)
+	}
+	return &EventContext{
+		RoomID: roomID,
+		Event:  e,
+		Before: reverseEvents(newEvents(res.EventsBefore)),
+		After:  newEvents(res.EventsAfter),
+		Start:  res.Start,
+		End:    res.End,
+	}, nil
+}
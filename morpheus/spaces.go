@@ -0,0 +1,223 @@
+package morpheus
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+)
+
+// maxHierarchyRooms limits the rooms fetched by Hierarchy
+const maxHierarchyRooms = 500
+
+// SpaceChild is a room listed by a space in an m.space.child state event.
+type SpaceChild struct {
+	RoomID    string
+	Via       []string
+	Order     string
+	Suggested bool
+}
+
+// spaceChild parses the content of an m.space.child.  The children without
+// via servers have been removed from the space.
+func spaceChild(roomID string, content map[string]interface{}) (SpaceChild, bool) {
+	child := SpaceChild{RoomID: roomID}
+	via, _ := content["via"].([]interface{})
+	for _, v := range via {
+		if server, ok := v.(string); ok {
+			child.Via = append(child.Via, server)
+		}
+	}
+	if len(child.Via) == 0 {
+		return child, false
+	}
+	child.Order, _ = content["order"].(string)
+	// Invalid orders are ignored, as the spec says
+	if len(child.Order) > 50 {
+		child.Order = ""
+	}
+	for _, c := range child.Order {
+		if c < 0x20 || c > 0x7e {
+			child.Order = ""
+			break
+		}
+	}
+	child.Suggested, _ = content["suggested"].(bool)
+	return child, true
+}
+
+// sortSpaceChildren sorts the children by order, the ones without it last,
+// and then by room ID.
+func sortSpaceChildren(children []SpaceChild) {
+	sort.SliceStable(children, func(i, j int) bool {
+		oi, oj := children[i].Order, children[j].Order
+		if oi != oj {
+			if oi == "" || oj == "" {
+				return oj == ""
+			}
+			return oi < oj
+		}
+		return children[i].RoomID < children[j].RoomID
+	})
+}
+
+// IsSpace returns true if the room is a space.
+func (r *Room) IsSpace() bool {
+	roomType, _ := r.State("m.room.create", "")["type"].(string)
+	return roomType == "m.space"
+}
+
+// SpaceChildren returns the children of the space in the order they are
+// listed.
+func (r *Room) SpaceChildren() []SpaceChild {
+	r.rwm.RLock()
+	defer r.rwm.RUnlock()
+	children := []SpaceChild{}
+	for key, content := range r.state {
+		if key.Type != "m.space.child" {
+			continue
+		}
+		if child, ok := spaceChild(key.StateKey, content); ok {
+			children = append(children, child)
+		}
+	}
+	sortSpaceChildren(children)
+	return children
+}
+
+// SpaceParents returns the IDs of the spaces that the room claims as parents
+// in m.space.parent state events.
+func (r *Room) SpaceParents() []string {
+	r.rwm.RLock()
+	defer r.rwm.RUnlock()
+	parents := []string{}
+	for key, content := range r.state {
+		if key.Type != "m.space.parent" {
+			continue
+		}
+		if via, _ := content["via"].([]interface{}); len(via) != 0 {
+			parents = append(parents, key.StateKey)
+		}
+	}
+	sort.Strings(parents)
+	return parents
+}
+
+// Parents returns the joined spaces that list the room as a child, or that
+// the room claims as parents.
+func (rs *Rooms) Parents(r *Room) []*Room {
+	rs.rwm.RLock()
+	rooms := make([]*Room, len(rs.R))
+	copy(rooms, rs.R)
+	rs.rwm.RUnlock()
+	claimed := make(map[string]bool)
+	for _, roomID := range r.SpaceParents() {
+		claimed[roomID] = true
+	}
+	parents := []*Room{}
+	for _, s := range rooms {
+		if s == r || s.Mem() != MemJoin || !s.IsSpace() {
+			continue
+		}
+		if claimed[s.ID()] {
+			parents = append(parents, s)
+			continue
+		}
+		for _, child := range s.SpaceChildren() {
+			if child.RoomID == r.ID() {
+				parents = append(parents, s)
+				break
+			}
+		}
+	}
+	return parents
+}
+
+// HierarchyRoom is a room of the hierarchy of a space, as the homeserver
+// knows it.  We don't need to be in the room.
+type HierarchyRoom struct {
+	RoomID        string `json:"room_id"`
+	Name          string `json:"name"`
+	CanonAlias    string `json:"canonical_alias"`
+	Topic         string `json:"topic"`
+	Members       int    `json:"num_joined_members"`
+	RoomType      string `json:"room_type"`
+	JoinRule      string `json:"join_rule"`
+	WorldReadable bool   `json:"world_readable"`
+	ChildrenState []struct {
+		Type     string                 `json:"type"`
+		StateKey string                 `json:"state_key"`
+		Content  map[string]interface{} `json:"content"`
+	} `json:"children_state"`
+}
+
+// IsSpace returns true if the room is a space.
+func (hr *HierarchyRoom) IsSpace() bool {
+	return hr.RoomType == "m.space"
+}
+
+// Children returns the children of the room, if it's a space, in the order
+// they are listed.
+func (hr *HierarchyRoom) Children() []SpaceChild {
+	children := []SpaceChild{}
+	for _, ev := range hr.ChildrenState {
+		if ev.Type != "m.space.child" {
+			continue
+		}
+		if child, ok := spaceChild(ev.StateKey, ev.Content); ok {
+			children = append(children, child)
+		}
+	}
+	sortSpaceChildren(children)
+	return children
+}
+
+type respHierarchy struct {
+	Rooms     []HierarchyRoom `json:"rooms"`
+	NextBatch string          `json:"next_batch"`
+}
+
+// Hierarchy returns the rooms of a space and of its nested spaces, the space
+// first.
+func (c *Client) Hierarchy(spaceID string) ([]HierarchyRoom, error) {
+	rooms := []HierarchyRoom{}
+	from := ""
+	for len(rooms) < maxHierarchyRooms {
+		query := url.Values{}
+		if from != "" {
+			query.Set("from", from)
+		}
+		// The endpoint was added in v1.2 of the spec, for every prefix
+		u := c.cli.BuildBaseURL("_matrix", "client", "v1", "rooms", spaceID,
+			"hierarchy") + "?" + query.Encode()
+		var res respHierarchy
+		err := c.withAuth(func() error {
+			_, err := c.cli.MakeRequest("GET", u, nil, &res)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		rooms = append(rooms, res.Rooms...)
+		if res.NextBatch == "" || len(res.Rooms) == 0 {
+			break
+		}
+		from = res.NextBatch
+	}
+	if len(rooms) == 0 {
+		return nil, fmt.Errorf("Space %s not found", spaceID)
+	}
+	return rooms, nil
+}
+
+// JoinRoomVia joins a room through the servers that a space or an upgrade
+// lists for it.
+func (c *Client) JoinRoomVia(roomID string, via []string) error {
+	u := c.cli.BuildURL("join", roomID)
+	if len(via) != 0 {
+		u += "?" + url.Values{"server_name": via}.Encode()
+	}
+	return c.withAuth(func() error {
+		_, err := c.cli.MakeRequest("POST", u, struct{}{}, nil)
+		return err
+	})
+}
@@ -0,0 +1,120 @@
+package morpheus
+
+import (
+	"github.com/matrix-org/gomatrix"
+)
+
+type stateKey struct {
+	Type     string
+	StateKey string
+}
+
+// roomState maps the (type, state_key) of the state events of a room to
+// their raw content.
+type roomState map[stateKey]map[string]interface{}
+
+// prevContent returns the content that a state event replaced, or nil if it
+// didn't replace any.
+func prevContent(ev *gomatrix.Event) map[string]interface{} {
+	prev, _ := ev.Unsigned["prev_content"].(map[string]interface{})
+	return prev
+}
+
+// revert undoes a state event, going back in time.
+func (s roomState) revert(evType string, key *string, prev map[string]interface{}) {
+	if key == nil {
+		return
+	}
+	if prev == nil {
+		delete(s, stateKey{evType, *key})
+	} else {
+		s[stateKey{evType, *key}] = prev
+	}
+}
+
+// name returns the display name of the user, or "" if it has none.
+func (s roomState) name(userID string) string {
+	name, _ := s[stateKey{"m.room.member", userID}]["displayname"].(string)
+	return name
+}
+
+// setState stores the raw content of a state event.
+func (r *Room) setState(ev *gomatrix.Event) {
+	if ev.StateKey == nil {
+		return
+	}
+	r.rwm.Lock()
+	r.state[stateKey{ev.Type, *ev.StateKey}] = ev.Content
+	r.rwm.Unlock()
+}
+
+// State returns the content of the current state event of the room with the
+// type and state key, or nil if there is none.  The content must not be
+// modified.
+func (r *Room) State(evType, key string) map[string]interface{} {
+	r.rwm.RLock()
+	defer r.rwm.RUnlock()
+	return r.state[stateKey{evType, key}]
+}
+
+// StateKeys returns the state keys of the current state events of the room
+// with the type.
+func (r *Room) StateKeys(evType string) []string {
+	r.rwm.RLock()
+	defer r.rwm.RUnlock()
+	keys := []string{}
+	for key := range r.state {
+		if key.Type == evType {
+			keys = append(keys, key.StateKey)
+		}
+	}
+	return keys
+}
+
+// senderName returns the current display name of a user in the room.
+func (r *Room) senderName(userID string) string {
+	r.rwm.RLock()
+	defer r.rwm.RUnlock()
+	return r.state.name(userID)
+}
+
+// stateBefore returns the state of the room before the events of the window
+// that come after mark, or before all of them if mark is nil.  It's rebuilt
+// from the current state reverting the state events of the window.
+func (r *Room) stateBefore(mark interface{}) roomState {
+	r.rwm.RLock()
+	state := make(roomState, len(r.state))
+	for key, content := range r.state {
+		state[key] = content
+	}
+	r.rwm.RUnlock()
+	r.Events.rwm.RLock()
+	defer r.Events.rwm.RUnlock()
+	for e := r.Events.l.Back(); e != nil; e = e.Prev() {
+		if mark != nil && e.Value == mark {
+			break
+		}
+		if ev, ok := e.Value.(*Event); ok {
+			state.revert(ev.Type, ev.StateKey, ev.prevContent)
+		}
+	}
+	return state
+}
+
+// historicalEvents parses the events fetched backwards from a point of the
+// timeline with the given state, setting the sender names in effect when
+// they were sent.  The events are returned newest first.
+func (r *Room) historicalEvents(state roomState, evs []gomatrix.Event) []*Event {
+	es := make([]*Event, 0, len(evs))
+	for i := range evs {
+		ev := &evs[i]
+		state.revert(ev.Type, ev.StateKey, prevContent(ev))
+		e, err := r.timelineEvent(ev)
+		if err != nil {
+			continue
+		}
+		e.SenderName = state.name(ev.Sender)
+		es = append(es, e)
+	}
+	return es
+}
@@ -0,0 +1,76 @@
+package morpheus
+
+import (
+	"github.com/matrix-org/gomatrix"
+	"strconv"
+)
+
+// respSync extends gomatrix.RespSync with the room fields that gomatrix
+// doesn't decode.
+type respSync struct {
+	NextBatch   string `json:"next_batch"`
+	AccountData struct {
+		Events []gomatrix.Event `json:"events"`
+	} `json:"account_data"`
+	Presence struct {
+		Events []gomatrix.Event `json:"events"`
+	} `json:"presence"`
+	Rooms struct {
+		Leave  map[string]respSyncRoom `json:"leave"`
+		Join   map[string]respSyncRoom `json:"join"`
+		Invite map[string]struct {
+			State struct {
+				Events []gomatrix.Event `json:"events"`
+			} `json:"invite_state"`
+		} `json:"invite"`
+	} `json:"rooms"`
+}
+
+type respSyncRoom struct {
+	State struct {
+		Events []gomatrix.Event `json:"events"`
+	} `json:"state"`
+	Timeline struct {
+		Events    []gomatrix.Event `json:"events"`
+		Limited   bool             `json:"limited"`
+		PrevBatch string           `json:"prev_batch"`
+	} `json:"timeline"`
+	Ephemeral struct {
+		Events []gomatrix.Event `json:"events"`
+	} `json:"ephemeral"`
+	AccountData struct {
+		Events []gomatrix.Event `json:"events"`
+	} `json:"account_data"`
+	Summary struct {
+		Heroes             []string `json:"m.heroes"`
+		JoinedMemberCount  *int     `json:"m.joined_member_count"`
+		InvitedMemberCount *int     `json:"m.invited_member_count"`
+	} `json:"summary"`
+	UnreadNotifications *struct {
+		HighlightCount    int `json:"highlight_count"`
+		NotificationCount int `json:"notification_count"`
+	} `json:"unread_notifications"`
+}
+
+func (c *Client) syncRequest(timeout int, since string, fullState bool,
+	setPresence string) (*respSync, error) {
+	query := map[string]string{
+		"timeout": strconv.Itoa(timeout),
+	}
+	if since != "" {
+		query["since"] = since
+	}
+	if fullState {
+		query["full_state"] = "true"
+	}
+	if setPresence != "" {
+		query["set_presence"] = setPresence
+	}
+	var res respSync
+	_, err := c.cli.MakeRequest("GET", c.cli.BuildURLWithQuery([]string{"sync"}, query),
+		nil, &res)
+	if err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
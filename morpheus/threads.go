@@ -0,0 +1,259 @@
+package morpheus
+
+import (
+	"fmt"
+	"github.com/matrix-org/gomatrix"
+	"net/url"
+	"sort"
+	"strconv"
+)
+
+// Thread is the summary of a thread: the events that reply to its root event
+// with the m.thread relation.
+type Thread struct {
+	RootID string
+	// Count is the number of replies
+	Count int
+	// Latest is the last reply, nil if we haven't seen any
+	Latest *Event
+	// Participated is true if we sent a reply
+	Participated bool
+}
+
+// threadState merges the summaries that the homeserver bundles with the root
+// events with the replies that we see, which may be older or newer.
+type threadState struct {
+	bundled      int
+	bundledTs    int64
+	latest       *Event
+	participated bool
+	// seen are the timestamps of the replies that we have seen
+	seen map[string]int64
+}
+
+func (t *threadState) count() int {
+	n := t.bundled
+	for _, ts := range t.seen {
+		if ts > t.bundledTs {
+			n++
+		}
+	}
+	if len(t.seen) > n {
+		n = len(t.seen)
+	}
+	return n
+}
+
+// threadRoot returns the root of the thread of an event from its content,
+// or "" if it's not in a thread.
+func threadRoot(content map[string]interface{}) string {
+	rel, _ := content["m.relates_to"].(map[string]interface{})
+	if relType, _ := rel["rel_type"].(string); relType != "m.thread" {
+		return ""
+	}
+	rootID, _ := rel["event_id"].(string)
+	return rootID
+}
+
+// thread returns the state of a thread, creating it.  r.rwm must be locked.
+func (r *Room) thread(rootID string) *threadState {
+	t, ok := r.threads[rootID]
+	if !ok {
+		t = &threadState{seen: make(map[string]int64)}
+		r.threads[rootID] = t
+	}
+	return t
+}
+
+// updateThreads adds a timeline event to the summary of its thread, and the
+// summary bundled in a root event.
+func (r *Room) updateThreads(ev *gomatrix.Event, e *Event) {
+	relations, _ := ev.Unsigned["m.relations"].(map[string]interface{})
+	bundle, _ := relations["m.thread"].(map[string]interface{})
+	var latest *Event
+	if bundle != nil {
+		if raw, ok := bundle["latest_event"].(map[string]interface{}); ok {
+			latest = bundledEvent(raw)
+		}
+	}
+	if e.ThreadRoot == "" && bundle == nil {
+		return
+	}
+	r.rwm.Lock()
+	defer r.rwm.Unlock()
+	if e.ThreadRoot != "" {
+		t := r.thread(e.ThreadRoot)
+		if _, ok := t.seen[e.ID]; !ok {
+			t.seen[e.ID] = e.Ts
+			if t.latest == nil || e.Ts >= t.latest.Ts {
+				t.latest = e
+			}
+			if e.Sender == *r.myUserID {
+				t.participated = true
+			}
+		}
+	}
+	if bundle != nil {
+		t := r.thread(e.ID)
+		count, _ := bundle["count"].(float64)
+		participated, _ := bundle["current_user_participated"].(bool)
+		if latest != nil && latest.Ts >= t.bundledTs {
+			t.bundled = int(count)
+			t.bundledTs = latest.Ts
+			if t.latest == nil || latest.Ts >= t.latest.Ts {
+				t.latest = latest
+			}
+		}
+		t.participated = t.participated || participated
+	}
+}
+
+// bundledEvent parses the latest event of a bundled thread summary, or
+// returns nil if it's not supported.
+func bundledEvent(raw map[string]interface{}) *Event {
+	ev := gomatrix.Event{}
+	ev.Type, _ = raw["type"].(string)
+	ev.ID, _ = raw["event_id"].(string)
+	ev.Sender, _ = raw["sender"].(string)
+	ts, _ := raw["origin_server_ts"].(float64)
+	ev.Timestamp = int64(ts)
+	ev.Content, _ = raw["content"].(map[string]interface{})
+	e, err := newEvent(&ev)
+	if err != nil {
+		return nil
+	}
+	return e
+}
+
+// Thread returns the summary of the thread of a root event, or nil if it has
+// no replies that we know of.
+func (r *Room) Thread(rootID string) *Thread {
+	r.rwm.RLock()
+	defer r.rwm.RUnlock()
+	t, ok := r.threads[rootID]
+	if !ok {
+		return nil
+	}
+	return &Thread{RootID: rootID, Count: t.count(), Latest: t.latest,
+		Participated: t.participated}
+}
+
+// Threads returns the summaries of the threads of the room, the last active
+// first.
+func (r *Room) Threads() []*Thread {
+	r.rwm.RLock()
+	rootIDs := make([]string, 0, len(r.threads))
+	for rootID := range r.threads {
+		rootIDs = append(rootIDs, rootID)
+	}
+	r.rwm.RUnlock()
+	threads := make([]*Thread, 0, len(rootIDs))
+	for _, rootID := range rootIDs {
+		if t := r.Thread(rootID); t != nil {
+			threads = append(threads, t)
+		}
+	}
+	latestTs := func(t *Thread) int64 {
+		if t.Latest == nil {
+			return 0
+		}
+		return t.Latest.Ts
+	}
+	sort.SliceStable(threads, func(i, j int) bool {
+		if latestTs(threads[i]) != latestTs(threads[j]) {
+			return latestTs(threads[i]) > latestTs(threads[j])
+		}
+		return threads[i].RootID < threads[j].RootID
+	})
+	return threads
+}
+
+type respRelations struct {
+	Chunk     []gomatrix.Event `json:"chunk"`
+	NextBatch string           `json:"next_batch"`
+}
+
+// ThreadEvents fetches up to limit replies of a thread before the token from,
+// or the last ones if from is empty.  The replies are returned in
+// chronological order, with the token to fetch the previous ones, empty if
+// there are no more.
+func (c *Client) ThreadEvents(r *Room, rootID, from string, limit uint) ([]*Event, string, error) {
+	query := url.Values{"dir": []string{"b"}, "limit": []string{strconv.Itoa(int(limit))}}
+	if from != "" {
+		query.Set("from", from)
+	}
+	u := c.cli.BuildBaseURL("_matrix", "client", "v1", "rooms", r.ID(), "relations",
+		rootID, "m.thread") + "?" + query.Encode()
+	var res respRelations
+	err := c.withAuth(func() error {
+		_, err := c.cli.MakeRequest("GET", u, nil, &res)
+		return err
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	es := make([]*Event, 0, len(res.Chunk))
+	for i := range res.Chunk {
+		e, err := r.timelineEvent(&res.Chunk[i])
+		if err != nil {
+			continue
+		}
+		e.SenderName = r.senderName(e.Sender)
+		es = append(es, e)
+	}
+	return reverseEvents(es), res.NextBatch, nil
+}
+
+// ThreadRootEvent returns the root event of a thread, from the events of the
+// room or the homeserver.
+func (c *Client) ThreadRootEvent(r *Room, rootID string) (*Event, error) {
+	if e := r.Events.Event(rootID); e != nil {
+		return e, nil
+	}
+	ctx, err := c.Context(r.ID(), rootID, 0)
+	if err != nil {
+		return nil, err
+	}
+	ctx.Event.SenderName = r.senderName(ctx.Event.Sender)
+	return ctx.Event, nil
+}
+
+// Event returns the event with the ID if it's in the list.
+func (evs *Events) Event(id string) *Event {
+	evs.rwm.RLock()
+	defer evs.rwm.RUnlock()
+	if e, ok := evs.ids[id]; ok {
+		return e.Value.(*Event)
+	}
+	return nil
+}
+
+type reqInReplyTo struct {
+	EventID string `json:"event_id"`
+}
+
+type reqThreadRelation struct {
+	RelType       string       `json:"rel_type"`
+	EventID       string       `json:"event_id"`
+	IsFallingBack bool         `json:"is_falling_back"`
+	InReplyTo     reqInReplyTo `json:"m.in_reply_to"`
+}
+
+// SendThreadText sends a text message to a thread.  For the clients without
+// threads, the message replies to the last one of the thread.
+func (c *Client) SendThreadText(r *Room, rootID, body string) error {
+	if rootID == "" {
+		return fmt.Errorf("No thread root")
+	}
+	replyTo := rootID
+	if t := r.Thread(rootID); t != nil && t.Latest != nil {
+		replyTo = t.Latest.ID
+	}
+	content := c.textContent(r, body)
+	content.RelatesTo = &reqThreadRelation{RelType: "m.thread", EventID: rootID,
+		IsFallingBack: true, InReplyTo: reqInReplyTo{EventID: replyTo}}
+	return c.withAuth(func() error {
+		_, err := c.cli.SendMessageEvent(r.ID(), "m.room.message", content)
+		return err
+	})
+}
@@ -0,0 +1,135 @@
+package morpheus
+
+import (
+	"fmt"
+	"strings"
+)
+
+// RoomLink separates in the Events of a room the history of its predecessor,
+// fetched when scrolling back past its creation.  The events before the link
+// belong to the room RoomID.
+type RoomLink struct {
+	RoomID string
+	// eventID is the last event of the predecessor, next the token of the
+	// history that follows the link
+	eventID, next string
+}
+
+// Tombstone is the m.room.tombstone of a room that has been upgraded.
+type Tombstone struct {
+	Body            string
+	ReplacementRoom string
+}
+
+// Predecessor returns the room that this room replaced and the last event in
+// it, from m.room.create, or empty strings if it has none.
+func (r *Room) Predecessor() (roomID, eventID string) {
+	return predecessor(r.State("m.room.create", ""))
+}
+
+func predecessor(create map[string]interface{}) (roomID, eventID string) {
+	pred, ok := create["predecessor"].(map[string]interface{})
+	if !ok {
+		return "", ""
+	}
+	roomID, _ = pred["room_id"].(string)
+	eventID, _ = pred["event_id"].(string)
+	return roomID, eventID
+}
+
+// Tombstone returns the tombstone of the room, or nil if it hasn't been
+// upgraded.
+func (r *Room) Tombstone() *Tombstone {
+	content := r.State("m.room.tombstone", "")
+	replacement, _ := content["replacement_room"].(string)
+	if replacement == "" {
+		return nil
+	}
+	body, _ := content["body"].(string)
+	return &Tombstone{Body: body, ReplacementRoom: replacement}
+}
+
+// Successor returns the room that replaced this one, if we have it.
+func (r *Room) Successor() *Room {
+	if t := r.Tombstone(); t != nil {
+		return r.Rooms.ByID(t.ReplacementRoom)
+	}
+	return nil
+}
+
+// Replaced returns true if the room has been upgraded and we joined the new
+// room.
+func (r *Room) Replaced() bool {
+	s := r.Successor()
+	return s != nil && s.Mem() == MemJoin
+}
+
+// frontRoomID returns the room whose history is at the front of the Events
+// of r: the oldest predecessor reached by GetPrevEvents, or r.
+func (r *Room) frontRoomID() string {
+	r.Events.rwm.RLock()
+	defer r.Events.rwm.RUnlock()
+	for e := r.Events.l.Front(); e != nil; e = e.Next() {
+		if link, ok := e.Value.(*RoomLink); ok {
+			return link.RoomID
+		}
+	}
+	return r.ID()
+}
+
+// predecessorOf returns the predecessor of a room, asking the homeserver for
+// the rooms that we don't have.
+func (c *Client) predecessorOf(roomID string) (predRoomID, eventID string) {
+	if r := c.Rs.ByID(roomID); r != nil {
+		return r.Predecessor()
+	}
+	var create map[string]interface{}
+	err := c.withAuth(func() error {
+		return c.cli.StateEvent(roomID, "m.room.create", "", &create)
+	})
+	if err != nil {
+		return "", ""
+	}
+	return predecessor(create)
+}
+
+// predecessorHistory starts the history of the predecessor of roomID at the
+// front of r, returning false if it has none or it can't be read.
+func (c *Client) predecessorHistory(r *Room, roomID string) bool {
+	predRoomID, eventID := c.predecessorOf(roomID)
+	if predRoomID == "" || eventID == "" {
+		return false
+	}
+	var res respContext
+	err := c.withAuth(func() error {
+		_, err := c.cli.MakeRequest("GET", c.cli.BuildURLWithQuery(
+			[]string{"rooms", predRoomID, "context", eventID},
+			map[string]string{"limit": "0"}), nil, &res)
+		return err
+	})
+	if err != nil || res.End == "" {
+		c.DebugPrint("predecessor", predRoomID, ":", err)
+		return false
+	}
+	var next Token
+	if front := r.Events.Front(); front != nil {
+		next, _ = front.Value.(Token)
+	}
+	r.Events.PushFront(&RoomLink{RoomID: predRoomID, eventID: eventID, next: string(next)})
+	r.PushFrontToken(res.End)
+	return true
+}
+
+// JoinReplacement joins the room that replaced an upgraded room.
+func (c *Client) JoinReplacement(r *Room) error {
+	t := r.Tombstone()
+	if t == nil {
+		return fmt.Errorf("Room %s has not been upgraded", r.ID())
+	}
+	// Join through the server of the new room, we may not share others
+	var via []string
+	if i := strings.Index(t.ReplacementRoom, ":"); i != -1 {
+		via = []string{t.ReplacementRoom[i+1:]}
+	}
+	return c.JoinRoomVia(t.ReplacementRoom, via)
+}
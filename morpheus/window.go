@@ -0,0 +1,322 @@
+package morpheus
+
+import (
+	"../list"
+	"fmt"
+	"github.com/matrix-org/gomatrix"
+)
+
+// DefaultMaxRoomEvents is the number of events kept in memory per room when
+// the config doesn't set MaxRoomEvents.
+const DefaultMaxRoomEvents = 1000
+
+// The events of a room are a window of its timeline of at most
+// MaxRoomEvents events, delimited by tokens to extend it in both directions.
+// When the window is at the end of the timeline (HasLastMsg) the new events
+// from the sync are appended to it, and the oldest ones are dropped while
+// the room follows new events.  Otherwise, or if the room doesn't follow new
+// events and the window would grow past the limit, the events from the sync
+// are notified but not stored, and they are fetched with GetNextEvents.
+// When the newest events dropped include the history of the room after a
+// RoomLink, GetNextEvents continues in the predecessor up to the link.
+
+func (c *Client) maxRoomEvents() int {
+	if c.cfg.MaxRoomEvents > 0 {
+		return c.cfg.MaxRoomEvents
+	}
+	return DefaultMaxRoomEvents
+}
+
+func (evs *Events) clearBack(n int) bool {
+	evs.rwm.Lock()
+	defer evs.rwm.Unlock()
+	cnt := 0
+	remove := false
+	e := evs.l.Front()
+	for ; e != nil; e = e.Next() {
+		switch e.Value.(type) {
+		case Token:
+			if cnt >= n {
+				remove = true
+			}
+		case *Event:
+			cnt++
+		}
+		if remove {
+			break
+		}
+	}
+	if remove {
+		// The links dropped tell where the history continues
+		var links []*RoomLink
+		next := e.Next()
+		for next != nil {
+			nextNext := next.Next()
+			if link, ok := next.Value.(*RoomLink); ok {
+				links = append(links, link)
+			}
+			evs.remove(next)
+			next = nextNext
+		}
+		evs.cutLinks = append(links, evs.cutLinks...)
+	}
+	evs.len = cnt
+	return remove
+}
+
+// nextLink returns the first RoomLink dropped with the newest events, the one
+// whose predecessor has the events at the back, or nil.
+func (evs *Events) nextLink() *RoomLink {
+	evs.rwm.RLock()
+	defer evs.rwm.RUnlock()
+	if len(evs.cutLinks) == 0 {
+		return nil
+	}
+	return evs.cutLinks[0]
+}
+
+// pushNextLink ends the history of the predecessor at the back, continuing
+// with the history after its link.
+func (evs *Events) pushNextLink() {
+	evs.rwm.Lock()
+	defer evs.rwm.Unlock()
+	link := evs.cutLinks[0]
+	evs.cutLinks = evs.cutLinks[1:]
+	evs.l.PushBack(link)
+	evs.l.PushBack(Token(link.next))
+}
+
+// remove removes an element of the list, with the event ID if it's an
+// event.  It must be called with the lock held.
+func (evs *Events) remove(elem *list.Element) {
+	if ev, ok := elem.Value.(*Event); ok && evs.ids[ev.ID] == elem {
+		delete(evs.ids, ev.ID)
+	}
+	evs.l.Remove(elem)
+}
+
+// reset drops all the events, tokens and links.
+func (evs *Events) reset() {
+	evs.rwm.Lock()
+	defer evs.rwm.Unlock()
+	evs.l.Init()
+	evs.ids = make(map[string]*list.Element)
+	evs.len = 0
+	evs.cutLinks = nil
+}
+
+// hasEvent returns true if an event with the ID is in the list.
+func (evs *Events) hasEvent(id string) bool {
+	return evs.Event(id) != nil
+}
+
+// SetFollow tells if the room follows new events, that is, if the UI shows
+// the end of its timeline.
+func (r *Room) SetFollow(follow bool) {
+	r.rwm.Lock()
+	r.follow = follow
+	r.rwm.Unlock()
+}
+
+// AtEnd returns true if the window reaches the end of the timeline, that is,
+// HasLastMsg read with the room locked.
+func (r *Room) AtEnd() bool {
+	r.rwm.RLock()
+	defer r.rwm.RUnlock()
+	return r.HasLastMsg
+}
+
+// ClearBackEvents drops the newest events of the room keeping at least n, so
+// that the window doesn't reach the end of the timeline anymore.
+func (r *Room) ClearBackEvents(n int) {
+	r.timelineMux.Lock()
+	defer r.timelineMux.Unlock()
+	if r.Events.clearBack(n) {
+		r.rwm.Lock()
+		r.HasLastMsg = false
+		r.rwm.Unlock()
+	}
+}
+
+// timelineEvent decrypts and parses a timeline event, evaluates the push rules
+// on it and adds it to the summary of its thread.
+func (r *Room) timelineEvent(ev *gomatrix.Event) (*Event, error) {
+	// The events fetched from predecessors have their room ID
+	roomID := ev.RoomID
+	if roomID == "" {
+		roomID = r.ID()
+	}
+	ev = r.Rooms.client.decrypt(roomID, ev)
+	e, err := newEvent(ev)
+	if err != nil {
+		return nil, err
+	}
+	e.PushActions = r.pushActions(&pushEvent{Type: ev.Type, Sender: ev.Sender,
+		StateKey: ev.StateKey, Content: ev.Content})
+	r.updateThreads(ev, e)
+	return e, nil
+}
+
+// notifyEvent publishes a timeline event that is not stored in the room.
+func (r *Room) notifyEvent(ev *gomatrix.Event) {
+	e, err := r.timelineEvent(ev)
+	if err != nil {
+		return
+	}
+	e.SenderName = r.senderName(ev.Sender)
+	r.Rooms.client.indexEvent(r, e)
+	r.Rooms.publish(BusEvent{Type: BusMessage, Room: r, Event: e})
+}
+
+// pushTimeline adds the timeline of a sync to the room, if its window is at
+// the end of the timeline.  The events missing before a limited timeline are
+// marked with a Gap.
+func (r *Room) pushTimeline(prevBatch string, limited bool, events []gomatrix.Event,
+	nextBatch string) {
+	max := r.Rooms.client.maxRoomEvents()
+	r.timelineMux.Lock()
+	defer r.timelineMux.Unlock()
+	r.rwm.Lock()
+	follow := r.follow
+	store := r.HasLastMsg && (follow || r.Events.Len()+len(events) <= max)
+	detached := r.HasLastMsg && !store
+	if detached {
+		r.HasLastMsg = false
+	}
+	r.rwm.Unlock()
+	if detached {
+		r.Rooms.publish(BusEvent{Type: BusUpdateRoom, Room: r, State: RoomStateEvents})
+	}
+	if !store {
+		for i := range events {
+			r.notifyEvent(&events[i])
+			if events[i].StateKey != nil {
+				r.updateState(&events[i])
+			}
+		}
+		return
+	}
+	if limited {
+		if gap := r.pushGap(prevBatch); gap != nil && r.Rooms.client.cfg.FillGaps {
+			go r.Rooms.client.fillGapBackground(r, gap)
+		}
+	}
+	r.PushToken(prevBatch)
+	for i := range events {
+		// The events fetched by GetNextEvents may overlap with the sync
+		if !r.Events.hasEvent(events[i].ID) {
+			r.PushEvent(&events[i])
+		}
+		if events[i].StateKey != nil {
+			r.updateState(&events[i])
+		}
+	}
+	r.PushToken(nextBatch)
+	if follow && r.Events.Len() > max {
+		r.ClearFrontEvents(max)
+		r.Rooms.publish(BusEvent{Type: BusUpdateRoom, Room: r, State: RoomStateEvents})
+	}
+}
+
+// GetNextEvents fetches up to num events after the last one of the room, for
+// the rooms whose window doesn't reach the end of the timeline.  The events
+// were notified when they arrived, so they are stored without publishing them
+// again.  The oldest events are dropped if the window grows past
+// MaxRoomEvents.
+func (c *Client) GetNextEvents(r *Room, num uint) (uint, error) {
+	r.ExpBackoff.Wait()
+	r.timelineMux.Lock()
+	defer r.timelineMux.Unlock()
+	if r.HasLastMsg {
+		return 0, nil
+	}
+	back := r.Events.Back()
+	if back == nil {
+		r.ExpBackoff.Inc()
+		return 0, fmt.Errorf("Events is empty")
+	}
+	token, ok := back.Value.(Token)
+	if !ok {
+		r.ExpBackoff.Inc()
+		return 0, fmt.Errorf("Bottom Event is not a token")
+	}
+	roomID := r.ID()
+	link := r.Events.nextLink()
+	if link != nil {
+		roomID = link.RoomID
+	}
+	var resMessages *gomatrix.RespMessages
+	err := c.withAuth(func() (err error) {
+		resMessages, err = c.cli.Messages(roomID, string(token), "", 'f', int(num))
+		return err
+	})
+	if err != nil {
+		r.ExpBackoff.Inc()
+		return 0, err
+	}
+	r.ExpBackoff.Reset()
+	count := uint(0)
+	linkReached := false
+	for i := range resMessages.Chunk {
+		ev := &resMessages.Chunk[i]
+		if !r.Events.hasEvent(ev.ID) {
+			if _, err := r.storeEvent(roomID, ev); err == nil {
+				count++
+			}
+		}
+		// The history of the predecessor ends with its tombstone
+		if link != nil && ev.ID == link.eventID {
+			linkReached = true
+			break
+		}
+	}
+	if resMessages.End != "" {
+		r.PushToken(resMessages.End)
+	}
+	if link != nil {
+		if linkReached || len(resMessages.Chunk) < int(num) {
+			r.Events.pushNextLink()
+		}
+	} else if len(resMessages.Chunk) < int(num) {
+		r.rwm.Lock()
+		r.HasLastMsg = true
+		r.rwm.Unlock()
+	}
+	if max := c.maxRoomEvents(); r.Events.Len() > max {
+		r.ClearFrontEvents(max)
+	}
+	return count, nil
+}
+
+// JumpToEvent replaces the events of the room with up to limit events around
+// the event eventID, which must belong to the room and not to a predecessor.
+// The window is then in the middle of the timeline, extended with
+// GetPrevEvents and GetNextEvents from the tokens around it.  Like
+// GetNextEvents, the events are stored without publishing them.
+func (c *Client) JumpToEvent(r *Room, eventID string, limit int) error {
+	res, err := c.context(r.ID(), eventID, limit)
+	if err != nil {
+		return err
+	}
+	events := make([]gomatrix.Event, 0, len(res.EventsBefore)+1+len(res.EventsAfter))
+	// events_before is in reverse chronological order
+	for i := len(res.EventsBefore) - 1; i >= 0; i-- {
+		events = append(events, res.EventsBefore[i])
+	}
+	events = append(events, res.Event)
+	events = append(events, res.EventsAfter...)
+	r.timelineMux.Lock()
+	defer r.timelineMux.Unlock()
+	r.Events.reset()
+	r.rwm.Lock()
+	r.HasFirstMsg = false
+	r.HasLastMsg = false
+	r.follow = false
+	r.rwm.Unlock()
+	r.PushToken(res.Start)
+	for i := range events {
+		r.storeEvent(r.ID(), &events[i])
+	}
+	r.PushToken(res.End)
+	return nil
+}
@@ -0,0 +1,66 @@
+package morpheus
+
+import (
+	"testing"
+)
+
+// checkEventIDs checks that the events found by ID are the ones in the list.
+func checkEventIDs(t *testing.T, evs *Events, step string) {
+	n := 0
+	for e := evs.l.Front(); e != nil; e = e.Next() {
+		if ev, ok := e.Value.(*Event); ok {
+			n++
+			if evs.Event(ev.ID) != ev {
+				t.Errorf("%s: Event(%s) not found", step, ev.ID)
+			}
+		}
+	}
+	if len(evs.ids) != n {
+		t.Errorf("%s: %d event IDs, want %d", step, len(evs.ids), n)
+	}
+}
+
+func TestEventsIDs(t *testing.T) {
+	evs := NewEvents()
+	evs.PushBack(Token("t0"))
+	for _, id := range []string{"$1", "$2"} {
+		evs.PushBackEvent(&Event{ID: id})
+	}
+	evs.PushBack(Token("t1"))
+	gap := &Gap{From: "t1", To: "t2"}
+	evs.PushBack(gap)
+	evs.PushBack(Token("t2"))
+	for _, id := range []string{"$5", "$6"} {
+		evs.PushBackEvent(&Event{ID: id})
+	}
+	evs.PushBack(Token("t3"))
+	evs.PushFrontEvent(&Event{ID: "$0"})
+	checkEventIDs(t, &evs, "push")
+
+	// The gap is closed when reaching $2
+	count, closed := evs.fillGap(gap, []*Event{{ID: "$4"}, {ID: "$3"}, {ID: "$2"}}, "t1")
+	if count != 2 || !closed {
+		t.Errorf("fillGap = %d, %v, want 2, true", count, closed)
+	}
+	checkEventIDs(t, &evs, "fillGap")
+
+	evs.clearFront(2)
+	if evs.Event("$0") != nil || evs.Event("$1") != nil || evs.Event("$6") == nil {
+		t.Errorf("clearFront(2) kept the wrong events")
+	}
+	checkEventIDs(t, &evs, "clearFront")
+
+	evs.PushBackEvent(&Event{ID: "$7"})
+	evs.PushBack(Token("t4"))
+	evs.clearBack(1)
+	if evs.Event("$7") != nil || evs.Event("$6") == nil {
+		t.Errorf("clearBack(1) kept the wrong events")
+	}
+	checkEventIDs(t, &evs, "clearBack")
+
+	evs.reset()
+	if evs.hasEvent("$6") {
+		t.Errorf("hasEvent($6) after reset")
+	}
+	checkEventIDs(t, &evs, "reset")
+}
@@ -0,0 +1,369 @@
+package main
+
+import (
+	"fmt"
+	"github.com/mattn/go-runewidth"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// highlightCode colors the code blocks by language.  Set by HighlightCode in
+// the config file, true by default.
+var highlightCode = true
+
+// noWrapMark starts the lines of text that printMessage truncates instead of
+// wrapping, like the lines of code.  The control characters are removed from
+// the messages, so it can't come from them.
+const noWrapMark = "\x00"
+
+// The colors of the code
+const (
+	codeColorDefault = 252
+	codeColorKeyword = 170
+	codeColorType    = 38
+	codeColorString  = 114
+	codeColorNumber  = 173
+	codeColorComment = 244
+	codeColorAdded   = 114
+	codeColorRemoved = 203
+)
+
+// codeLang is the syntax of a language, enough to color it line by line
+type codeLang struct {
+	keywords     map[string]bool
+	types        map[string]bool
+	lineComments []string
+	// blockComment are the start and end of block comments, if it has them
+	blockComment [2]string
+	// quotes start the strings, longest first
+	quotes []string
+	// multiline are the quotes of the strings that can span lines
+	multiline map[string]bool
+	// caseInsensitive languages list their keywords and types in lower case
+	caseInsensitive bool
+}
+
+func words(s string) map[string]bool {
+	m := make(map[string]bool)
+	for _, w := range strings.Fields(s) {
+		m[w] = true
+	}
+	return m
+}
+
+var cLike = codeLang{
+	lineComments: []string{"//"},
+	blockComment: [2]string{"/*", "*/"},
+	quotes:       []string{`"`, `'`},
+}
+
+func newLang(base codeLang, keywords, types string) *codeLang {
+	l := base
+	l.keywords = words(keywords)
+	l.types = words(types)
+	return &l
+}
+
+var codeLangs = map[string]*codeLang{
+	"go": newLang(codeLang{lineComments: []string{"//"}, blockComment: [2]string{"/*", "*/"},
+		quotes: []string{"`", `"`, `'`}, multiline: words("`")},
+		"break case chan const continue default defer else fallthrough for func go goto "+
+			"if import interface map package range return select struct switch type var",
+		"bool byte complex64 complex128 error float32 float64 int int8 int16 int32 int64 "+
+			"rune string uint uint8 uint16 uint32 uint64 uintptr any true false iota nil "+
+			"append cap close copy delete len make new panic print println recover"),
+	"python": newLang(codeLang{lineComments: []string{"#"},
+		quotes:    []string{`"""`, `'''`, `"`, `'`},
+		multiline: words(`""" '''`)},
+		"and as assert async await break class continue def del elif else except finally "+
+			"for from global if import in is lambda nonlocal not or pass raise return try "+
+			"while with yield",
+		"True False None self int float str bytes bool list dict set tuple object "+
+			"print len range open super isinstance Exception"),
+	"javascript": newLang(codeLang{lineComments: []string{"//"},
+		blockComment: [2]string{"/*", "*/"}, quotes: []string{"`", `"`, `'`},
+		multiline: words("`")},
+		"async await break case catch class const continue debugger default delete do "+
+			"else export extends finally for from function if import in instanceof let new "+
+			"of return static super switch this throw try typeof var void while with yield "+
+			"interface type enum implements private public protected readonly",
+		"true false null undefined NaN Infinity Array Object String Number Boolean "+
+			"Promise Map Set console string number boolean any void never unknown"),
+	"c": newLang(cLike,
+		"break case const continue default do else enum extern for goto if inline "+
+			"register return sizeof static struct switch typedef union volatile while "+
+			"#include #define #ifdef #ifndef #endif #if #else #pragma",
+		"char double float int long short signed unsigned void bool size_t NULL true false "+
+			"int8_t int16_t int32_t int64_t uint8_t uint16_t uint32_t uint64_t"),
+	"cpp": newLang(cLike,
+		"alignas auto break case catch class const constexpr continue default delete do "+
+			"else enum explicit extern for friend goto if inline mutable namespace new "+
+			"noexcept operator private protected public return sizeof static struct switch "+
+			"template this throw try typedef typename union using virtual volatile while "+
+			"#include #define #ifdef #ifndef #endif #if #else #pragma",
+		"bool char double float int long short signed unsigned void size_t nullptr true "+
+			"false std string vector map"),
+	"java": newLang(cLike,
+		"abstract assert break case catch class continue default do else enum extends "+
+			"final finally for if implements import instanceof interface native new package "+
+			"private protected public return static super switch synchronized this throw "+
+			"throws try var volatile while",
+		"boolean byte char double float int long short void String Object Integer true "+
+			"false null"),
+	"rust": newLang(codeLang{lineComments: []string{"//"}, blockComment: [2]string{"/*", "*/"},
+		quotes: []string{`"`}},
+		"as async await break const continue crate dyn else enum extern fn for if impl in "+
+			"let loop match mod move mut pub ref return self Self static struct super trait "+
+			"type unsafe use where while",
+		"bool char f32 f64 i8 i16 i32 i64 i128 isize str u8 u16 u32 u64 u128 usize String "+
+			"Vec Option Some None Result Ok Err Box true false"),
+	"bash": newLang(codeLang{lineComments: []string{"#"}, quotes: []string{`"`, `'`}},
+		"case do done elif else esac fi for function if in local return select then "+
+			"until while export readonly",
+		"echo cd exit set unset source alias test true false"),
+	"sql": newLang(codeLang{lineComments: []string{"--"}, blockComment: [2]string{"/*", "*/"},
+		quotes: []string{`'`, `"`}, caseInsensitive: true},
+		"select from where and or not insert into values update set delete create table "+
+			"drop alter index join left right inner outer on as group by order having limit "+
+			"offset union distinct primary key foreign references null is in like between "+
+			"case when then else end begin commit rollback",
+		"int integer bigint text varchar char boolean date timestamp real float"),
+	"json": newLang(codeLang{quotes: []string{`"`}}, "", "true false null"),
+	"yaml": newLang(codeLang{lineComments: []string{"#"}, quotes: []string{`"`, `'`}},
+		"", "true false null yes no on off"),
+}
+
+var codeLangAliases = map[string]string{
+	"golang": "go", "py": "python", "python3": "python", "js": "javascript",
+	"jsx": "javascript", "ts": "javascript", "tsx": "javascript",
+	"typescript": "javascript", "h": "c", "c++": "cpp", "cc": "cpp", "hpp": "cpp",
+	"rs": "rust", "sh": "bash", "shell": "bash", "zsh": "bash", "console": "bash",
+	"yml": "yaml", "postgresql": "sql", "mysql": "sql", "sqlite": "sql",
+}
+
+// renderCodeBlock returns the lines of a code block in the language lang
+// with escapes, highlighted if the language is known.
+func renderCodeBlock(lang, code string) []string {
+	lang = strings.ToLower(lang)
+	if alias, ok := codeLangAliases[lang]; ok {
+		lang = alias
+	}
+	lines := strings.Split(code, "\n")
+	if !highlightCode {
+		for i, line := range lines {
+			lines[i] = fmt.Sprintf("\x1b[38;5;%dm%s", htmlColorCode, line)
+		}
+		return lines
+	}
+	if lang == "diff" || lang == "patch" {
+		return highlightDiff(lines)
+	}
+	return codeLangs[lang].highlight(lines)
+}
+
+func highlightDiff(lines []string) []string {
+	for i, line := range lines {
+		color := codeColorDefault
+		switch {
+		case strings.HasPrefix(line, "+++") || strings.HasPrefix(line, "---"):
+			color = codeColorKeyword
+		case strings.HasPrefix(line, "+"):
+			color = codeColorAdded
+		case strings.HasPrefix(line, "-"):
+			color = codeColorRemoved
+		case strings.HasPrefix(line, "@@"):
+			color = codeColorType
+		}
+		lines[i] = fmt.Sprintf("\x1b[38;5;%dm%s", color, line)
+	}
+	return lines
+}
+
+// codeWriter writes code changing the color only when needed
+type codeWriter struct {
+	b     strings.Builder
+	color int
+}
+
+func (cw *codeWriter) write(color int, s string) {
+	if s == "" {
+		return
+	}
+	if color != cw.color {
+		cw.b.WriteString(fmt.Sprintf("\x1b[38;5;%dm", color))
+		cw.color = color
+	}
+	cw.b.WriteString(s)
+}
+
+func isIdentRune(c rune) bool {
+	return c == '_' || c == '#' || unicode.IsLetter(c) || unicode.IsDigit(c)
+}
+
+// highlight colors the lines of code, or only sets the default color if the
+// language is unknown (l is nil).  The comments and strings can go on in
+// the next lines.
+func (l *codeLang) highlight(lines []string) []string {
+	// open ends the comment or string that goes on, of color openColor
+	open := ""
+	openColor := 0
+	for i, line := range lines {
+		cw := &codeWriter{}
+		if l == nil {
+			cw.write(codeColorDefault, line)
+			lines[i] = cw.b.String()
+			continue
+		}
+		for j := 0; j < len(line); {
+			rest := line[j:]
+			if open != "" {
+				end := strings.Index(rest, open)
+				if end == -1 {
+					cw.write(openColor, rest)
+					break
+				}
+				cw.write(openColor, rest[:end+len(open)])
+				j += end + len(open)
+				open = ""
+				continue
+			}
+			if n := l.token(rest, cw, &open, &openColor); n != 0 {
+				j += n
+				continue
+			}
+			c, size := utf8.DecodeRuneInString(rest)
+			switch {
+			case unicode.IsDigit(c) && (j == 0 || !isIdentRune(rune(line[j-1]))):
+				n := len(rest) - len(strings.TrimLeftFunc(rest, func(c rune) bool {
+					return isIdentRune(c) || c == '.'
+				}))
+				cw.write(codeColorNumber, rest[:n])
+				j += n
+			case isIdentRune(c):
+				n := len(rest) - len(strings.TrimLeftFunc(rest, isIdentRune))
+				word := rest[:n]
+				key := word
+				if l.caseInsensitive {
+					key = strings.ToLower(word)
+				}
+				color := codeColorDefault
+				if l.keywords[key] {
+					color = codeColorKeyword
+				} else if l.types[key] {
+					color = codeColorType
+				}
+				cw.write(color, word)
+				j += n
+			default:
+				cw.write(codeColorDefault, rest[:size])
+				j += size
+			}
+		}
+		lines[i] = cw.b.String()
+	}
+	return lines
+}
+
+// token writes the comment or string that starts rest, returning its length,
+// or 0 if there's none.
+func (l *codeLang) token(rest string, cw *codeWriter, open *string, openColor *int) int {
+	for _, lc := range l.lineComments {
+		if strings.HasPrefix(rest, lc) {
+			cw.write(codeColorComment, rest)
+			return len(rest)
+		}
+	}
+	if start := l.blockComment[0]; start != "" && strings.HasPrefix(rest, start) {
+		cw.write(codeColorComment, start)
+		*open, *openColor = l.blockComment[1], codeColorComment
+		return len(start)
+	}
+	for _, q := range l.quotes {
+		if !strings.HasPrefix(rest, q) {
+			continue
+		}
+		if l.multiline[q] {
+			cw.write(codeColorString, q)
+			*open, *openColor = q, codeColorString
+			return len(q)
+		}
+		// The strings of one line end with the quote or the line
+		n := len(q)
+		for n < len(rest) {
+			if rest[n] == '\\' {
+				n += 2
+				continue
+			}
+			if strings.HasPrefix(rest[n:], q) {
+				n += len(q)
+				break
+			}
+			n++
+		}
+		if n > len(rest) {
+			n = len(rest)
+		}
+		cw.write(codeColorString, rest[:n])
+		return n
+	}
+	return 0
+}
+
+// truncateLine cuts a line with escapes to width columns, ending it with a
+// marker if it's longer, and returns it with its width.
+func truncateLine(line string, width int) (string, int) {
+	lineWidth := runewidth.StringWidth(line) - StringEscapeWidth(line)
+	if lineWidth <= width {
+		return line, lineWidth
+	}
+	var b strings.Builder
+	w := 0
+	esc := false
+	for _, c := range line {
+		if esc || c == '\x1b' {
+			b.WriteRune(c)
+			esc = c != 'm'
+			continue
+		}
+		cw := runewidth.RuneWidth(c)
+		if w+cw > width-1 {
+			break
+		}
+		b.WriteRune(c)
+		w += cw
+	}
+	b.WriteString(fmt.Sprintf("\x1b[38;5;%dm…\x1b[39m", codeColorComment))
+	return b.String(), w + 1
+}
+
+// fencedCode matches the fences of the code blocks in the plain bodies
+const fencedCode = "```"
+
+// renderFencedCode renders the fenced code blocks of a plain body, which are
+// not wrapped by printMessage.
+func renderFencedCode(body string) string {
+	if !strings.Contains(body, fencedCode) {
+		return body
+	}
+	lines := strings.Split(body, "\n")
+	out := make([]string, 0, len(lines))
+	for i := 0; i < len(lines); i++ {
+		trimmed := strings.TrimSpace(lines[i])
+		if !strings.HasPrefix(trimmed, fencedCode) {
+			out = append(out, lines[i])
+			continue
+		}
+		lang := strings.TrimSpace(strings.TrimPrefix(trimmed, fencedCode))
+		code := []string{}
+		for i++; i < len(lines) && !strings.HasPrefix(strings.TrimSpace(lines[i]),
+			fencedCode); i++ {
+			code = append(code, strings.Replace(lines[i], "\t", "    ", -1))
+		}
+		for _, line := range renderCodeBlock(lang, strings.Join(code, "\n")) {
+			out = append(out, fmt.Sprintf("%s\x1b[0m\x1b[38;5;%dm│\x1b[0m %s\x1b[0m",
+				noWrapMark, htmlColorQuote, line))
+		}
+	}
+	return strings.Join(out, "\n")
+}
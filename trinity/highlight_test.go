@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestTruncateLine(t *testing.T) {
+	tests := []struct {
+		line  string
+		width int
+		text  string
+		w     int
+	}{
+		{"short", 10, "short", 5},
+		{"exactly10!", 10, "exactly10!", 10},
+		{"a longer line", 10, "a longer …", 10},
+		{"\x1b[38;5;170mfunc\x1b[39m main()", 8, "func ma…", 8},
+		{"日本語のテキスト", 7, "日本語…", 7},
+		{"日本語のテキスト", 8, "日本語…", 7},
+		{"", 5, "", 0},
+	}
+	for _, test := range tests {
+		line, w := truncateLine(test.line, test.width)
+		if text := stripEscapes(line); text != test.text || w != test.w {
+			t.Errorf("truncateLine(%q, %d) = %q, %d, want %q, %d", test.line, test.width,
+				text, w, test.text, test.w)
+		}
+	}
+}
+
+func TestHighlightKeywords(t *testing.T) {
+	keyword := fmt.Sprintf("\x1b[38;5;%dm", codeColorKeyword)
+	tests := []struct {
+		lang, code, word string
+		keyword          bool
+	}{
+		{"go", "func main() {}", "func", true},
+		{"go", "Func main() {}", "Func", false},
+		{"sql", "select 1", "select", true},
+		{"sql", "SELECT 1", "SELECT", true},
+		{"sql", "Select 1", "Select", true},
+		{"sql", "selected 1", "selected", false},
+		{"postgresql", "WHERE x", "WHERE", true},
+	}
+	for _, test := range tests {
+		line := renderCodeBlock(test.lang, test.code)[0]
+		if colored := strings.Contains(line, keyword+test.word); colored != test.keyword {
+			t.Errorf("renderCodeBlock(%q, %q) = %q, keyword %q: %v, want %v", test.lang,
+				test.code, line, test.word, colored, test.keyword)
+		}
+	}
+}
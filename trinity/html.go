@@ -0,0 +1,436 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// renderHTML renders the org.matrix.custom.html formatted_body of messages.
+// Set by RenderHTML in the config file, true by default.
+var renderHTML = true
+
+// The colors of the rendered HTML
+const (
+	htmlColorCode    = 180
+	htmlColorLink    = 75
+	htmlColorPill    = 45
+	htmlColorQuote   = 244
+	htmlColorHeading = 222
+)
+
+// htmlList is a list being rendered
+type htmlList struct {
+	ordered bool
+	n       int
+}
+
+// htmlRenderer turns the HTML of a message into text with ANSI escapes that
+// printMessage can wrap: the escapes have no spaces and the blocks are
+// separated by new lines.  gocui only handles bold, underline, reverse and
+// colors, so italics are underlined and strikethrough uses a combining
+// character.  The tags and attributes not listed are dropped, keeping their
+// text.
+type htmlRenderer struct {
+	b strings.Builder
+	// Counters of the nested styles
+	bold, underline, reverse, strike int
+	colors                           []int
+	quote                            int
+	lists                            []htmlList
+	// skip is set inside the elements whose text is not shown
+	skip int
+	// atLineStart is true if nothing has been written after the last new
+	// line
+	atLineStart bool
+	// pendingSpace is a collapsed white space to write before the next
+	// text
+	pendingSpace bool
+	// The link being rendered and its text
+	hrefs    []string
+	linkText strings.Builder
+	// The code block being rendered
+	pre     int
+	preLang string
+	preText strings.Builder
+}
+
+// renderHTMLBody renders the formatted body of a message, whose text color
+// is baseColor (0 for the default one).
+func renderHTMLBody(body string, baseColor int) (string, error) {
+	hr := &htmlRenderer{colors: []int{baseColor}, atLineStart: true}
+	body = strings.Replace(body, "\t", "    ", -1)
+	d := xml.NewDecoder(strings.NewReader("<body>" + sanitize(body) + "</body>"))
+	d.Strict = false
+	d.AutoClose = xml.HTMLAutoClose
+	d.Entity = xml.HTMLEntity
+	for {
+		tok, err := d.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		switch tok := tok.(type) {
+		case xml.StartElement:
+			hr.start(strings.ToLower(tok.Name.Local), tok.Attr)
+		case xml.EndElement:
+			hr.end(strings.ToLower(tok.Name.Local))
+		case xml.CharData:
+			hr.text(string(tok))
+		}
+	}
+	return strings.TrimRight(hr.b.String(), " \n") + hr.sgr(), nil
+}
+
+func htmlAttr(attrs []xml.Attr, name string) string {
+	for _, attr := range attrs {
+		if strings.ToLower(attr.Name.Local) == name {
+			return attr.Value
+		}
+	}
+	return ""
+}
+
+// sanitize removes the control characters but the new lines from the HTML,
+// which could change the terminal.
+func sanitize(s string) string {
+	return strings.Map(func(c rune) rune {
+		switch {
+		case c == '\n':
+			return c
+		case unicode.IsControl(c):
+			return -1
+		}
+		return c
+	}, s)
+}
+
+// sgr returns the escape that sets the current style.
+func (hr *htmlRenderer) sgr() string {
+	s := "\x1b[0m"
+	if hr.bold > 0 {
+		s += "\x1b[1m"
+	}
+	if hr.underline > 0 {
+		s += "\x1b[4m"
+	}
+	if hr.reverse > 0 {
+		s += "\x1b[7m"
+	}
+	if color := hr.colors[len(hr.colors)-1]; color != 0 {
+		s += fmt.Sprintf("\x1b[38;5;%dm", color)
+	}
+	return s
+}
+
+func (hr *htmlRenderer) setStyle() {
+	hr.b.WriteString(hr.sgr())
+}
+
+func (hr *htmlRenderer) pushColor(color int) {
+	hr.colors = append(hr.colors, color)
+	hr.setStyle()
+}
+
+func (hr *htmlRenderer) popColor() {
+	if len(hr.colors) > 1 {
+		hr.colors = hr.colors[:len(hr.colors)-1]
+	}
+	hr.setStyle()
+}
+
+// prefix returns the start of the lines inside quotes and lists.
+func (hr *htmlRenderer) prefix() string {
+	if hr.quote == 0 && len(hr.lists) == 0 {
+		return ""
+	}
+	p := ""
+	if hr.quote > 0 {
+		p = fmt.Sprintf("\x1b[0m\x1b[38;5;%dm%s\x1b[0m",
+			htmlColorQuote, strings.Repeat("│", hr.quote)) + hr.sgr() + " "
+	}
+	if len(hr.lists) > 1 {
+		p += strings.Repeat("  ", len(hr.lists)-1)
+	}
+	return p
+}
+
+// newline ends the current line, if it has something.
+func (hr *htmlRenderer) newline() {
+	hr.pendingSpace = false
+	if hr.atLineStart {
+		return
+	}
+	hr.b.WriteString("\n")
+	hr.atLineStart = true
+}
+
+// write writes text, starting the line with the prefix.
+func (hr *htmlRenderer) write(s string) {
+	if s == "" {
+		return
+	}
+	if hr.atLineStart {
+		hr.b.WriteString(hr.prefix())
+		hr.atLineStart = false
+	} else if hr.pendingSpace {
+		hr.b.WriteString(" ")
+	}
+	hr.pendingSpace = false
+	hr.b.WriteString(s)
+}
+
+func (hr *htmlRenderer) text(s string) {
+	if hr.skip > 0 {
+		return
+	}
+	s = sanitize(s)
+	if hr.pre > 0 {
+		hr.preText.WriteString(s)
+		return
+	}
+	if len(hr.hrefs) > 0 {
+		hr.linkText.WriteString(s)
+	}
+	words := strings.Fields(s)
+	if len(words) == 0 {
+		if s != "" {
+			hr.pendingSpace = true
+		}
+		return
+	}
+	if unicode.IsSpace(rune(s[0])) {
+		hr.pendingSpace = true
+	}
+	for i, w := range words {
+		if hr.strike > 0 {
+			w = strikethrough(w)
+		}
+		if i != 0 {
+			hr.pendingSpace = true
+		}
+		hr.write(w)
+	}
+	if unicode.IsSpace(rune(s[len(s)-1])) {
+		hr.pendingSpace = true
+	}
+}
+
+// strikethrough strikes every character of a word with U+0336.
+func strikethrough(w string) string {
+	var b strings.Builder
+	for _, c := range w {
+		b.WriteRune(c)
+		b.WriteRune('̶')
+	}
+	return b.String()
+}
+
+// safeHref returns the link if it has a scheme that we show.
+func safeHref(href string) string {
+	href = strings.TrimSpace(sanitize(href))
+	for _, scheme := range []string{"https://", "http://", "mailto:", "matrix:"} {
+		if strings.HasPrefix(strings.ToLower(href), scheme) {
+			return strings.Replace(href, " ", "%20", -1)
+		}
+	}
+	return ""
+}
+
+// isPill returns true if the link is a mention of a user, room or alias.
+func isPill(href string) bool {
+	id := strings.TrimPrefix(href, "https://matrix.to/#/")
+	return id != href && id != "" && strings.ContainsAny(id[:1], "@!#")
+}
+
+func (hr *htmlRenderer) start(tag string, attrs []xml.Attr) {
+	if hr.skip > 0 {
+		switch tag {
+		case "mx-reply", "script", "style":
+			hr.skip++
+		}
+		return
+	}
+	switch tag {
+	case "mx-reply", "script", "style":
+		// The reply fallback quotes the message replied to
+		hr.skip++
+	case "b", "strong":
+		hr.bold++
+		hr.setStyle()
+	case "i", "em", "u", "ins":
+		hr.underline++
+		hr.setStyle()
+	case "del", "s", "strike":
+		hr.strike++
+	case "code":
+		if hr.pre > 0 {
+			class := htmlAttr(attrs, "class")
+			if strings.HasPrefix(class, "language-") {
+				hr.preLang = strings.TrimPrefix(class, "language-")
+			}
+			return
+		}
+		hr.pushColor(htmlColorCode)
+	case "pre":
+		hr.newline()
+		hr.pre++
+	case "a":
+		href := safeHref(htmlAttr(attrs, "href"))
+		hr.hrefs = append(hr.hrefs, href)
+		hr.linkText.Reset()
+		if isPill(href) {
+			hr.reverse++
+			hr.pushColor(htmlColorPill)
+		} else {
+			hr.underline++
+			hr.pushColor(htmlColorLink)
+		}
+	case "h1", "h2", "h3", "h4", "h5", "h6":
+		hr.newline()
+		hr.bold++
+		hr.pushColor(htmlColorHeading)
+		hr.write(strings.Repeat("#", int(tag[1]-'0')))
+		hr.pendingSpace = true
+	case "blockquote":
+		hr.newline()
+		hr.quote++
+	case "ul", "ol":
+		hr.newline()
+		l := htmlList{ordered: tag == "ol"}
+		// n counts the items written, from start
+		if start, err := strconv.Atoi(htmlAttr(attrs, "start")); err == nil && l.ordered {
+			l.n = start - 1
+		}
+		hr.lists = append(hr.lists, l)
+	case "li":
+		hr.newline()
+		if len(hr.lists) == 0 {
+			hr.write("•")
+		} else if l := &hr.lists[len(hr.lists)-1]; l.ordered {
+			l.n++
+			hr.write(fmt.Sprintf("%d.", l.n))
+		} else {
+			hr.write("•")
+		}
+		hr.pendingSpace = true
+	case "p", "div", "table", "tr":
+		hr.newline()
+	case "td", "th":
+		if !hr.atLineStart {
+			hr.write("│")
+			hr.pendingSpace = true
+		}
+	case "br":
+		if hr.atLineStart {
+			hr.write(" ")
+		}
+		hr.atLineStart = false
+		hr.newline()
+	case "hr":
+		hr.newline()
+		hr.write(strings.Repeat("─", 20))
+		hr.newline()
+	case "img":
+		alt := strings.TrimSpace(sanitize(htmlAttr(attrs, "alt")))
+		if alt == "" {
+			alt = "image"
+		}
+		hr.write(fmt.Sprintf("[%s]", alt))
+	}
+}
+
+func (hr *htmlRenderer) end(tag string) {
+	if hr.skip > 0 {
+		switch tag {
+		case "mx-reply", "script", "style":
+			hr.skip--
+		}
+		return
+	}
+	switch tag {
+	case "b", "strong":
+		if hr.bold > 0 {
+			hr.bold--
+		}
+		hr.setStyle()
+	case "i", "em", "u", "ins":
+		if hr.underline > 0 {
+			hr.underline--
+		}
+		hr.setStyle()
+	case "del", "s", "strike":
+		if hr.strike > 0 {
+			hr.strike--
+		}
+	case "code":
+		if hr.pre == 0 {
+			hr.popColor()
+		}
+	case "pre":
+		if hr.pre == 0 {
+			return
+		}
+		hr.pre--
+		if hr.pre == 0 {
+			hr.codeBlock()
+		}
+	case "a":
+		if len(hr.hrefs) == 0 {
+			return
+		}
+		href := hr.hrefs[len(hr.hrefs)-1]
+		hr.hrefs = hr.hrefs[:len(hr.hrefs)-1]
+		if isPill(href) {
+			hr.reverse--
+			hr.popColor()
+			return
+		}
+		hr.underline--
+		hr.popColor()
+		text := strings.TrimSpace(hr.linkText.String())
+		if href != "" && href != text && strings.TrimPrefix(href, "mailto:") != text {
+			hr.pendingSpace = true
+			hr.write(fmt.Sprintf("\x1b[38;5;%dm<%s>", htmlColorQuote, href) + hr.sgr())
+		}
+	case "h1", "h2", "h3", "h4", "h5", "h6":
+		if hr.bold > 0 {
+			hr.bold--
+		}
+		hr.popColor()
+		hr.newline()
+	case "blockquote":
+		hr.newline()
+		if hr.quote > 0 {
+			hr.quote--
+		}
+	case "ul", "ol":
+		hr.newline()
+		if len(hr.lists) > 0 {
+			hr.lists = hr.lists[:len(hr.lists)-1]
+		}
+	case "li", "p", "div", "table", "tr":
+		hr.newline()
+	}
+}
+
+// codeBlock writes the code block that ended, one line per line of code that
+// printMessage doesn't wrap.
+func (hr *htmlRenderer) codeBlock() {
+	code := strings.TrimRight(hr.preText.String(), "\n")
+	hr.preText.Reset()
+	lang := hr.preLang
+	hr.preLang = ""
+	hr.newline()
+	for _, line := range renderCodeBlock(lang, code) {
+		hr.b.WriteString(noWrapMark + hr.prefix() +
+			fmt.Sprintf("\x1b[0m\x1b[38;5;%dm│\x1b[0m %s", htmlColorQuote, line) +
+			hr.sgr() + "\n")
+	}
+	hr.atLineStart = true
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+)
+
+var escapeRegexp = regexp.MustCompile("\x1b\\[[0-9;]*m")
+
+// stripEscapes removes the ANSI escapes and the no wrap marks of a rendered
+// body, leaving its text.
+func stripEscapes(s string) string {
+	return strings.Replace(escapeRegexp.ReplaceAllString(s, ""), noWrapMark, "", -1)
+}
+
+func TestRenderHTMLBodyText(t *testing.T) {
+	tests := []struct {
+		body string
+		text string
+	}{
+		{"hello <b>world</b>", "hello world"},
+		{"a  \n  b", "a b"},
+		{"<p>one</p><p>two</p>", "one\ntwo"},
+		{"line<br>next", "line\nnext"},
+		{"<del>ab</del> <s>x</s>", "a̶b̶ x̶"},
+		{`<a href="https://example.org">site</a>`, "site <https://example.org>"},
+		{`<a href="https://example.org">https://example.org</a>`, "https://example.org"},
+		{`<a href="javascript:alert(1)">bad</a>`, "bad"},
+		{`<a href="https://matrix.to/#/@alice:example.org">Alice</a>: hi`, "Alice: hi"},
+		{"<blockquote>quoted<br>twice</blockquote>after", "│ quoted\n│ twice\nafter"},
+		{"<ul><li>a</li><li>b<ul><li>c</li></ul></li></ul>", "• a\n• b\n  • c"},
+		{"<ol><li>a</li><li>b</li></ol>", "1. a\n2. b"},
+		{`<ol start="3"><li>a</li><li>b</li></ol>`, "3. a\n4. b"},
+		{"<h1>Title</h1>text", "# Title\ntext"},
+		{"<mx-reply><blockquote>old</blockquote></mx-reply>new", "new"},
+		{"<script>x</script>ok", "ok"},
+		{"<unknown>kept</unknown>", "kept"},
+		{"a &amp; b &lt;c&gt;", "a & b <c>"},
+		{`<img alt="pic" src="mxc://x/y">`, "[pic]"},
+		{"<b>unclosed", "unclosed"},
+		{"a\x07b", "ab"},
+		{"<pre><code>a\n\tb\n</code></pre>", "│ a\n│     b"},
+	}
+	for _, test := range tests {
+		out, err := renderHTMLBody(test.body, 0)
+		if err != nil {
+			t.Errorf("renderHTMLBody(%q): %v", test.body, err)
+			continue
+		}
+		if text := stripEscapes(out); text != test.text {
+			t.Errorf("renderHTMLBody(%q) = %q, want %q", test.body, text, test.text)
+		}
+	}
+}
+
+func TestRenderHTMLBodyStyle(t *testing.T) {
+	tests := []struct {
+		body      string
+		baseColor int
+		out       string
+	}{
+		{"plain", 0, "plain\x1b[0m"},
+		{"plain", 7, "plain\x1b[0m\x1b[38;5;7m"},
+		{"<b>bold</b>", 0, "\x1b[0m\x1b[1mbold\x1b[0m\x1b[0m"},
+		{"<em>it</em>", 0, "\x1b[0m\x1b[4mit\x1b[0m\x1b[0m"},
+		{"<code>x</code>", 0, "\x1b[0m\x1b[38;5;180mx\x1b[0m\x1b[0m"},
+		{`<a href="https://matrix.to/#/@a:b">A</a>`, 0, "\x1b[0m\x1b[7m\x1b[38;5;45mA\x1b[0m\x1b[0m"},
+	}
+	for _, test := range tests {
+		out, err := renderHTMLBody(test.body, test.baseColor)
+		if err != nil {
+			t.Errorf("renderHTMLBody(%q): %v", test.body, err)
+			continue
+		}
+		if out != test.out {
+			t.Errorf("renderHTMLBody(%q, %d) = %q, want %q", test.body, test.baseColor,
+				out, test.out)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	mor "../morpheus"
+	"fmt"
+	//"github.com/jroimartin/gocui"
+	"../../gocui"
+	"strings"
+)
+
+// printInvite shows the invite of the room instead of its messages.
+func printInvite(v *gocui.View, r *mor.Room, inv *mor.Invite) {
+	lines := []string{"", fmt.Sprintf("\x1b[38;5;45m%s invited you to %s\x1b[0;0m",
+		inv.Inviter, r)}
+	if inv.IsDirect {
+		lines = append(lines, "This is a direct chat")
+	}
+	if inv.CanonAlias != "" {
+		lines = append(lines, "Alias:   "+inv.CanonAlias)
+	}
+	if inv.Topic != "" {
+		lines = append(lines, "Topic:   "+inv.Topic)
+	}
+	if inv.Members != 0 {
+		lines = append(lines, fmt.Sprintf("Members: %d known", inv.Members))
+	}
+	if inv.Reason != "" {
+		lines = append(lines, "Reason:  "+inv.Reason)
+	}
+	lines = append(lines, "", "\x1b[38;5;226mPress F2 to accept or F3 to decline\x1b[0;0m",
+		"(or /accept [roomID], /decline [roomID] [reason])")
+	fmt.Fprintln(v, strings.Join(lines, "\n"))
+	viewMsgsLines = len(lines) + 1
+}
+
+func acceptInvite(cli *mor.Client, roomID string) {
+	if err := cli.AcceptInvite(roomID); err != nil {
+		cli.ConsolePrint(mor.MsgTxtTypeNotice, "accept: ", err)
+	}
+}
+
+func declineInvite(cli *mor.Client, roomID, reason string) {
+	if err := cli.DeclineInvite(roomID, reason); err != nil {
+		cli.ConsolePrint(mor.MsgTxtTypeNotice, "decline: ", err)
+	}
+}
+
+func keyAcceptInvite(g *gocui.Gui, v *gocui.View) error {
+	if currentRoom.Invite() != nil {
+		go acceptInvite(roomCli(currentRoom), currentRoom.ID())
+	}
+	return nil
+}
+
+func keyDeclineInvite(g *gocui.Gui, v *gocui.View) error {
+	if currentRoom.Invite() != nil {
+		go declineInvite(roomCli(currentRoom), currentRoom.ID(), "")
+	}
+	return nil
+}
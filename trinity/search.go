@@ -0,0 +1,270 @@
+package main
+
+import (
+	mor "../morpheus"
+	"fmt"
+	//"github.com/jroimartin/gocui"
+	"../../gocui"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Number of events shown around every search result
+const searchContextLen = 1
+
+// Number of events loaded in the timeline around an event opened with
+// /context
+const contextLen = 10
+
+// searchState holds what the search view shows.  It's only accessed from
+// the gocui main loop.
+type searchState struct {
+	cli     *mor.Client
+	term    string
+	rooms   []string
+	count   int
+	results []mor.SearchResult
+	next    string
+	// local is the query of a search in the local index
+	local *mor.IndexQuery
+}
+
+var search *searchState
+
+// searchRoom returns the room used to show the senders of the events of
+// roomID.
+func searchRoom(cli *mor.Client, roomID string) *mor.Room {
+	if r := cli.Rs.ByID(roomID); r != nil {
+		return r
+	}
+	return cli.Rs.ConsoleRoom()
+}
+
+func cmdSearch(g *gocui.Gui, cli *mor.Client, args Args) {
+	if len(args.Args) == 1 {
+		// Show again the results hidden by /context
+		g.Update(func(g *gocui.Gui) error {
+			if search == nil {
+				cli.ConsolePrintf(mor.MsgTxtTypeText,
+					"Usage: %s [term... | more | close]", args.Args[0])
+				return nil
+			}
+			return showSearch(g)
+		})
+		return
+	}
+	switch args.Args[1] {
+	case "close":
+		g.Update(closeSearch)
+		return
+	case "more":
+		g.Update(func(g *gocui.Gui) error {
+			s := search
+			if s == nil || s.next == "" {
+				cli.ConsolePrint(mor.MsgTxtTypeText, "search: no more results")
+				return nil
+			}
+			go searchPage(g, s, s.next)
+			return nil
+		})
+		return
+	}
+	s := &searchState{cli: cli, term: strings.Join(args.Args[1:], " ")}
+	// Search in all the rooms from the console
+	if args.Room != args.Room.Rooms.ConsoleRoom() {
+		s.rooms = []string{args.Room.ID()}
+	}
+	searchPage(g, s, "")
+}
+
+// parseIndexQuery parses the arguments of /lsearch: words, and the filters
+// from:userID, room:roomID, after:YYYY-MM-DD and before:YYYY-MM-DD
+func parseIndexQuery(args []string) (*mor.IndexQuery, error) {
+	q := &mor.IndexQuery{}
+	terms := []string{}
+	for _, arg := range args {
+		var err error
+		switch {
+		case strings.HasPrefix(arg, "from:"):
+			q.Senders = append(q.Senders, strings.TrimPrefix(arg, "from:"))
+		case strings.HasPrefix(arg, "room:"):
+			q.Rooms = append(q.Rooms, strings.TrimPrefix(arg, "room:"))
+		case strings.HasPrefix(arg, "after:"):
+			q.Since, err = time.ParseInLocation("2006-01-02",
+				strings.TrimPrefix(arg, "after:"), time.Local)
+		case strings.HasPrefix(arg, "before:"):
+			q.Until, err = time.ParseInLocation("2006-01-02",
+				strings.TrimPrefix(arg, "before:"), time.Local)
+		default:
+			terms = append(terms, arg)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	q.Terms = strings.Join(terms, " ")
+	return q, nil
+}
+
+func cmdLocalSearch(g *gocui.Gui, cli *mor.Client, args Args) {
+	if len(args.Args) == 1 {
+		cli.ConsolePrintf(mor.MsgTxtTypeText,
+			"Usage: %s word... [from:userID] [room:roomID] [after:YYYY-MM-DD] [before:YYYY-MM-DD]",
+			args.Args[0])
+		return
+	}
+	q, err := parseIndexQuery(args.Args[1:])
+	if err != nil {
+		cli.ConsolePrint(mor.MsgTxtTypeNotice, "lsearch: ", err)
+		return
+	}
+	if len(q.Rooms) == 0 && args.Room != args.Room.Rooms.ConsoleRoom() {
+		q.Rooms = []string{args.Room.ID()}
+	}
+	s := &searchState{cli: cli, term: strings.Join(args.Args[1:], " "), local: q}
+	searchPage(g, s, "")
+}
+
+func searchPage(g *gocui.Gui, s *searchState, nextBatch string) {
+	var res *mor.SearchResults
+	var err error
+	if s.local != nil {
+		res, err = s.cli.SearchLocal(s.local)
+	} else {
+		res, err = s.cli.Search(s.term, s.rooms, nil, searchContextLen, nextBatch)
+	}
+	if err != nil {
+		s.cli.ConsolePrint(mor.MsgTxtTypeNotice, "search: ", err)
+		return
+	}
+	g.Update(func(g *gocui.Gui) error {
+		s.count = res.Count
+		s.results = append(s.results, res.Results...)
+		s.next = res.NextBatch
+		search = s
+		return showSearch(g)
+	})
+}
+
+func cmdContext(g *gocui.Gui, cli *mor.Client, args Args) {
+	var n int
+	var err error
+	if len(args.Args) == 2 {
+		n, err = strconv.Atoi(args.Args[1])
+	}
+	if len(args.Args) != 2 || err != nil {
+		cli.ConsolePrintf(mor.MsgTxtTypeText, "Usage: %s N", args.Args[0])
+		return
+	}
+	g.Update(func(g *gocui.Gui) error {
+		s := search
+		if s == nil || n < 1 || n > len(s.results) {
+			cli.ConsolePrintf(mor.MsgTxtTypeText, "context: no search result %d", n)
+			return nil
+		}
+		result := s.results[n-1]
+		r := s.cli.Rs.ByID(result.RoomID)
+		if r == nil {
+			cli.ConsolePrintf(mor.MsgTxtTypeText, "context: not in room %s", result.RoomID)
+			return nil
+		}
+		go func() {
+			if err := s.cli.JumpToEvent(r, result.Event.ID, contextLen); err != nil {
+				s.cli.ConsolePrint(mor.MsgTxtTypeNotice, "context: ", err)
+				return
+			}
+			g.Update(func(g *gocui.Gui) error {
+				return jumpToEvent(g, r, result.Event.ID)
+			})
+		}()
+		return nil
+	})
+}
+
+// jumpToEvent shows the window loaded around an event in the timeline of its
+// room, hiding the search results.
+func jumpToEvent(g *gocui.Gui, r *mor.Room, eventID string) error {
+	roomUI := getRoomUI(r)
+	roomUI.JumpEventID = eventID
+	roomUI.jumpPending = true
+	roomUI.ScrollBottom = false
+	if err := g.DeleteView("search"); err != nil && err != gocui.ErrUnknownView {
+		return err
+	}
+	if currentRoom != r {
+		setCurrentRoom(r, false)
+		return nil
+	}
+	scrollBottom = false
+	printView(g, "msgs")
+	return nil
+}
+
+func setSearchView(g *gocui.Gui) (*gocui.View, error) {
+	maxX, _ := g.Size()
+	v, err := g.SetView("search", viewRoomsWidth, -1, maxX-viewUsersWidth, viewMsgsHeight)
+	if err != nil && err != gocui.ErrUnknownView {
+		return nil, err
+	}
+	v.Frame = true
+	g.SetViewOnTop("search")
+	g.SetViewOnTop("statusline")
+	return v, nil
+}
+
+func showSearch(g *gocui.Gui) error {
+	v, err := setSearchView(g)
+	if err != nil {
+		return err
+	}
+	v.Clear()
+	v.SetOrigin(0, 0)
+	s := search
+	v.Title = fmt.Sprintf("Search \"%s\": %d results (/context N, /search more, /search close)",
+		s.term, s.count)
+	for i, result := range s.results {
+		r := searchRoom(s.cli, result.RoomID)
+		fmt.Fprintf(v, "\x1b[38;5;45m%d. %s\x1b[0;0m\n", i+1, r)
+		printEventContext(v, r, result.Before, result.Event, result.After)
+		fmt.Fprintln(v)
+	}
+	if s.next != "" {
+		fmt.Fprintf(v, "\x1b[38;5;45m--- /search more ---\x1b[0;0m\n")
+	}
+	return nil
+}
+
+// printEventContext prints e highlighted between the events around it.
+func printEventContext(v *gocui.View, r *mor.Room, before []*mor.Event, e *mor.Event,
+	after []*mor.Event) {
+	for _, ev := range before {
+		printMessage(v, ev, r)
+	}
+	highlighted := *e
+	highlighted.Highlight = true
+	printMessage(v, &highlighted, r)
+	for _, ev := range after {
+		printMessage(v, ev, r)
+	}
+}
+
+func closeSearch(g *gocui.Gui) error {
+	search = nil
+	if err := g.DeleteView("search"); err != nil && err != gocui.ErrUnknownView {
+		return err
+	}
+	return nil
+}
+
+// scrollViewSearch scrolls the search view if it's open and returns false
+// otherwise.
+func scrollViewSearch(g *gocui.Gui, l int) bool {
+	v, err := g.View("search")
+	if err != nil {
+		return false
+	}
+	_, y := v.Origin()
+	v.SetOrigin(0, max(y+l, 0))
+	return true
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	mor "../morpheus"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// spaceSets returns the sections of a space and of its nested spaces, with the
+// joined and invited children of each one.  The rooms already listed in seen
+// are skipped, which also breaks cycles of spaces.
+func spaceSets(rs *mor.Rooms, space *mor.Room, depth int, seen map[*mor.Room]bool) []roomSet {
+	seen[space] = true
+	set := roomSet{Title: space.String(), Rooms: make([]*mor.Room, 0), Space: space,
+		Depth: depth}
+	nested := []*mor.Room{}
+	for _, child := range space.SpaceChildren() {
+		r := rs.ByID(child.RoomID)
+		if r == nil || seen[r] || (r.Mem() != mor.MemJoin && r.Mem() != mor.MemInvite) ||
+			(r.Replaced() && !showUpgradedRooms) {
+			continue
+		}
+		seen[r] = true
+		// The nested spaces are listed too, to select them
+		set.Rooms = append(set.Rooms, r)
+		if r.IsSpace() && r.Mem() == mor.MemJoin {
+			nested = append(nested, r)
+		}
+	}
+	sortRooms(set.Rooms)
+	sets := []roomSet{set}
+	for _, s := range nested {
+		sets = append(sets, spaceSets(rs, s, depth+1, seen)...)
+	}
+	return sets
+}
+
+// selectSpace filters the room list of an account to the rooms of a space,
+// or lists all the rooms if space is nil.
+func selectSpace(rs *mor.Rooms, space *mor.Room) {
+	getRoomsUI(rs).SetSpace(space)
+	UpdateShortcuts()
+}
+
+// topSpaces returns the spaces of the "Spaces" section: the ones without
+// parents, and one of each cycle of spaces that are parents of each other,
+// which are not nested in any of those.
+func topSpaces(rs *mor.Rooms, spaces []*mor.Room) []*mor.Room {
+	top := make([]*mor.Room, 0)
+	nested := make(map[*mor.Room]bool)
+	var nest func(s *mor.Room)
+	nest = func(s *mor.Room) {
+		if nested[s] {
+			return
+		}
+		nested[s] = true
+		for _, child := range s.SpaceChildren() {
+			if r := rs.ByID(child.RoomID); r != nil && r.IsSpace() &&
+				r.Mem() == mor.MemJoin {
+				nest(r)
+			}
+		}
+	}
+	for _, s := range spaces {
+		if len(rs.Parents(s)) == 0 {
+			top = append(top, s)
+			nest(s)
+		}
+	}
+	for _, s := range spaces {
+		if !nested[s] {
+			top = append(top, s)
+			nest(s)
+		}
+	}
+	return top
+}
+
+func cmdSpace(cli *mor.Client, args Args) {
+	switch len(args.Args) {
+	case 1:
+		selectSpace(&cli.Rs, nil)
+	case 2:
+		space := cli.Rs.ByID(args.Args[1])
+		if space == nil || !space.IsSpace() || space.Mem() != mor.MemJoin {
+			cli.ConsolePrintf(mor.MsgTxtTypeNotice, "space: %s is not a joined space",
+				args.Args[1])
+			return
+		}
+		selectSpace(&cli.Rs, space)
+	default:
+		cli.ConsolePrintf(mor.MsgTxtTypeText, "Usage: %s [spaceID]", args.Args[0])
+		return
+	}
+	rePrintChan <- "rooms"
+}
+
+// hierarchyEntry is a room of the hierarchy listed by /hierarchy
+type hierarchyEntry struct {
+	Room  mor.HierarchyRoom
+	Depth int
+	// Via are the servers to join the room, from its parent
+	Via []string
+}
+
+// hierarchy is the last hierarchy listed by /hierarchy, to join its rooms
+var hierarchy []hierarchyEntry
+var hierarchyCli *mor.Client
+var hierarchyMux sync.Mutex
+
+// hierarchyEntries sorts the rooms of the hierarchy of a space depth first,
+// in the order that the spaces list them.
+func hierarchyEntries(rooms []mor.HierarchyRoom) []hierarchyEntry {
+	byID := make(map[string]mor.HierarchyRoom)
+	for _, hr := range rooms {
+		byID[hr.RoomID] = hr
+	}
+	entries := []hierarchyEntry{}
+	seen := make(map[string]bool)
+	var walk func(hr mor.HierarchyRoom, depth int, via []string)
+	walk = func(hr mor.HierarchyRoom, depth int, via []string) {
+		seen[hr.RoomID] = true
+		entries = append(entries, hierarchyEntry{Room: hr, Depth: depth, Via: via})
+		for _, child := range hr.Children() {
+			// The homeserver omits the rooms that we can't see
+			if childRoom, ok := byID[child.RoomID]; ok && !seen[child.RoomID] {
+				walk(childRoom, depth+1, child.Via)
+			}
+		}
+	}
+	walk(rooms[0], 0, nil)
+	return entries
+}
+
+func hierarchyLine(cli *mor.Client, n int, e hierarchyEntry) string {
+	name := e.Room.Name
+	if name == "" {
+		name = e.Room.CanonAlias
+	}
+	if name == "" {
+		name = e.Room.RoomID
+	}
+	info := []string{fmt.Sprintf("%d members", e.Room.Members)}
+	if e.Room.IsSpace() {
+		info = append([]string{"space"}, info...)
+	}
+	if r := cli.Rs.ByID(e.Room.RoomID); r != nil && r.Mem() == mor.MemJoin {
+		info = append(info, "joined")
+	} else if e.Room.JoinRule != "" && e.Room.JoinRule != "public" {
+		info = append(info, e.Room.JoinRule)
+	}
+	return fmt.Sprintf("%3d. %s%s (%s)", n, strings.Repeat("  ", e.Depth), name,
+		strings.Join(info, ", "))
+}
+
+// cmdHierarchy lists the rooms of a space, of the current room or the
+// selected one by default, and joins them.
+func cmdHierarchy(cli *mor.Client, args Args) {
+	usage := func() {
+		cli.ConsolePrintf(mor.MsgTxtTypeText, "Usage: %s [spaceID | join N]",
+			args.Args[0])
+	}
+	if len(args.Args) == 3 && args.Args[1] == "join" {
+		n, err := strconv.Atoi(args.Args[2])
+		if err != nil {
+			usage()
+			return
+		}
+		hierarchyMux.Lock()
+		entries, entriesCli := hierarchy, hierarchyCli
+		hierarchyMux.Unlock()
+		if entriesCli != cli || n < 1 || n > len(entries) {
+			cli.ConsolePrintf(mor.MsgTxtTypeNotice, "hierarchy: no room %d", n)
+			return
+		}
+		e := entries[n-1]
+		if err := cli.JoinRoomVia(e.Room.RoomID, e.Via); err != nil {
+			cli.ConsolePrint(mor.MsgTxtTypeNotice, "join: ", err)
+		}
+		return
+	}
+	spaceID := ""
+	selected := getRoomsUI(&cli.Rs).Space()
+	switch {
+	case len(args.Args) == 2:
+		spaceID = args.Args[1]
+	case len(args.Args) == 1 && args.Room.IsSpace():
+		spaceID = args.Room.ID()
+	case len(args.Args) == 1 && selected != nil:
+		spaceID = selected.ID()
+	default:
+		usage()
+		return
+	}
+	rooms, err := cli.Hierarchy(spaceID)
+	if err != nil {
+		cli.ConsolePrint(mor.MsgTxtTypeNotice, "hierarchy: ", err)
+		return
+	}
+	entries := hierarchyEntries(rooms)
+	lines := []string{}
+	for i, e := range entries {
+		lines = append(lines, hierarchyLine(cli, i+1, e))
+	}
+	lines = append(lines, fmt.Sprintf("Join a room with: /%s join N", args.Args[0]))
+	hierarchyMux.Lock()
+	hierarchy, hierarchyCli = entries, cli
+	hierarchyMux.Unlock()
+	cli.ConsolePrint(mor.MsgTxtTypeText, strings.Join(lines, "\n"))
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	mor "../morpheus"
+	"fmt"
+	//"github.com/jroimartin/gocui"
+	"../../gocui"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// threadView is the thread of a room open in the thread pane
+type threadView struct {
+	rootID string
+	root   *mor.Event
+	events []*mor.Event
+	// next is the token to fetch the previous replies, empty if there are
+	// no more
+	next string
+	// replying sends the messages typed to the thread instead of the room
+	replying bool
+	rwm      sync.RWMutex
+}
+
+// isReplying returns true if the messages typed go to the thread.
+func (tv *threadView) isReplying() bool {
+	tv.rwm.RLock()
+	defer tv.rwm.RUnlock()
+	return tv.replying
+}
+
+// addEvent appends a reply that arrived while the thread is open.
+func (tv *threadView) addEvent(e *mor.Event) {
+	tv.rwm.Lock()
+	defer tv.rwm.Unlock()
+	for _, ev := range tv.events {
+		if ev.ID == e.ID {
+			return
+		}
+	}
+	tv.events = append(tv.events, e)
+}
+
+// roomThread returns the thread open in the room, or nil.
+func roomThread(r *mor.Room) *threadView {
+	roomUI := getRoomUI(r)
+	roomUI.threadM.Lock()
+	defer roomUI.threadM.Unlock()
+	return roomUI.thread
+}
+
+func setRoomThread(r *mor.Room, tv *threadView) {
+	roomUI := getRoomUI(r)
+	roomUI.threadM.Lock()
+	roomUI.thread = tv
+	roomUI.threadM.Unlock()
+	rePrintChan <- "thread"
+}
+
+// eventSnippet returns the first line of the text of an event, for the
+// summaries.
+func eventSnippet(e *mor.Event, r *mor.Room, width int) string {
+	_, text := eventToStrings(e, r)
+	text = strings.Replace(strings.SplitN(text, "\n", 2)[0], noWrapMark, "", -1)
+	return strTrimPadRight(text, width)
+}
+
+// threadSummary is the line shown under the root of a thread in the room.
+func threadSummary(r *mor.Room, t *mor.Thread, width int) string {
+	replies := "replies"
+	if t.Count == 1 {
+		replies = "reply"
+	}
+	summary := fmt.Sprintf("└ %d %s", t.Count, replies)
+	if t.Latest != nil {
+		name := t.Latest.SenderName
+		if name == "" {
+			name = t.Latest.Sender
+		}
+		summary += fmt.Sprintf(", last by %s: ", name)
+		summary += eventSnippet(t.Latest, r, max(width-len([]rune(summary)), 0))
+	}
+	return strings.TrimRight(summary, " ")
+}
+
+// printThreadSummary prints the summary of the thread of e under it, if it's
+// the root of one, and returns the number of lines printed.
+func printThreadSummary(v *gocui.View, r *mor.Room, e *mor.Event) int {
+	t := r.Thread(e.ID)
+	if t == nil {
+		return 0
+	}
+	width, _ := v.Size()
+	fmt.Fprintf(v, "%s\x1b[38;5;45m%s\x1b[0;0m\n", strings.Repeat(" ", timelineUserWidth),
+		threadSummary(r, t, width-timelineUserWidth))
+	return 1
+}
+
+func setThreadView(g *gocui.Gui) (*gocui.View, error) {
+	maxX, _ := g.Size()
+	v, err := g.SetView("thread", viewRoomsWidth, -1, maxX-viewUsersWidth, viewMsgsHeight)
+	if err != nil && err != gocui.ErrUnknownView {
+		return nil, err
+	}
+	v.Frame = true
+	g.SetViewOnTop("thread")
+	// The search results go over the thread
+	if _, err := g.View("search"); err == nil {
+		g.SetViewOnTop("search")
+	}
+	g.SetViewOnTop("statusline")
+	return v, nil
+}
+
+// showThread shows the thread pane if the current room has a thread open,
+// and removes it otherwise.
+func showThread(g *gocui.Gui) error {
+	tv := roomThread(currentRoom)
+	if tv == nil {
+		if err := g.DeleteView("thread"); err != nil && err != gocui.ErrUnknownView {
+			return err
+		}
+		return nil
+	}
+	v, err := setThreadView(g)
+	if err != nil {
+		return err
+	}
+	v.Clear()
+	tv.rwm.RLock()
+	defer tv.rwm.RUnlock()
+	count := len(tv.events)
+	if t := currentRoom.Thread(tv.rootID); t != nil && t.Count > count {
+		count = t.Count
+	}
+	if tv.replying {
+		v.Title = fmt.Sprintf("Thread: %d replies, replying (/thread reply to write to the room)",
+			count)
+	} else {
+		v.Title = fmt.Sprintf("Thread: %d replies (/thread reply, /thread more, /thread close)",
+			count)
+	}
+	lines := 0
+	if tv.next != "" {
+		fmt.Fprintf(v, "\x1b[38;5;45m--- /thread more ---\x1b[0;0m\n")
+		lines++
+	}
+	if tv.root != nil {
+		root := *tv.root
+		root.Highlight = true
+		lines += printMessage(v, &root, currentRoom)
+	}
+	for _, e := range tv.events {
+		lines += printMessage(v, e, currentRoom)
+	}
+	// Show the last replies
+	v.SetOrigin(0, max(lines+1-viewMsgsHeight, 0))
+	return nil
+}
+
+// scrollViewThread scrolls the thread pane if it's open and returns false
+// otherwise.
+func scrollViewThread(g *gocui.Gui, l int) bool {
+	v, err := g.View("thread")
+	if err != nil {
+		return false
+	}
+	_, y := v.Origin()
+	v.SetOrigin(0, max(y+l, 0))
+	return true
+}
+
+// openThread fetches the root and the last replies of a thread and shows
+// them in the thread pane.
+func openThread(r *mor.Room, rootID string) {
+	cli := roomCli(r)
+	root, err := cli.ThreadRootEvent(r, rootID)
+	if err != nil {
+		cli.ConsolePrint(mor.MsgTxtTypeNotice, "thread: ", err)
+		return
+	}
+	events, next, err := cli.ThreadEvents(r, rootID, "", uint(numPrevEvents))
+	if err != nil {
+		cli.ConsolePrint(mor.MsgTxtTypeNotice, "thread: ", err)
+		return
+	}
+	setRoomThread(r, &threadView{rootID: rootID, root: root, events: events, next: next})
+}
+
+// threadMore fetches the previous replies of the open thread.
+func threadMore(r *mor.Room, tv *threadView) {
+	cli := roomCli(r)
+	tv.rwm.RLock()
+	next := tv.next
+	tv.rwm.RUnlock()
+	if next == "" {
+		cli.ConsolePrint(mor.MsgTxtTypeText, "thread: no more replies")
+		return
+	}
+	events, next, err := cli.ThreadEvents(r, tv.rootID, next, uint(numPrevEvents))
+	if err != nil {
+		cli.ConsolePrint(mor.MsgTxtTypeNotice, "thread: ", err)
+		return
+	}
+	tv.rwm.Lock()
+	tv.events = append(events, tv.events...)
+	tv.next = next
+	tv.rwm.Unlock()
+	rePrintChan <- "thread"
+}
+
+// threadArrvdMessage adds a reply to the thread pane if its thread is open,
+// and updates the summary under its root.
+func threadArrvdMessage(r *mor.Room, e *mor.Event) {
+	if tv := roomThread(r); tv != nil && tv.rootID == e.ThreadRoot {
+		tv.addEvent(e)
+		if currentRoom == r {
+			rePrintChan <- "thread"
+		}
+	}
+	if currentRoom == r && r.AtEnd() {
+		rePrintChan <- "msgs"
+	}
+}
+
+// cmdThreads lists the threads of the room, the last active first.
+func cmdThreads(cli *mor.Client, args Args) {
+	r := args.Room
+	threads := r.Threads()
+	if len(threads) == 0 {
+		cli.ConsolePrintf(mor.MsgTxtTypeText, "No threads in %s", r)
+		return
+	}
+	lines := []string{fmt.Sprintf("Threads in %s (/thread N to open one):", r)}
+	for i, t := range threads {
+		root := t.RootID
+		if e := r.Events.Event(t.RootID); e != nil {
+			root = eventSnippet(e, r, 40)
+		}
+		last := ""
+		if t.Latest != nil {
+			last = time.Unix(t.Latest.Ts/1000, 0).Format(", last 2006-01-02 15:04")
+		}
+		lines = append(lines, fmt.Sprintf("%3d. %s (%d replies%s)", i+1,
+			strings.TrimRight(root, " "), t.Count, last))
+	}
+	cli.ConsolePrint(mor.MsgTxtTypeText, strings.Join(lines, "\n"))
+}
+
+// cmdThread opens the N-th thread listed by /threads, the last active one by
+// default, and closes it, fetches its previous replies or switches the
+// messages typed between the thread and the room.
+func cmdThread(cli *mor.Client, args Args) {
+	r := args.Room
+	usage := func() {
+		cli.ConsolePrintf(mor.MsgTxtTypeText, "Usage: %s [N | reply | more | close]",
+			args.Args[0])
+	}
+	if len(args.Args) > 2 {
+		usage()
+		return
+	}
+	n := 1
+	if len(args.Args) == 2 {
+		switch args.Args[1] {
+		case "close":
+			setRoomThread(r, nil)
+			return
+		case "more":
+			if tv := roomThread(r); tv != nil {
+				go threadMore(r, tv)
+			}
+			return
+		case "reply":
+			if tv := roomThread(r); tv != nil {
+				tv.rwm.Lock()
+				tv.replying = !tv.replying
+				tv.rwm.Unlock()
+				rePrintChan <- "thread"
+			} else {
+				cli.ConsolePrintf(mor.MsgTxtTypeNotice, "thread: no thread open in %s", r)
+			}
+			return
+		}
+		var err error
+		if n, err = strconv.Atoi(args.Args[1]); err != nil {
+			usage()
+			return
+		}
+	}
+	threads := r.Threads()
+	if n < 1 || n > len(threads) {
+		cli.ConsolePrintf(mor.MsgTxtTypeNotice, "thread: no thread %d in %s", n, r)
+		return
+	}
+	go openThread(r, threads[n-1].RootID)
+}
@@ -4,9 +4,12 @@ import (
 	mor "../morpheus"
 	"bytes"
 	"fmt"
+	"github.com/spf13/viper"
 	"os"
 	"os/signal"
 	"runtime"
+	"sort"
+	"strconv"
 	"sync"
 	"syscall"
 	//"github.com/jroimartin/gocui"
@@ -57,7 +60,14 @@ type RoomUI struct {
 	ViewMsgsOriginY int
 	ScrollBottom    bool
 	ScrollSkipMsgs  uint
-	LastEventID     string
+	// ScrollAnchorID is the event shown at the bottom after fetching the
+	// next events
+	ScrollAnchorID string
+	// JumpEventID is the event opened with /context, highlighted in the
+	// timeline, and jumpPending is set until the view is scrolled to it
+	JumpEventID string
+	jumpPending bool
+	LastEventID string
 	//ScrollDelta         int
 	gettingPrev         bool
 	gettingPrevM        sync.Mutex
@@ -65,6 +75,9 @@ type RoomUI struct {
 	highlight           bool
 	ViewReadlineBuf     string
 	ViewReadlineCursorX int
+	// thread is the thread open in the thread pane
+	thread  *threadView
+	threadM sync.Mutex
 }
 
 func (rUI *RoomUI) TryGettingPrev() bool {
@@ -92,58 +105,182 @@ func getRoomUI(r *mor.Room) *RoomUI {
 	return r.UI.(*RoomUI)
 }
 
+// roomSet is a titled section of the room list
+type roomSet struct {
+	Title string
+	Rooms []*mor.Room
+	// Space is the space of the section, if any.  Its section is shown even
+	// if it's empty.
+	Space *mor.Room
+	// Depth indents the sections of nested spaces
+	Depth int
+}
+
 type RoomsUI struct {
-	ByShortcut   map[int]*mor.Room
-	PeopleRooms  []*mor.Room
-	GroupRooms   []*mor.Room
-	InvitedRooms []*mor.Room
-	LeftRooms    []*mor.Room
+	Sets []roomSet
+	// space filters the room list to the rooms of a space, or nil to list
+	// all the rooms
+	space  *mor.Room
+	spaceM sync.Mutex
+}
+
+func (rsUI *RoomsUI) Space() *mor.Room {
+	defer rsUI.spaceM.Unlock()
+	rsUI.spaceM.Lock()
+	return rsUI.space
+}
+
+func (rsUI *RoomsUI) SetSpace(space *mor.Room) {
+	defer rsUI.spaceM.Unlock()
+	rsUI.spaceM.Lock()
+	rsUI.space = space
+}
+
+// joinedSpace returns the selected space, unselecting it if we left it.
+func (rsUI *RoomsUI) joinedSpace() *mor.Room {
+	defer rsUI.spaceM.Unlock()
+	rsUI.spaceM.Lock()
+	if rsUI.space != nil && (roomDeleted(rsUI.space) || rsUI.space.Mem() != mor.MemJoin) {
+		rsUI.space = nil
+	}
+	return rsUI.space
 }
 
 func initRoomsUI(rs *mor.Rooms) {
-	rs.UI = &RoomsUI{ByShortcut: make(map[int]*mor.Room)}
+	rs.UI = &RoomsUI{}
 }
 
 func getRoomsUI(rs *mor.Rooms) *RoomsUI {
 	return rs.UI.(*RoomsUI)
 }
 
-func UpdateShortcuts(rs *mor.Rooms) {
+func updateRoomSets(rs *mor.Rooms) {
 	rsUI := getRoomsUI(rs)
-	rsUI.ByShortcut = make(map[int]*mor.Room, len(rs.R))
-	rsUI.PeopleRooms = make([]*mor.Room, 0)
-	rsUI.GroupRooms = make([]*mor.Room, 0)
-	rsUI.InvitedRooms = make([]*mor.Room, 0)
-	rsUI.LeftRooms = make([]*mor.Room, 0)
+	space := rsUI.joinedSpace()
+	spaces := make([]*mor.Room, 0)
+	peopleRooms := make([]*mor.Room, 0)
+	groupRooms := make([]*mor.Room, 0)
+	invitedRooms := make([]*mor.Room, 0)
+	leftRooms := make([]*mor.Room, 0)
 
 	// Iterate rs.R only once to enforce a consistent view of all the rooms
 	// (We don't want the same room in two lists).
 	for _, r := range rs.R[1:] {
-		if len(r.Users.U) == 2 && r.Mem() == mor.MemJoin {
-			rsUI.PeopleRooms = append(rsUI.PeopleRooms, r)
+		if r.Replaced() && !showUpgradedRooms {
+			continue
+		}
+		if r.IsSpace() && r.Mem() == mor.MemJoin {
+			spaces = append(spaces, r)
+		} else if len(r.Users.U) == 2 && r.Mem() == mor.MemJoin {
+			peopleRooms = append(peopleRooms, r)
 		} else if len(r.Users.U) != 2 && r.Mem() == mor.MemJoin {
-			rsUI.GroupRooms = append(rsUI.GroupRooms, r)
+			groupRooms = append(groupRooms, r)
 		} else if r.Mem() == mor.MemInvite {
-			rsUI.InvitedRooms = append(rsUI.InvitedRooms, r)
+			invitedRooms = append(invitedRooms, r)
 		} else if r.Mem() == mor.MemLeave {
-			rsUI.LeftRooms = append(rsUI.LeftRooms, r)
+			leftRooms = append(leftRooms, r)
+		}
+	}
+	// The nested spaces are listed in their parents
+	spaces = topSpaces(rs, spaces)
+	for _, rooms := range [][]*mor.Room{spaces, peopleRooms, groupRooms,
+		invitedRooms, leftRooms} {
+		sortRooms(rooms)
+	}
+	sets := []roomSet{{Rooms: []*mor.Room{rs.ConsoleRoom()}},
+		{Title: "Spaces", Rooms: spaces}}
+	if space != nil {
+		seen := make(map[*mor.Room]bool)
+		sets = append(sets, spaceSets(rs, space, 0, seen)...)
+		// Don't miss the invites while in a space
+		invites := make([]*mor.Room, 0)
+		for _, r := range invitedRooms {
+			if !seen[r] {
+				invites = append(invites, r)
+			}
+		}
+		sets = append(sets, roomSet{Title: "Invited", Rooms: invites})
+	} else {
+		sets = append(sets, roomSet{Title: "People", Rooms: peopleRooms},
+			roomSet{Title: "Groups", Rooms: groupRooms},
+			roomSet{Title: "Invited", Rooms: invitedRooms},
+			roomSet{Title: "Left", Rooms: leftRooms})
+	}
+	rsUI.Sets = sets
+}
+
+// sortRooms sorts the rooms according to roomSort
+func sortRooms(rooms []*mor.Room) {
+	lastTs := make(map[*mor.Room]int64)
+	for _, r := range rooms {
+		lastTs[r] = r.LastTs()
+	}
+	byActivity := func(i, j int) bool {
+		return lastTs[rooms[i]] > lastTs[rooms[j]]
+	}
+	switch roomSort {
+	case "activity":
+		sort.SliceStable(rooms, byActivity)
+	case "unread":
+		sort.SliceStable(rooms, func(i, j int) bool {
+			notifI, highI := rooms[i].Unread()
+			notifJ, highJ := rooms[j].Unread()
+			if highI != highJ {
+				return highI > highJ
+			}
+			if notifI != notifJ {
+				return notifI > notifJ
+			}
+			return byActivity(i, j)
+		})
+	}
+}
+
+// sortChanged returns true if the room is no longer where roomSort puts it
+// in its section of the room list, so that the rooms are only renumbered
+// when they move.
+func sortChanged(r *mor.Room) bool {
+	for _, set := range roomSets(r.Rooms) {
+		for _, r1 := range set.Rooms {
+			if r1 != r {
+				continue
+			}
+			sorted := append([]*mor.Room{}, set.Rooms...)
+			sortRooms(sorted)
+			for i := range sorted {
+				if sorted[i] != set.Rooms[i] {
+					return true
+				}
+			}
+			return false
 		}
 	}
+	return false
+}
 
-	sortedRooms := make([]*mor.Room, 0, len(rs.R))
-	sortedRooms = append(sortedRooms, rs.ConsoleRoom())
-	sortedRooms = append(sortedRooms, rsUI.PeopleRooms...)
-	sortedRooms = append(sortedRooms, rsUI.GroupRooms...)
-	sortedRooms = append(sortedRooms, rsUI.InvitedRooms...)
-	sortedRooms = append(sortedRooms, rsUI.LeftRooms...)
+// roomSets returns the sections of the room list of an account in the order
+// they are listed
+func roomSets(rs *mor.Rooms) []roomSet {
+	return getRoomsUI(rs).Sets
+}
 
+// UpdateShortcuts numbers the rooms of all the accounts in the order they are
+// listed, so that shortcuts are unique across accounts.
+func UpdateShortcuts() {
+	_byShortcut := make(map[int]*mor.Room)
 	count := 0
-	for _, r := range sortedRooms {
-		rUI := getRoomUI(r)
-		rUI.Shortcut = count
-		rsUI.ByShortcut[rUI.Shortcut] = r
-		count++
+	for _, c := range clis {
+		updateRoomSets(&c.Rs)
+		for _, roomSet := range roomSets(&c.Rs) {
+			for _, r := range roomSet.Rooms {
+				rUI := getRoomUI(r)
+				rUI.Shortcut = count
+				_byShortcut[rUI.Shortcut] = r
+				count++
+			}
+		}
 	}
+	byShortcut = _byShortcut
 }
 
 // CONFIG
@@ -165,13 +302,27 @@ var readlineHeight int = 1
 
 var displayNamesID = false
 
+// roomSort is the order of the rooms in the list: "activity", "unread" or
+// empty for the order in which they were joined.  Set by RoomSort in the
+// config file.
+var roomSort = ""
+
+// showUpgradedRooms lists the rooms that have been replaced by a room that we
+// joined.  Set by ShowUpgradedRooms in the config file.
+var showUpgradedRooms = false
+
 //var lineBackgroundGray = false
 
 // END CONFIG
 
 // GLOBALS
 
-var cli *mor.Client
+var clis []*mor.Client
+
+// byShortcut indexes the rooms of all the accounts by shortcut
+var byShortcut map[int]*mor.Room
+
+var hooks *mor.Hooks
 
 var currentRoom *mor.Room
 var lastRoom *mor.Room
@@ -194,6 +345,11 @@ var scrollChan chan int
 var switchRoomChan chan bool
 var cmdChan chan Args
 
+// reauthChans carry the password typed with /reauth to the Reauth of each
+// account
+var reauthChans = make(map[*mor.Client]chan string)
+var reauthM sync.Mutex
+
 var started bool
 
 var lastTs int64
@@ -202,6 +358,11 @@ var numPrevEvents = 128
 
 // END GLOBALS
 
+// roomCli returns the account that owns the room
+func roomCli(r *mor.Room) *mor.Client {
+	return r.Rooms.Client()
+}
+
 func min(x, y int) int {
 	if x < y {
 		return x
@@ -220,7 +381,6 @@ var modeLongRoomShortcut bool
 var longRoomShortcutDec int = -1
 
 func shortcuts(key gocui.Key, ch rune, mod gocui.Modifier) bool {
-	rs := cli.Rs
 	roomShortcut := -1
 	if modeLongRoomShortcut {
 		switch {
@@ -247,9 +407,7 @@ func shortcuts(key gocui.Key, ch rune, mod gocui.Modifier) bool {
 		}
 	}
 	if roomShortcut != -1 {
-		rsUI := getRoomsUI(&rs)
-		cli.DebugPrint(rsUI.ByShortcut)
-		r, ok := rsUI.ByShortcut[roomShortcut]
+		r, ok := byShortcut[roomShortcut]
 		if ok {
 			setCurrentRoom(r, true)
 		}
@@ -325,10 +483,11 @@ func getPrevEvents(room *mor.Room) {
 	}()
 	// Fetch previous messages
 	_currentRoom := currentRoom
-	count, err := cli.GetPrevEvents(_currentRoom, uint(numPrevEvents))
+	c := roomCli(_currentRoom)
+	count, err := c.GetPrevEvents(_currentRoom, uint(numPrevEvents))
 	if err != nil || count == 0 {
 		if err != nil {
-			cli.DebugPrint("cli.GetPrevEvents:", err)
+			c.DebugPrint("cli.GetPrevEvents:", err)
 		}
 		if _currentRoom == room {
 			scrollChan <- 0
@@ -346,6 +505,31 @@ func getPrevEvents(room *mor.Room) {
 	}
 }
 
+func getNextEvents(room *mor.Room) {
+	roomUI := getRoomUI(room)
+	defer roomUI.UnsetGettingPrev()
+	c := roomCli(room)
+	if lastEvent := room.Events.LastEvent(); lastEvent != nil {
+		roomUI.ScrollAnchorID = lastEvent.ID
+	}
+	if _, err := c.GetNextEvents(room, uint(numPrevEvents)); err != nil {
+		c.DebugPrint("cli.GetNextEvents:", err)
+		roomUI.ScrollAnchorID = ""
+		return
+	}
+	if currentRoom == room {
+		rePrintChan <- "msgs"
+	}
+}
+
+// fillGap loads the newest missing messages of a gap of the room.
+func fillGap(room *mor.Room, gap *mor.Gap) {
+	c := roomCli(room)
+	if _, err := c.FillGap(room, gap, uint(numPrevEvents)); err != nil {
+		c.DebugPrint("cli.FillGap:", err)
+	}
+}
+
 func scrollViewMsgs(viewMsgs *gocui.View, l int) error {
 	_, y := viewMsgs.Origin()
 	newY := 0
@@ -366,17 +550,26 @@ func scrollViewMsgs(viewMsgs *gocui.View, l int) error {
 		newY = max(newY, 1)
 	}
 	viewMsgs.SetOrigin(0, newY)
+	_currentRoom := currentRoom
 	if newY >= viewMsgsLines-viewMsgsHeight {
-		scrollBottom = true
-		_currentRoom := currentRoom
-		if _currentRoom.Events.Len() > minMsgs+numPrevEvents {
-			_currentRoom.ClearFrontEvents(minMsgs)
-			rePrintChan <- "msgs"
-			scrollChan <- bottomDelta()
+		if !_currentRoom.AtEnd() {
+			// The newest events are not in memory
+			scrollBottom = false
+			if getRoomUI(_currentRoom).TryGettingPrev() {
+				go getNextEvents(_currentRoom)
+			}
+		} else {
+			scrollBottom = true
+			if _currentRoom.Events.Len() > minMsgs+numPrevEvents {
+				_currentRoom.ClearFrontEvents(minMsgs)
+				rePrintChan <- "msgs"
+				scrollChan <- bottomDelta()
+			}
 		}
 	} else {
 		scrollBottom = false
 	}
+	_currentRoom.SetFollow(scrollBottom)
 	return nil
 }
 
@@ -396,7 +589,7 @@ func printView(g *gocui.Gui, view string) {
 	views := []string{view}
 	if view == "all" {
 		views = []string{"rooms", "msgs", "users",
-			"readline", "statusline"}
+			"readline", "statusline", "thread"}
 	}
 	for _, view := range views {
 		switch view {
@@ -416,11 +609,13 @@ func printView(g *gocui.Gui, view string) {
 		case "statusline":
 			v, _ := g.View(view)
 			printStatusLine(v, currentRoom)
+		case "thread":
+			showThread(g)
 		case "debug":
 			v, err := g.View(view)
 			if err == nil {
 				v.Clear()
-				fmt.Fprint(v, cli.DebugBuf())
+				fmt.Fprint(v, roomCli(currentRoom).DebugBuf())
 			}
 		}
 	}
@@ -434,7 +629,7 @@ func eventLoop(g *gocui.Gui) {
 			g.Update(func(g *gocui.Gui) error {
 				viewMsgs, _ := g.View("msgs")
 				if re.Room == currentRoom {
-					printMessage(viewMsgs, re.Event, re.Room)
+					viewMsgsLines += printMessage(viewMsgs, re.Event, re.Room)
 					if scrollBottom {
 						scrollViewMsgsBottom(g)
 					}
@@ -480,6 +675,7 @@ func eventLoop(g *gocui.Gui) {
 
 				currentRoomUI.newMsgs = false
 				currentRoomUI.highlight = false
+				go markRead(currentRoom)
 
 				printView(g, "all")
 
@@ -493,6 +689,13 @@ func eventLoop(g *gocui.Gui) {
 	}
 }
 
+func markRead(r *mor.Room) {
+	cli := roomCli(r)
+	if err := cli.MarkRead(r); err != nil {
+		cli.DebugPrint("read_markers:", err)
+	}
+}
+
 func roomIDCmd(args Args) string {
 	if len(args.Args) == 2 {
 		return args.Args[1]
@@ -506,6 +709,7 @@ func roomIDCmd(args Args) string {
 func cmdLoop(g *gocui.Gui) {
 	for {
 		args := <-cmdChan
+		cli := roomCli(args.Room)
 		switch args.Args[0] {
 		case "quit":
 			g.Update(quit)
@@ -524,9 +728,25 @@ func cmdLoop(g *gocui.Gui) {
 					"Usage: %s roomID", args.Args[0])
 				return
 			}
-			go cli.LeaveRoom(roomID)
+			go func() {
+				if err := cli.LeaveRoom(roomID); err != nil {
+					cli.ConsolePrint(mor.MsgTxtTypeNotice, "leave: ", err)
+				}
+			}()
 			setCurrentRoom(lastRoom, false)
 			lastRoom = currentRoom
+		case "forget":
+			roomID := roomIDCmd(args)
+			if roomID == "" || roomID == mor.ConsoleRoomID {
+				cli.ConsolePrintf(mor.MsgTxtTypeText,
+					"Usage: %s roomID", args.Args[0])
+				break
+			}
+			go func() {
+				if err := cli.ForgetRoom(roomID); err != nil {
+					cli.ConsolePrint(mor.MsgTxtTypeNotice, "forget: ", err)
+				}
+			}()
 		case "reset": // Clear gocui artifacts from the screen
 			g.Update(func(g *gocui.Gui) error {
 				maxX, maxY := g.Size()
@@ -547,6 +767,63 @@ func cmdLoop(g *gocui.Gui) {
 				g.DeleteView("clear")
 				return nil
 			})
+		case "devices":
+			go cmdDevices(cli, args)
+		case "hooks":
+			cmdHooks(cli, args)
+		case "notify":
+			go cmdNotify(cli, args)
+		case "search":
+			go cmdSearch(g, cli, args)
+		case "lsearch":
+			go cmdLocalSearch(g, cli, args)
+		case "context":
+			cmdContext(g, cli, args)
+		case "keyword":
+			go cmdKeyword(cli, args)
+		case "space":
+			cmdSpace(cli, args)
+		case "hierarchy":
+			go cmdHierarchy(cli, args)
+		case "threads":
+			cmdThreads(cli, args)
+		case "thread":
+			cmdThread(cli, args)
+		case "accept":
+			roomID := roomIDCmd(args)
+			if roomID == "" || roomID == mor.ConsoleRoomID {
+				cli.ConsolePrintf(mor.MsgTxtTypeText,
+					"Usage: %s [roomID]", args.Args[0])
+				break
+			}
+			go acceptInvite(cli, roomID)
+		case "decline":
+			// The reason follows the room ID, if any
+			roomID, reason := args.Room.ID(), args.Args[1:]
+			if len(reason) != 0 && strings.HasPrefix(reason[0], "!") {
+				roomID = roomIDCmd(Args{Room: args.Room, Args: args.Args[:2]})
+				reason = reason[1:]
+			}
+			if roomID == mor.ConsoleRoomID {
+				cli.ConsolePrintf(mor.MsgTxtTypeText,
+					"Usage: %s [roomID] [reason]", args.Args[0])
+				break
+			}
+			go declineInvite(cli, roomID, strings.Join(reason, " "))
+		case "logout":
+			go func() {
+				var err error
+				if len(args.Args) == 2 && args.Args[1] == "all" {
+					err = cli.LogoutAll()
+				} else {
+					err = cli.Logout()
+				}
+				if err != nil {
+					cli.ConsolePrint(mor.MsgTxtTypeNotice, "logout: ", err)
+					return
+				}
+				g.Update(quit)
+			}()
 		case "debug-clear-front":
 			currentRoom.ClearFrontEvents(minMsgs)
 			rePrintChan <- "msgs"
@@ -558,6 +835,189 @@ func cmdLoop(g *gocui.Gui) {
 	}
 }
 
+func cmdDevices(cli *mor.Client, args Args) {
+	usage := func() {
+		cli.ConsolePrintf(mor.MsgTxtTypeText,
+			"Usage: %s [rename deviceID name | delete deviceID...]", args.Args[0])
+	}
+	if len(args.Args) == 1 {
+		devices, err := cli.Devices()
+		if err != nil {
+			cli.ConsolePrint(mor.MsgTxtTypeNotice, "devices: ", err)
+			return
+		}
+		lines := []string{fmt.Sprintf("  %-12s %-24s %-15s %-16s %s",
+			"ID", "Name", "Last seen IP", "Last seen", "E2EE")}
+		for _, d := range devices {
+			current := " "
+			if d.ID == cli.GetDeviceID() {
+				current = "*"
+			}
+			lastSeen := ""
+			if d.LastSeenTs != 0 {
+				lastSeen = time.Unix(d.LastSeenTs/1000, 0).Format("2006-01-02 15:04")
+			}
+			keys := "no keys"
+			if d.HasKeys {
+				keys = "keys"
+			}
+			lines = append(lines, fmt.Sprintf("%s %-12s %-24s %-15s %-16s %s",
+				current, d.ID, strTrimPadRight(d.DisplayName, 24),
+				d.LastSeenIP, lastSeen, keys))
+		}
+		cli.ConsolePrint(mor.MsgTxtTypeText, strings.Join(lines, "\n"))
+		return
+	}
+	var err error
+	switch args.Args[1] {
+	case "rename":
+		if len(args.Args) < 4 {
+			usage()
+			return
+		}
+		err = cli.RenameDevice(args.Args[2], strings.Join(args.Args[3:], " "))
+	case "delete":
+		if len(args.Args) < 3 {
+			usage()
+			return
+		}
+		err = cli.DeleteDevices(args.Args[2:])
+	default:
+		usage()
+		return
+	}
+	if err != nil {
+		cli.ConsolePrintf(mor.MsgTxtTypeNotice, "devices %s: %s", args.Args[1], err)
+	}
+}
+
+func cmdHooks(cli *mor.Client, args Args) {
+	if len(args.Args) == 1 {
+		if len(hooks.H) == 0 {
+			cli.ConsolePrint(mor.MsgTxtTypeText, "No hooks in the config file")
+			return
+		}
+		lines := []string{}
+		for i, h := range hooks.H {
+			state := "enabled"
+			if !h.Enabled() {
+				state = "disabled"
+			}
+			runs, dropped := h.Stats()
+			lines = append(lines, fmt.Sprintf("%d: %s (%s, %d runs, %d dropped)",
+				i, h.Command(), state, runs, dropped))
+		}
+		cli.ConsolePrint(mor.MsgTxtTypeText, strings.Join(lines, "\n"))
+		return
+	}
+	var i int
+	var err error
+	if len(args.Args) == 3 {
+		i, err = strconv.Atoi(args.Args[2])
+	}
+	if len(args.Args) != 3 || err != nil || i < 0 || i >= len(hooks.H) ||
+		(args.Args[1] != "enable" && args.Args[1] != "disable") {
+		cli.ConsolePrintf(mor.MsgTxtTypeText,
+			"Usage: %s [enable N | disable N]", args.Args[0])
+		return
+	}
+	hooks.H[i].SetEnabled(args.Args[1] == "enable")
+}
+
+func cmdNotify(cli *mor.Client, args Args) {
+	usage := func() {
+		cli.ConsolePrintf(mor.MsgTxtTypeText,
+			"Usage: %s [room all|mentions|none | rules | enable|disable|delete kind ruleID]",
+			args.Args[0])
+	}
+	if len(args.Args) == 1 {
+		cli.ConsolePrintf(mor.MsgTxtTypeText, "Notifications for %s: %s",
+			args.Room, cli.RoomNotify(args.Room.ID()))
+		return
+	}
+	var err error
+	switch args.Args[1] {
+	case "room":
+		if len(args.Args) != 3 || args.Room == args.Room.Rooms.ConsoleRoom() {
+			usage()
+			return
+		}
+		notify := map[string]mor.RoomNotify{"all": mor.RoomNotifyAll,
+			"mentions": mor.RoomNotifyMentions, "none": mor.RoomNotifyNone}
+		n, ok := notify[args.Args[2]]
+		if !ok {
+			usage()
+			return
+		}
+		err = cli.SetRoomNotify(args.Room.ID(), n)
+	case "rules":
+		rules, err := cli.PushRules()
+		if err != nil {
+			cli.ConsolePrint(mor.MsgTxtTypeNotice, "notify rules: ", err)
+			return
+		}
+		lines := []string{}
+		for _, kind := range mor.PushRuleKinds {
+			for _, rule := range rules.Kind(kind) {
+				enabled := " "
+				if rule.Enabled {
+					enabled = "*"
+				}
+				lines = append(lines, fmt.Sprintf("%s %-9s %s %v", enabled, kind,
+					rule.RuleID, rule.Actions))
+			}
+		}
+		cli.ConsolePrint(mor.MsgTxtTypeText, strings.Join(lines, "\n"))
+		return
+	case "enable", "disable":
+		if len(args.Args) != 4 {
+			usage()
+			return
+		}
+		err = cli.SetPushRuleEnabled(args.Args[2], args.Args[3], args.Args[1] == "enable")
+	case "delete":
+		if len(args.Args) != 4 {
+			usage()
+			return
+		}
+		err = cli.DeletePushRule(args.Args[2], args.Args[3])
+	default:
+		usage()
+		return
+	}
+	if err != nil {
+		cli.ConsolePrintf(mor.MsgTxtTypeNotice, "notify %s: %s", args.Args[1], err)
+	}
+}
+
+func cmdKeyword(cli *mor.Client, args Args) {
+	if len(args.Args) == 1 {
+		cli.ConsolePrintf(mor.MsgTxtTypeText, "Keywords: %s",
+			strings.Join(cli.Keywords(), ", "))
+		return
+	}
+	if len(args.Args) != 3 || (args.Args[1] != "add" && args.Args[1] != "del") {
+		cli.ConsolePrintf(mor.MsgTxtTypeText,
+			"Usage: %s [add word | del word]", args.Args[0])
+		return
+	}
+	var err error
+	if args.Args[1] == "add" {
+		err = cli.AddKeyword(args.Args[2])
+	} else {
+		err = cli.DelKeyword(args.Args[2])
+	}
+	if err != nil {
+		cli.ConsolePrintf(mor.MsgTxtTypeNotice, "keyword %s: %s", args.Args[1], err)
+	}
+}
+
+func hooksErrLoop() {
+	for err := range hooks.Errs() {
+		clis[0].ConsolePrint(mor.MsgTxtTypeNotice, err)
+	}
+}
+
 func AddedUser(r *mor.Room, u *mor.User) {
 	initUserUI(u)
 	UpdatedUser(r, u)
@@ -565,7 +1025,7 @@ func AddedUser(r *mor.Room, u *mor.User) {
 
 func DeletedUser(r *mor.Room, u *mor.User) {
 	if started {
-		UpdateShortcuts(&cli.Rs)
+		UpdateShortcuts()
 		rePrintChan <- "rooms"
 		if currentRoom == r {
 			rePrintChan <- "users"
@@ -583,7 +1043,7 @@ func UpdatedUser(r *mor.Room, u *mor.User) {
 			rePrintChan <- "statusline"
 		}
 		if len(r.Users.U) <= 3 {
-			UpdateShortcuts(&cli.Rs)
+			UpdateShortcuts()
 			rePrintChan <- "rooms"
 		}
 	}
@@ -600,29 +1060,50 @@ func AddedRoom(r *mor.Room) {
 
 func DeletedRoom(r *mor.Room) {
 	if started {
-		UpdateShortcuts(&cli.Rs)
+		UpdateShortcuts()
 		if currentRoom == r {
 			if lastRoom != r {
-				currentRoom = lastRoom
+				setCurrentRoom(lastRoom, false)
 			} else {
-				currentRoom = cli.Rs.ConsoleRoom()
+				setCurrentRoom(r.Rooms.ConsoleRoom(), false)
 			}
-			rePrintChan <- "all"
 		} else {
 			rePrintChan <- "rooms"
 		}
 	}
 }
 
+// roomDeleted returns true if the room has been removed from its Rooms.
+func roomDeleted(r *mor.Room) bool {
+	return r.Rooms.ByID(r.ID()) != r
+}
+
 func UpdatedRoom(r *mor.Room, state mor.RoomState) {
 	//rUI := getRoomUI(r)
 	if started {
-		if state == mor.RoomStateMembership || state == mor.RoomStateAll {
-			UpdateShortcuts(&cli.Rs)
+		if state == mor.RoomStateMembership || state == mor.RoomStateAll ||
+			state == mor.RoomStateTombstone || state == mor.RoomStateSpace ||
+			(state == mor.RoomStateUnread && roomSort == "unread" && sortChanged(r)) {
+			UpdateShortcuts()
+		}
+		if state == mor.RoomStateEvents {
+			if currentRoom == r {
+				rePrintChan <- "msgs"
+				if scrollBottom {
+					scrollChan <- bottomDelta()
+				}
+			}
+			return
 		}
 		rePrintChan <- "rooms"
 		if currentRoom == r {
 			rePrintChan <- "statusline"
+			// Replace the invite card by the messages, or show
+			// the tombstone banner
+			if state == mor.RoomStateMembership ||
+				state == mor.RoomStateTombstone {
+				rePrintChan <- "msgs"
+			}
 		}
 	}
 }
@@ -641,20 +1122,44 @@ func ArrvdMessage(r *mor.Room, e *mor.Event) {
 			clearedFront = true
 		}
 		if _currentRoom == r {
-			if clearedFront {
+			switch {
+			case e.ThreadRoot != "":
+				// The replies are shown in the thread pane
+				threadArrvdMessage(r, e)
+			case !r.AtEnd():
+				// The event is not stored, it's fetched when
+				// scrolling down
+			case clearedFront:
 				rePrintChan <- "msgs"
 				scrollChan <- bottomDelta()
-			} else {
+			default:
 				recvMsgChan <- RoomEvent{r, e}
 			}
+			if e.Notify && roomScrollBottom {
+				go markRead(r)
+			}
 		} else {
-			if _, ok := e.Content.(mor.Message); ok && e.Ts > lastTs {
+			if e.ThreadRoot != "" {
+				threadArrvdMessage(r, e)
+			}
+			_, isMsg := e.Content.(mor.Message)
+			// The console has no push rules, any message is new
+			notify := e.Notify || r == r.Rooms.ConsoleRoom()
+			if isMsg && notify && e.Ts > lastTs {
+				if e.Highlight && !roomUI.highlight {
+					roomUI.highlight = true
+					rePrintChan <- "rooms"
+				}
 				if !roomUI.newMsgs {
 					roomUI.newMsgs = true
 					rePrintChan <- "rooms"
 				}
 			}
 		}
+		if roomSort == "activity" && e.Ts > lastTs && sortChanged(r) {
+			UpdateShortcuts()
+			rePrintChan <- "rooms"
+		}
 	}
 }
 
@@ -664,23 +1169,100 @@ func Cmd(r *mor.Room, args []string) {
 	}
 }
 
+// reauthChan returns the channel of the password of the account.
+func reauthChan(cli *mor.Client) chan string {
+	reauthM.Lock()
+	defer reauthM.Unlock()
+	ch, ok := reauthChans[cli]
+	if !ok {
+		ch = make(chan string)
+		reauthChans[cli] = ch
+	}
+	return ch
+}
+
+// Reauth waits for the password typed with /reauth in a room of the account,
+// and gives up if it's empty or the client stops waiting.
+func Reauth(cli *mor.Client, err error, reply chan<- string, done <-chan struct{}) {
+	cli.ConsolePrintf(mor.MsgTxtTypeNotice,
+		"Password of %s required (%s), enter it in this console with: "+
+			"/reauth password, or give up with: /reauth", cli.GetUserID(), err)
+	select {
+	case password := <-reauthChan(cli):
+		if password == "" {
+			close(reply)
+			return
+		}
+		reply <- password
+	case <-done:
+		cli.ConsolePrintf(mor.MsgTxtTypeNotice, "Password of %s no longer awaited",
+			cli.GetUserID())
+	}
+}
+
+func handleBusEvent(ev mor.BusEvent) {
+	switch ev.Type {
+	case mor.BusAddUser:
+		AddedUser(ev.Room, ev.User)
+	case mor.BusDelUser:
+		DeletedUser(ev.Room, ev.User)
+	case mor.BusUpdateUser:
+		UpdatedUser(ev.Room, ev.User)
+	case mor.BusAddRoom:
+		AddedRoom(ev.Room)
+	case mor.BusDelRoom:
+		DeletedRoom(ev.Room)
+	case mor.BusUpdateRoom:
+		UpdatedRoom(ev.Room, ev.State)
+	case mor.BusMessage:
+		ArrvdMessage(ev.Room, ev.Event)
+	case mor.BusCmd:
+		Cmd(ev.Room, ev.Args)
+	case mor.BusReauth:
+		// Reauth waits for the user, don't block the bus
+		go Reauth(ev.Client, ev.Err, ev.Reply, ev.Done)
+	}
+}
+
+func busLoop(sub *mor.Subscription) {
+	for ev := range sub.C {
+		handleBusEvent(ev)
+	}
+}
+
 func main() {
 	//defer profile.Start().Stop()
 	var err error
-	cli, err = mor.NewClient("morpheus", []string{"."}, mor.Callbacks{
-		AddedUser, DeletedUser, UpdatedUser,
-		AddedRoom, DeletedRoom, UpdatedRoom,
-		ArrvdMessage,
-		Cmd,
-	})
+	bus := mor.NewBus()
+	sub := bus.Subscribe(mor.BusFilter{}, 1024)
+	clis, err = mor.NewClients("morpheus", []string{"."}, bus)
 	if err != nil {
 		panic(err)
 	}
+	roomSort = viper.GetString("RoomSort")
+	showUpgradedRooms = viper.GetBool("ShowUpgradedRooms")
+	if viper.IsSet("RenderHTML") {
+		renderHTML = viper.GetBool("RenderHTML")
+	}
+	if viper.IsSet("HighlightCode") {
+		highlightCode = viper.GetBool("HighlightCode")
+	}
+	hooks, err = mor.NewHooks(bus)
+	if err != nil {
+		panic(err)
+	}
+	// Handle the events published while creating the clients before using
+	// the rooms
+	for len(sub.C) > 0 {
+		handleBusEvent(<-sub.C)
+	}
 
 	//
 	// Init
-	initRoomsUI(&cli.Rs)
-	currentRoom = cli.Rs.ConsoleRoom()
+	for _, c := range clis {
+		initRoomsUI(&c.Rs)
+	}
+	currentRoom = clis[0].Rs.ConsoleRoom()
 	lastRoom = currentRoom
 
 	//
@@ -709,8 +1291,32 @@ func main() {
 		keyReadmultiLineToggle); err != nil {
 		log.Panicln(err)
 	}
+	if err := g.SetKeybinding("", gocui.KeyF2, gocui.ModNone,
+		keyAcceptInvite); err != nil {
+		log.Panicln(err)
+	}
+	if err := g.SetKeybinding("", gocui.KeyF3, gocui.ModNone,
+		keyDeclineInvite); err != nil {
+		log.Panicln(err)
+	}
+	if err := g.SetKeybinding("", gocui.KeyF4, gocui.ModNone,
+		keyJoinReplacement); err != nil {
+		log.Panicln(err)
+	}
+	if err := g.SetKeybinding("", gocui.KeyF5, gocui.ModNone,
+		func(g *gocui.Gui, v *gocui.View) error {
+			if gaps := currentRoom.Gaps(); len(gaps) != 0 {
+				go fillGap(currentRoom, gaps[0])
+			}
+			return nil
+		}); err != nil {
+		log.Panicln(err)
+	}
 	if err := g.SetKeybinding("", gocui.KeyArrowUp, gocui.ModNone,
 		func(g *gocui.Gui, v *gocui.View) error {
+			if scrollViewSearch(g, -1) || scrollViewThread(g, -1) {
+				return nil
+			}
 			viewMsgs, err := g.View("msgs")
 			if err != nil {
 				return err
@@ -721,6 +1327,9 @@ func main() {
 	}
 	if err := g.SetKeybinding("", gocui.KeyArrowDown, gocui.ModNone,
 		func(g *gocui.Gui, v *gocui.View) error {
+			if scrollViewSearch(g, 1) || scrollViewThread(g, 1) {
+				return nil
+			}
 			viewMsgs, err := g.View("msgs")
 			if err != nil {
 				return err
@@ -731,6 +1340,9 @@ func main() {
 	}
 	if err := g.SetKeybinding("", gocui.KeyPgup, gocui.ModNone,
 		func(g *gocui.Gui, v *gocui.View) error {
+			if scrollViewSearch(g, -viewMsgsHeight/2) || scrollViewThread(g, -viewMsgsHeight/2) {
+				return nil
+			}
 			viewMsgs, err := g.View("msgs")
 			if err != nil {
 				return err
@@ -741,6 +1353,9 @@ func main() {
 	}
 	if err := g.SetKeybinding("", gocui.KeyPgdn, gocui.ModNone,
 		func(g *gocui.Gui, v *gocui.View) error {
+			if scrollViewSearch(g, viewMsgsHeight/2) || scrollViewThread(g, viewMsgsHeight/2) {
+				return nil
+			}
 			viewMsgs, err := g.View("msgs")
 			if err != nil {
 				return err
@@ -787,8 +1402,10 @@ func main() {
 
 	go eventLoop(g)
 	go cmdLoop(g)
+	go busLoop(sub)
+	go hooksErrLoop()
 
-	UpdateShortcuts(&cli.Rs)
+	UpdateShortcuts()
 	exit := make(chan error)
 	go func() {
 		if err := g.MainLoop(); err != nil && err != gocui.ErrQuit {
@@ -803,10 +1420,16 @@ func main() {
 		rePrintChan <- "statusline"
 	}()
 
-	// TODO: Error checking
-	cli.Login()
-	// TODO: Error checking
-	go cli.Sync()
+	for _, c := range clis {
+		go func(c *mor.Client) {
+			if err := c.Login(); err != nil {
+				c.ConsolePrint(mor.MsgTxtTypeNotice, "login: ", err)
+				return
+			}
+			// TODO: Error checking
+			c.Sync()
+		}(c)
+	}
 
 	err = <-exit
 	if err != nil {
@@ -833,15 +1456,21 @@ func strTrimPadRight(s string, pLen int) string {
 }
 
 func setCurrentRoom(r *mor.Room, toggle bool) {
-	if toggle {
-		if currentRoom == r {
-			r = lastRoom
-		}
-	} else if currentRoom == r {
+	if toggle && currentRoom == r {
+		r = lastRoom
+	}
+	if roomDeleted(r) {
+		r = r.Rooms.ConsoleRoom()
+	}
+	if currentRoom == r {
 		return
 	}
 	lastRoom = currentRoom
 	currentRoom = r
+	// Opening a space filters the room list to its rooms
+	if r.IsSpace() && r.Mem() == mor.MemJoin {
+		selectSpace(r.Rooms, r)
+	}
 	if started {
 		switchRoomChan <- true
 	}
@@ -950,59 +1579,78 @@ func setAllViews(g *gocui.Gui) error {
 	if _, err := g.View("debug"); err == nil {
 		g.SetView("debug", maxX/2, maxY/2, maxX, maxY)
 	}
+	if _, err := g.View("thread"); err == nil {
+		setThreadView(g)
+	}
+	if _, err := g.View("search"); err == nil {
+		setSearchView(g)
+	}
 	g.SetViewOnTop("statusline")
 	g.SetCurrentView("readline")
 	return nil
 }
 
 func printRooms(v *gocui.View) {
-	rs := &cli.Rs
 	v.Clear()
 	pad := 1
-	if len(rs.R) > 9 {
+	if len(byShortcut) > 10 {
 		pad = 2
 	}
-	rsUI := getRoomsUI(rs)
-	roomSets := [][]*mor.Room{[]*mor.Room{rs.ConsoleRoom()},
-		rsUI.PeopleRooms, rsUI.GroupRooms, rsUI.InvitedRooms, rsUI.LeftRooms}
-	for i, roomSet := range roomSets {
-		if len(roomSet) != 0 {
-			switch i {
-			case 1:
-				fmt.Fprintf(v, "\n    People\n\n")
-			case 2:
-				fmt.Fprintf(v, "\n    Groups\n\n")
-			case 3:
-				fmt.Fprintf(v, "\n    Invited\n\n")
-			case 4:
-				fmt.Fprintf(v, "\n    Left\n\n")
-			}
+	for _, c := range clis {
+		if len(clis) > 1 {
+			fmt.Fprintf(v, "\x1b[38;5;110m%s\x1b[0;0m\n",
+				strTrimPadRight(c.GetUserID(), viewRoomsWidth))
 		}
-		for _, r := range roomSet {
+		printRoomSets(v, &c.Rs, pad)
+		if len(clis) > 1 {
+			fmt.Fprintf(v, "\n")
+		}
+	}
+}
+
+func printRoomSets(v *gocui.View, rs *mor.Rooms, pad int) {
+	for _, roomSet := range roomSets(rs) {
+		if roomSet.Title != "" && (len(roomSet.Rooms) != 0 || roomSet.Space != nil) {
+			indent := strings.Repeat("  ", roomSet.Depth)
+			fmt.Fprintf(v, "\n%s\n\n", strTrimPadRight("    "+indent+roomSet.Title,
+				viewRoomsWidth))
+		}
+		for _, r := range roomSet.Rooms {
 			highStart := ""
 			highEnd := ""
+			badge := ""
 			roomUI := getRoomUI(r)
+			if notif, highlight := r.Unread(); highlight != 0 {
+				badge = fmt.Sprintf(" \x1b[38;5;208m%d!\x1b[39m", highlight)
+			} else if notif != 0 {
+				badge = fmt.Sprintf(" %d", notif)
+			}
 			if r == currentRoom {
 				highStart = "\x1b[48;5;40m\x1b[38;5;0m"
 				highEnd = "\x1b[0;0m"
-			} else if roomUI.newMsgs {
-				highStart = "\x1b[38;5;226m"
-				highEnd = "\x1b[0;0m"
 			} else if roomUI.highlight {
 				highStart = "\x1b[38;5;208m"
 				highEnd = "\x1b[0;0m"
+			} else if roomUI.newMsgs {
+				highStart = "\x1b[38;5;226m"
+				highEnd = "\x1b[0;0m"
 			}
 			rUI := getRoomUI(r)
-			fmt.Fprintf(v, "%s%*s.%s%s\n", highStart, pad,
+			badgeWidth := runewidth.StringWidth(badge) - StringEscapeWidth(badge)
+			fmt.Fprintf(v, "%s%*s.%s%s%s\n", highStart, pad,
 				fmt.Sprintf("%d", rUI.Shortcut),
-				strTrimPadRight(r.String(), viewRoomsWidth-pad),
-				highEnd)
+				strTrimPadRight(r.String(), viewRoomsWidth-pad-badgeWidth),
+				badge, highEnd)
 		}
 	}
 }
 
 func printRoomMessages(v *gocui.View, r *mor.Room) {
 	v.Clear()
+	if inv := r.Invite(); inv != nil {
+		printInvite(v, r, inv)
+		return
+	}
 	//lineBackgroundGray = false
 	viewMsgsWidth, _ := v.Size()
 	prevLine := "--- Fetching previous messages ---"
@@ -1011,18 +1659,54 @@ func printRoomMessages(v *gocui.View, r *mor.Room) {
 	viewMsgsLines = 1
 	roomUI := getRoomUI(r)
 	count := uint(0)
+	skipMsgs := roomUI.ScrollSkipMsgs
 	scrollDelta := 0
 	prevTs := time.Unix(0, 0)
 	prevMsgsBar := false
 	newMsgsBar := false
+	anchorLine := 0
+	jumpLine := 0
+	// printPrevMsgsBar separates the previous messages just fetched
+	printPrevMsgsBar := func() {
+		fmt.Fprintf(v, "%s%s%s\n", "\x1b[38;5;23m",
+			strings.Repeat("–", viewMsgsWidth), "\x1b[0;0m")
+		scrollDelta = viewMsgsLines
+		viewMsgsLines++
+		prevMsgsBar = true
+	}
 	it := r.Events.Iterator()
 	for elem := it.Next(); elem != nil; elem = it.Next() {
-		// DEBUG
-		if t, ok := elem.Value.(mor.Token); ok {
-			fmt.Fprintf(v, "%s%s%s\n", "\x1b[38;5;226m-- Token: ", t, " --\x1b[0;0m")
+		if link, ok := elem.Value.(*mor.RoomLink); ok {
+			printRoomLink(v, r, link)
+			viewMsgsLines++
+		}
+		if _, ok := elem.Value.(*mor.Gap); ok {
+			gapLine := " missing messages – press F5 to load "
+			prevLen := viewMsgsWidth/2 - len([]rune(gapLine))/2
+			afterLen := viewMsgsWidth - prevLen - len([]rune(gapLine))
+			fmt.Fprintf(v, "%s%s%s%s%s\n", "\x1b[38;5;226m",
+				strings.Repeat("–", max(prevLen, 0)), gapLine,
+				strings.Repeat("–", max(afterLen, 0)), "\x1b[0;0m")
 			viewMsgsLines++
 		}
-		if e, ok := elem.Value.(*mor.Event); ok {
+		if e, ok := elem.Value.(*mor.Event); ok && e.ThreadRoot != "" {
+			// The replies are shown in the thread pane, under the
+			// summary of their root
+			if e.ID == roomUI.ScrollAnchorID {
+				anchorLine = viewMsgsLines
+			}
+			if e.ID == roomUI.JumpEventID {
+				jumpLine = viewMsgsLines
+			}
+			count++
+			if count == skipMsgs {
+				// The previous messages end with hidden replies
+				printPrevMsgsBar()
+			}
+			if e.ID == roomUI.LastEventID {
+				newMsgsBar = true
+			}
+		} else if ok {
 			ts := time.Unix(e.Ts/1000, 0)
 			if prevTs.Day() != ts.Day() ||
 				prevTs.Month() != ts.Month() ||
@@ -1053,26 +1737,49 @@ func printRoomMessages(v *gocui.View, r *mor.Room) {
 				newMsgsBar = false
 			}
 			prevTs = ts
-			printMessage(v, e, r)
+			if e.ID == roomUI.JumpEventID {
+				jumpLine = viewMsgsLines
+				highlighted := *e
+				highlighted.Highlight = true
+				e = &highlighted
+			}
+			viewMsgsLines += printMessage(v, e, r)
+			viewMsgsLines += printThreadSummary(v, r, e)
+			if e.ID == roomUI.ScrollAnchorID {
+				anchorLine = viewMsgsLines
+			}
 			count++
-			if count == roomUI.ScrollSkipMsgs {
-				fmt.Fprintf(v, "%s%s%s\n", "\x1b[38;5;23m",
-					strings.Repeat("–", viewMsgsWidth), "\x1b[0;0m")
-				scrollDelta = viewMsgsLines
-				viewMsgsLines++
-				prevMsgsBar = true
+			if count == skipMsgs {
+				printPrevMsgsBar()
 			}
 			if e.ID == roomUI.LastEventID {
 				newMsgsBar = true
 			}
 		}
 	}
+	if t := r.Tombstone(); t != nil {
+		viewMsgsLines += printTombstone(v, r, t)
+	}
 	if roomUI.ScrollSkipMsgs != 0 {
 		//cli.ConsolePrint("roomUI.ScrollDelta = ", roomUI.ScrollDelta)
 		scrollViewMsgs(v, scrollDelta) //+roomUI.ScrollDelta)
 		roomUI.ScrollSkipMsgs = 0
 		//roomUI.ScrollDelta = 0
 	}
+	if roomUI.ScrollAnchorID != "" {
+		roomUI.ScrollAnchorID = ""
+		if anchorLine != 0 {
+			v.SetOrigin(0, max(anchorLine-viewMsgsHeight, 1))
+			scrollViewMsgs(v, 0)
+		}
+	}
+	if roomUI.jumpPending {
+		roomUI.jumpPending = false
+		if jumpLine != 0 {
+			v.SetOrigin(0, max(jumpLine-viewMsgsHeight/2, 1))
+			scrollViewMsgs(v, 0)
+		}
+	}
 }
 
 func printRoomUsers(v *gocui.View, r *mor.Room) {
@@ -1108,6 +1815,7 @@ func printRoomUsers(v *gocui.View, r *mor.Room) {
 func printStatusLine(v *gocui.View, r *mor.Room) {
 	v.Clear()
 	_currentRoom := currentRoom
+	cli := roomCli(_currentRoom)
 	u := _currentRoom.Users.ByID(cli.GetUserID())
 	power := "!"
 	if u != nil {
@@ -1142,21 +1850,41 @@ func eventToStrings(e *mor.Event, r *mor.Room) (nick, text string) {
 		color = nick256Colors[uUI.DispNameHash%uint32(len(nick256Colors))]
 	}
 
+	name := u.String()
+	// Show the name that the sender had when the event was sent
+	if e.SenderName != "" && e.SenderName != u.Name() {
+		name = e.SenderName
+	}
 	switch ec := e.Content.(type) {
 	case mor.Message:
-		nick = strTrimPadLeft(u.String(), timelineUserWidth-10)
+		nick = strTrimPadLeft(name, timelineUserWidth-10)
 		nick = fmt.Sprintf("\x1b[38;5;%dm%s\x1b[39m", color, nick)
 		switch mc := ec.Content.(type) {
 		case mor.TextMessage:
 			body := strings.Replace(mc.Body, "\x1b", "\\x1b", -1)
+			body = strings.Replace(body, noWrapMark, "", -1)
+			baseColor := 0
+			if mc.Type == mor.MsgTxtTypeNotice {
+				baseColor = 246
+			}
+			// Fall back to the plain body if the HTML is broken
+			if renderHTML && mc.FormattedBody != "" {
+				if html, err := renderHTMLBody(mc.FormattedBody, baseColor); err == nil {
+					body = html
+				} else if highlightCode {
+					body = renderFencedCode(body)
+				}
+			} else if highlightCode {
+				body = renderFencedCode(body)
+			}
 			switch mc.Type {
 			case mor.MsgTxtTypeText:
 				text = body
 			case mor.MsgTxtTypeEmote:
 				nick = strTrimPadLeft("*", timelineUserWidth-10)
-				text = fmt.Sprintf("%s %s", u.String(), body)
+				text = fmt.Sprintf("%s %s", name, body)
 			case mor.MsgTxtTypeNotice:
-				text = fmt.Sprintf("\x1b[38;5;246m%s\x1b[39m", body)
+				text = fmt.Sprintf("\x1b[38;5;%dm%s\x1b[39m", baseColor, body)
 			}
 		default:
 			text = fmt.Sprintf("msgtype %s not supported yet", ec.MsgType)
@@ -1188,10 +1916,15 @@ func StringEscapeWidth(s string) (n int) {
 	return n
 }
 
-func printMessage(v *gocui.View, e *mor.Event, r *mor.Room) {
+// printMessage prints an event wrapped to the width of the view and returns
+// the number of lines printed.
+func printMessage(v *gocui.View, e *mor.Event, r *mor.Room) int {
 	msgWidth, _ := v.Size()
 	t := time.Unix(e.Ts/1000, 0)
 	nick, text := eventToStrings(e, r)
+	if e.Highlight {
+		nick = fmt.Sprintf("\x1b[48;5;88m%s\x1b[0m", nick)
+	}
 	// Reset all text attributes
 	fmt.Fprint(v, "\x1b[0m")
 
@@ -1213,6 +1946,14 @@ func printMessage(v *gocui.View, e *mor.Event, r *mor.Room) {
 			//	fmt.Fprint(v, "\x1b[48;5;236m")
 			//}
 		}
+		if strings.Contains(l, noWrapMark) {
+			// The lines of code are truncated instead of wrapped
+			l, strLen = truncateLine(strings.Replace(l, noWrapMark, "", -1), viewMsgsWidth)
+			fmt.Fprint(v, l)
+			fmt.Fprintf(v, "%s\n\x1b[49m", viewMsgWidthSpace[:viewMsgsWidth-strLen])
+			lines += 1
+			continue
+		}
 		for j, w := range strings.Split(l, " ") {
 			wLen := runewidth.StringWidth(w) - StringEscapeWidth(w)
 			if !utf8.ValidString(w) {
@@ -1273,12 +2014,12 @@ func printMessage(v *gocui.View, e *mor.Event, r *mor.Room) {
 	if text == "" {
 		fmt.Fprintf(v, "%s\n", viewMsgWidthSpace)
 	}
-	viewMsgsLines += lines
 	//if lineBackgroundGray {
 	//	lineBackgroundGray = false
 	//} else {
 	//	lineBackgroundGray = true
 	//}
+	return lines
 }
 
 func stringSplit(text string, l uint) (ss []string) {
@@ -1290,7 +2031,10 @@ func stringSplit(text string, l uint) (ss []string) {
 
 func quit(g *gocui.Gui) error {
 	// DEBUG
-	go cli.StopSync()
+	for _, c := range clis {
+		go c.StopSync()
+	}
+	hooks.Stop()
 	return gocui.ErrQuit
 }
 
@@ -1310,14 +2054,37 @@ func keyDebugToggle(g *gocui.Gui, v *gocui.View) error {
 			viewDebug.Title = "Debug"
 			viewDebug.Wrap = true
 		}
-		fmt.Fprint(viewDebug, cli.DebugBuf())
+		fmt.Fprint(viewDebug, roomCli(currentRoom).DebugBuf())
 		g.SetViewOnTop("debug")
 	}
 	return nil
 }
 
 func sendText(body string, r *mor.Room) error {
-	go cli.SendText(r.ID(), body)
+	// Don't let the password reach the console room
+	if body == "/reauth" || strings.HasPrefix(body, "/reauth ") {
+		// The password goes to the account of the room only
+		cli := roomCli(r)
+		password := strings.TrimPrefix(strings.TrimPrefix(body, "/reauth"), " ")
+		select {
+		case reauthChan(cli) <- password:
+		default:
+			cli.ConsolePrintf(mor.MsgTxtTypeNotice, "reauth: session of %s is valid",
+				cli.GetUserID())
+		}
+		return nil
+	}
+	// The messages go to the open thread after /thread reply, the
+	// commands to the console
+	if tv := roomThread(r); tv != nil && tv.isReplying() && !mor.IsCommand(body) {
+		go func() {
+			if err := roomCli(r).SendThreadText(r, tv.rootID, body); err != nil {
+				roomCli(r).ConsolePrint(mor.MsgTxtTypeNotice, "send: ", err)
+			}
+		}()
+		return nil
+	}
+	go roomCli(r).SendText(r.ID(), body)
 	return nil
 }
 
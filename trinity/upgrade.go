@@ -0,0 +1,67 @@
+package main
+
+import (
+	mor "../morpheus"
+	"fmt"
+	//"github.com/jroimartin/gocui"
+	"../../gocui"
+	"strings"
+)
+
+// roomName returns the name of a room of the account, or its ID if we don't
+// have it.
+func roomName(r *mor.Room, roomID string) string {
+	if other := r.Rooms.ByID(roomID); other != nil {
+		return other.String()
+	}
+	return roomID
+}
+
+// printRoomLink shows where the history of the predecessor of the room ends.
+func printRoomLink(v *gocui.View, r *mor.Room, link *mor.RoomLink) {
+	viewMsgsWidth, _ := v.Size()
+	linkLine := fmt.Sprintf(" above: history of %s ", roomName(r, link.RoomID))
+	prevLen := viewMsgsWidth/2 - len([]rune(linkLine))/2
+	afterLen := viewMsgsWidth - prevLen - len([]rune(linkLine))
+	fmt.Fprintf(v, "%s%s%s%s%s\n", "\x1b[38;5;45m",
+		strings.Repeat("–", max(prevLen, 0)), linkLine,
+		strings.Repeat("–", max(afterLen, 0)), "\x1b[0;0m")
+}
+
+// printTombstone shows the banner of an upgraded room after its messages and
+// returns the number of lines printed.
+func printTombstone(v *gocui.View, r *mor.Room, t *mor.Tombstone) int {
+	lines := []string{""}
+	if t.Body != "" {
+		lines = append(lines, t.Body)
+	}
+	if s := r.Successor(); s != nil && s.Mem() == mor.MemJoin {
+		lines = append(lines, fmt.Sprintf(
+			"\x1b[38;5;226mThis room was replaced by %s – press F4 to open it\x1b[0;0m", s))
+	} else {
+		lines = append(lines, fmt.Sprintf(
+			"\x1b[38;5;226mThis room was replaced by %s – press F4 to join the new one\x1b[0;0m",
+			roomName(r, t.ReplacementRoom)))
+	}
+	fmt.Fprintln(v, strings.Join(lines, "\n"))
+	return len(lines)
+}
+
+func joinReplacement(r *mor.Room) {
+	cli := roomCli(r)
+	if err := cli.JoinReplacement(r); err != nil {
+		cli.ConsolePrint(mor.MsgTxtTypeNotice, "join: ", err)
+	}
+}
+
+func keyJoinReplacement(g *gocui.Gui, v *gocui.View) error {
+	if currentRoom.Tombstone() == nil {
+		return nil
+	}
+	if s := currentRoom.Successor(); s != nil && s.Mem() == mor.MemJoin {
+		setCurrentRoom(s, false)
+	} else {
+		go joinReplacement(currentRoom)
+	}
+	return nil
+}